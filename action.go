@@ -0,0 +1,144 @@
+package storm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// Files an action directory can be described by, in order of preference
+var actionFiles = []string{"action.yaml", "action.yml"}
+
+// Load the action of a directory; invalid actions are reported as
+// `Diagnostics`
+func loadAction(directory string) (*ActionConfig, error) {
+	for _, name := range actionFiles {
+		file := filepath.Join(directory, name)
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		ac := ActionConfig{}
+		diagnostics := checkYaml(file, content, actionSchema, &ac, func(root *yaml.Node) Diagnostics {
+			return validateAction(file, root, ac)
+		})
+		if len(diagnostics) > 0 {
+			return nil, diagnostics
+		}
+
+		return &ac, nil
+	}
+
+	return nil, fmt.Errorf("no action.yaml in %s", directory)
+}
+
+// Check the action a step uses and point the step at the action's absolute
+// directory; the step is named after the action unless it has a name
+func (r *includeResolver) action(c *diagnosticCollector, file string, step Step, path []string) (Step, Diagnostics) {
+	usesPath := append(append([]string{}, path...), "uses")
+
+	directory := filepath.Clean(step.Uses)
+	if !filepath.IsAbs(directory) {
+		directory = filepath.Join(filepath.Dir(file), step.Uses)
+	}
+
+	ac, err := loadAction(directory)
+
+	diagnostics := Diagnostics{}
+	if errors.As(err, &diagnostics) {
+		return step, diagnostics
+	}
+	if err != nil {
+		c.add(usesPath, "cannot read action %s; %s", step.Uses, err)
+		return step, nil
+	}
+
+	// Values with expressions are only known when the step runs, they are
+	// checked then
+	dynamic := lo.Filter(lo.Keys(step.With), func(name string, _ int) bool {
+		_, declared := ac.Inputs[name]
+		return declared && expressionPattern.MatchString(step.With[name])
+	})
+
+	_, err = resolveInputs(lo.OmitByKeys(ac.Inputs, dynamic), lo.OmitByKeys(step.With, dynamic))
+	if err != nil {
+		c.add(append(append([]string{}, path...), "with"), "%s: %s", step.Uses, strings.ReplaceAll(err.Error(), "\n", "; "))
+		return step, nil
+	}
+
+	absolute, err := filepath.Abs(directory)
+	if err != nil {
+		c.add(usesPath, "%s", err)
+		return step, nil
+	}
+
+	step.Uses = absolute
+	step.Name = lo.Ternary(step.Name != "", step.Name, ac.Name)
+
+	return step, nil
+}
+
+// Run the steps, or the script, of the action a step uses. The action's
+// inputs are its `with` values; its directory is `STORM_ACTION_PATH`, and its
+// outputs are what its steps write to `STORM_OUTPUT`.
+func (w *Workflow) executeAction(step Step, args ExecuteArgs, facts map[string]string) (map[string]string, int, error) {
+	ac, err := loadAction(step.Uses)
+	if err != nil {
+		return nil, 1, err
+	}
+
+	inputs, err := resolveInputs(ac.Inputs, step.With)
+	if err != nil {
+		return nil, 1, fmt.Errorf("%s: %s", step.Uses, strings.ReplaceAll(err.Error(), "\n", "; "))
+	}
+
+	args.Env = append(append(append([]string{}, args.Env...), InputsEnv(inputs)...), "STORM_ACTION_PATH="+step.Uses)
+
+	steps := ac.Steps
+	if ac.Script != "" {
+		steps = []ActionStep{{Name: ac.Name, Run: ShellQuote(filepath.Join(step.Uses, ac.Script))}}
+	}
+
+	expressions := ExpressionContext{Inputs: inputs, Facts: facts}
+	outputs := map[string]string{}
+
+	for _, actionStep := range steps {
+		stepArgs := args
+
+		// Validation already checked the expressions
+		stepArgs.Command, _ = expressions.interpolateCommand(actionStep.Run)
+		if actionStep.Directory != "" {
+			stepArgs.Directory, _ = expressions.Interpolate(actionStep.Directory)
+		}
+
+		stepOutputs, exitCode, err := w.executeStep(stepArgs)
+		outputs = lo.Assign(outputs, stepOutputs)
+
+		if err != nil {
+			return ac.outputs(outputs), exitCode, err
+		}
+	}
+
+	return ac.outputs(outputs), 0, nil
+}
+
+// The outputs the action declares, or all of them when it declares none; the
+// changed output is always kept
+func (a ActionConfig) outputs(written map[string]string) map[string]string {
+	if len(a.Outputs) > 0 {
+		written = lo.PickByKeys(written, append(lo.Keys(a.Outputs), ChangedOutput))
+	}
+
+	if len(written) == 0 {
+		return nil
+	}
+
+	return written
+}
@@ -0,0 +1,30 @@
+package storm
+
+// An action; a directory with an `action.yaml` whose steps, or script, a
+// workflow step runs with `uses`
+type ActionConfig struct {
+	Name        string                   `yaml:"name" description:"The name of the action." schema:"required,minLength=1"`
+	Description string                   `yaml:"description,omitempty" description:"What the action does."`
+	Inputs      map[string]DispatchInput `yaml:"inputs,omitempty" description:"Inputs given with the step's with; available to the action as ${{ inputs.name }} and STORM_INPUT_NAME."`
+	Outputs     map[string]ActionOutput  `yaml:"outputs,omitempty" description:"Outputs the action writes to STORM_OUTPUT; when declared, the others are dropped."`
+
+	Steps  []ActionStep `yaml:"steps,omitempty" schema:"minItems=1"`
+	Script string       `yaml:"script,omitempty" description:"Executable in the action's directory to run instead of steps, e.g. ./main.sh." schema:"minLength=1"`
+}
+
+func (a *ActionConfig) extendSchema(schema *orderedObject) {
+	schema.Set("oneOf", []map[string][]string{
+		{"required": {"steps"}},
+		{"required": {"script"}},
+	})
+}
+
+type ActionOutput struct {
+	Description string `yaml:"description,omitempty" description:"What the output is."`
+}
+
+type ActionStep struct {
+	Name      string `yaml:"name" description:"The name of the step." schema:"required,minLength=1"`
+	Run       string `yaml:"run" description:"The command to run in this step." schema:"required,minLength=1"`
+	Directory string `yaml:"directory,omitempty" description:"Directory to run the step from"`
+}
@@ -1,13 +1,18 @@
 package storm
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
-	"runtime"
+	"path"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
 )
 
 type Agent struct {
@@ -23,8 +28,45 @@ type RunArgs struct {
 	Wc *WorkflowConfig
 	Ic *InventoryConfig
 
-	Callback       func(interface{})
-	StepOutputType int
+	Handlers []func(Event)
+
+	// Defaults to a new run id
+	RunId   string
+	History *History
+
+	// Recorded run to resume and the step to restart failed jobs from
+	Resume   *RunRecord
+	FromStep string
+
+	// Only run on servers matching these names or labels
+	Limit []string
+
+	// When planning, connect to every server to check it is reachable
+	CheckConnect bool
+
+	// `KEY=value` variables set for every step, on every server
+	Env []string
+
+	// Values of the workflow's `on.dispatch.inputs`
+	Inputs map[string]string
+
+	// Where the facts gathered from servers are kept, and how old cached facts
+	// can be to be used instead of gathering them again
+	FactsCache  *FactsCache
+	FactsMaxAge time.Duration
+
+	// Report what would change on every server instead of changing it, and
+	// show changes to files as unified diffs
+	Check bool
+	Diff  bool
+
+	// Delay before each server starts, from the start of the run; servers
+	// start in the order of their delays
+	StartDelay func(server Server) time.Duration
+
+	// Release directory to upgrade the storm of servers from when it cannot
+	// run the controller's workflows; without one such servers are refused
+	UpgradeFrom string
 }
 
 type RunOption func(*RunArgs)
@@ -43,94 +85,239 @@ func (a *Agent) AgentWithFiles(w string, i string) RunOption {
 	}
 }
 
-func (a *Agent) AgentWithCallback(callback func(interface{}), format int) RunOption {
+// Receive every event of the run, tagged with the server it happened on; can
+// be used multiple times. Without any handler the run is rendered as plain
+// text to stdout.
+func (a *Agent) AgentWithHandler(handler func(Event)) RunOption {
 	return func(ra *RunArgs) {
-		ra.Callback = callback
-		ra.StepOutputType = format
+		ra.Handlers = append(ra.Handlers, handler)
 	}
 }
 
-func (a *Agent) Run(opts ...RunOption) error {
-	var wc *WorkflowConfig
-	var ic *InventoryConfig
-	args := RunArgs{
-		StepOutputType: StepOutputTypePlain,
+// Publish every event of the run to the bus' subscribers
+func (a *Agent) AgentWithEvents(bus *EventBus) RunOption {
+	return a.AgentWithHandler(bus.Publish)
+}
+
+func (a *Agent) AgentWithRunId(id string) RunOption {
+	return func(ra *RunArgs) {
+		ra.RunId = id
 	}
+}
 
-	for _, opt := range opts {
-		opt(&args)
+// Record the run, with the events and outputs of every server, in the run
+// history
+func (a *Agent) AgentWithHistory(history *History) RunOption {
+	return func(ra *RunArgs) {
+		ra.History = history
+	}
+}
+
+// Skip, on every server, the jobs a recorded run completed and restart from
+// the first one it did not; optionally from a given step of that job
+func (a *Agent) AgentWithResume(record RunRecord, fromStep string) RunOption {
+	return func(ra *RunArgs) {
+		ra.Resume = &record
+		ra.FromStep = fromStep
+	}
+}
+
+// Only run on the servers matching any of these names or labels
+func (a *Agent) AgentWithLimit(selectors ...string) RunOption {
+	return func(ra *RunArgs) {
+		ra.Limit = append(ra.Limit, selectors...)
+	}
+}
+
+// When planning, connect to every server to check it is reachable
+func (a *Agent) AgentWithConnectionCheck() RunOption {
+	return func(ra *RunArgs) {
+		ra.CheckConnect = true
+	}
+}
+
+// Set `KEY=value` environment variables for every step, on every server
+func (a *Agent) AgentWithEnv(env ...string) RunOption {
+	return func(ra *RunArgs) {
+		ra.Env = append(ra.Env, env...)
+	}
+}
+
+// Give the workflow's `on.dispatch.inputs`; checked before connecting to any
+// server
+func (a *Agent) AgentWithInputs(inputs map[string]string) RunOption {
+	return func(ra *RunArgs) {
+		ra.Inputs = inputs
+	}
+}
+
+// Keep the facts gathered from each server in the cache, and use cached ones
+// younger than maxAge instead of gathering them again; 0 always gathers them
+func (a *Agent) AgentWithFactsCache(cache *FactsCache, maxAge time.Duration) RunOption {
+	return func(ra *RunArgs) {
+		ra.FactsCache = cache
+		ra.FactsMaxAge = maxAge
+	}
+}
+
+// Report what the run would change on every server without changing anything;
+// see `Workflow.WorkflowWithCheck`
+func (a *Agent) AgentWithCheck() RunOption {
+	return func(ra *RunArgs) {
+		ra.Check = true
+	}
+}
+
+// Show the changes to files, made or that would be, as unified diffs
+func (a *Agent) AgentWithDiff() RunOption {
+	return func(ra *RunArgs) {
+		ra.Diff = true
 	}
+}
 
+// Start each server after its own delay from the start of the run, e.g. to
+// spread scheduled runs out; servers start in the order of their delays
+func (a *Agent) AgentWithStartDelay(delay func(server Server) time.Duration) RunOption {
+	return func(ra *RunArgs) {
+		ra.StartDelay = delay
+	}
+}
+
+// Upgrade storm on servers where it is missing or incompatible, from a
+// release directory, instead of refusing to run on them
+func (a *Agent) AgentWithUpgrade(releaseDirectory string) RunOption {
+	return func(ra *RunArgs) {
+		ra.UpgradeFrom = releaseDirectory
+	}
+}
+
+func (a *Agent) configs(args RunArgs) (*WorkflowConfig, *InventoryConfig, error) {
 	if args.Wf != nil && args.If != nil {
-		_wc, err := a.workflow.Load(*args.Wf)
+		wc, err := a.workflow.Load(*args.Wf)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		wc = _wc
 
-		_ic, err := a.inventory.Load(*args.If)
+		ic, err := a.inventory.Load(*args.If)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		ic = _ic
-	} else {
-		wc = args.Wc
-		ic = args.Ic
+
+		return wc, ic, nil
 	}
 
-	if wc == nil && ic == nil {
-		return errors.New("invalid inventory and workflow configurations")
+	if args.Wc == nil || args.Ic == nil {
+		return nil, nil, errors.New("invalid inventory and workflow configurations")
 	}
 
-	callback := func(s string) {
-		if args.StepOutputType == StepOutputTypePlain {
-			fmt.Println(s)
-		} else {
-			args.Callback(s)
-		}
+	return args.Wc, args.Ic, nil
+}
+
+var ErrInvalidServerSelection = errors.New("invalid server selection")
+
+// The servers of the inventory a run goes to; a limit selecting none of them,
+// e.g. a mistyped name or label, is an error rather than a run doing nothing
+func selectServers(ic InventoryConfig, limit []string) ([]Server, error) {
+	servers := ic.Select(limit...)
+	if len(limit) > 0 && len(servers) == 0 {
+		return nil, errors.Join(ErrInvalidServerSelection, fmt.Errorf("no server of the inventory matches %s", strings.Join(limit, ", ")))
 	}
 
-	for _, server := range ic.Servers {
-		if args.StepOutputType == StepOutputTypePlain {
-			fmt.Printf("Server: [%s]\n", server.Name)
-		}
+	return servers, nil
+}
 
-		sshClient, err := a.ssh.Authenticate(AuthenticateArgs{
-			Host:          server.Host,
-			Port:          server.Port,
-			User:          server.User,
-			Password:      server.SshPassword,
-			PrivateSshKey: server.PrivateSshKey,
+func (a *Agent) Run(opts ...RunOption) (err error) {
+	args := RunArgs{}
+
+	for _, opt := range opts {
+		opt(&args)
+	}
+
+	wc, ic, err := a.configs(args)
+	if err != nil {
+		return err
+	}
+
+	// Servers interpolate the inputs themselves, they only need checking
+	inputs, err := ResolveInputs(*wc, args.Inputs)
+	if err != nil {
+		return err
+	}
+
+	servers, err := selectServers(*ic, args.Limit)
+	if err != nil {
+		return err
+	}
+
+	if len(args.Handlers) == 0 {
+		args.Handlers = append(args.Handlers, NewPlainRenderer(os.Stdout).Render)
+	}
+
+	if args.RunId == "" {
+		args.RunId = NewRunId()
+	}
+
+	if args.History != nil {
+		recorder, startErr := args.History.Start(HistoryStartArgs{
+			Id:       args.RunId,
+			Mode:     RunModeAgent,
+			Workflow: *wc,
+			Inputs:   inputs,
+
+			ResumedFrom: lo.TernaryF(args.Resume != nil, func() string { return args.Resume.Id }, func() string { return "" }),
 		})
-		if err != nil {
-			return errors.Join(err, errors.New("authentication failed"))
+		if startErr != nil {
+			return startErr
 		}
+		defer func() { recorder.Finish(err) }()
 
-		destinationFilePath := fmt.Sprintf("/home/%s/workflow.yaml", server.User)
-		content, err := a.workflow.Dump(*wc)
-		if err != nil {
-			log.Println(err)
+		args.Handlers = append(args.Handlers, recorder.Handle)
+	}
+
+	emit := newEventDispatcher(args.Handlers)
+
+	var binaries *binaryCache
+	if args.UpgradeFrom != "" {
+		if binaries, err = newBinaryCache(releaseBinary(args.UpgradeFrom)); err != nil {
+			return err
+		}
+		defer binaries.Close()
+	}
 
-			return errors.Join(errors.New("could dump workflow config"), err)
+	started := time.Now()
+	if args.StartDelay != nil {
+		servers = append([]Server{}, servers...)
+		sort.SliceStable(servers, func(i, j int) bool { return args.StartDelay(servers[i]) < args.StartDelay(servers[j]) })
+	}
+
+	for _, server := range servers {
+		finished := false
+
+		if args.StartDelay != nil {
+			time.Sleep(time.Until(started.Add(args.StartDelay(server))))
 		}
 
-		_, _, err = a.ssh.ExecuteCommand(ExecuteCommandArgs{
-			Client:         sshClient,
-			Command:        fmt.Sprintf("echo '%s' > %s", *content, destinationFilePath),
-			OutputCallback: func(s string) {},
-			ErrorCallback:  func(s string) { fmt.Println(s) },
-		})
-		if err != nil {
-			return errors.Join(errors.New("could generate workflow file"), err)
+		var resume *ResumeState
+		if args.Resume != nil {
+			resume = lo.ToPtr(NewResumeState(*args.Resume, server.Name, args.FromStep))
 		}
 
-		_, _, err = a.ssh.ExecuteCommand(ExecuteCommandArgs{
-			Client:         sshClient,
-			Command:        fmt.Sprintf("~/.storm/bin/storm run -f=%d %s", args.StepOutputType, destinationFilePath),
-			OutputCallback: callback,
-			ErrorCallback:  callback,
+		err := a.runOnServer(server, *wc, resume, args, binaries, inputs, NewTemplateData(*ic, server), func(e Event) {
+			e.Meta().RunId = args.RunId
+			e.Meta().Host = server.Name
+			finished = finished || e.Type() == EventRunFinished
+			emit(e)
 		})
 		if err != nil {
+			// The server never reported back, e.g. it could not be reached
+			if !finished {
+				emit(&RunFinished{
+					EventMeta: EventMeta{RunId: args.RunId, Time: time.Now().UTC(), Host: server.Name, Workflow: wc.Name},
+					ExitCode:  1,
+					Error:     err.Error(),
+				})
+			}
+
 			return err
 		}
 	}
@@ -138,113 +325,198 @@ func (a *Agent) Run(opts ...RunOption) error {
 	return nil
 }
 
-// This is meant for testing locally or in CI
-func (a *Agent) InstallDev(ic InventoryConfig) error {
-	os.Setenv("GOOS", "linux")
-	os.Setenv("GOARCH", "arm64")
+// Ship the workflow to a per-run workspace on the server, run it with the
+// remote storm binary and remove the workspace afterwards. The remote binary
+// speaks the event protocol, its lines are decoded back into events; it is
+// checked to speak the controller's first, and upgraded from the binaries
+// when there are any.
+func (a *Agent) runOnServer(server Server, wc WorkflowConfig, resume *ResumeState, args RunArgs, binaries *binaryCache, inputs map[string]string, data TemplateData, emit func(Event)) error {
+	sshClient, err := a.ssh.Authenticate(AuthenticateArgs{
+		Host:          server.Host,
+		Port:          server.Port,
+		User:          server.User,
+		Password:      server.SshPassword,
+		PrivateSshKey: server.PrivateSshKey,
+	})
+	if err != nil {
+		return errors.Join(err, errors.New("authentication failed"))
+	}
+	defer sshClient.Close()
 
-	_, err := exec.Command("go", "build", "-o", "storm", "./cmd").Output()
+	upgrade, err := a.handshake(sshClient, binaries)
 	if err != nil {
-		return errors.Join(errors.New("build failed; could not build storm"), err)
+		return err
+	}
+	if upgrade != "" {
+		emit(&StepOutput{
+			EventMeta: EventMeta{Time: time.Now().UTC()},
+			Stream:    StreamStdout,
+			Line:      upgrade,
+		})
 	}
 
-	defer os.Remove("./storm")
+	workspace, err := a.createWorkspace(sshClient, NewRunId())
+	if err != nil {
+		return errors.Join(errors.New("could not create workspace"), err)
+	}
+	defer func() {
+		if err := a.ssh.RemoveAll(sshClient, workspace); err != nil {
+			fmt.Println(errors.Join(fmt.Errorf("could not remove workspace %s", workspace), err))
+		}
+	}()
 
-	for _, server := range ic.Servers {
-		fmt.Printf("Server: [%s]\n", server.Name)
+	facts, err := a.serverFacts(sshClient, server, args.FactsCache, args.FactsMaxAge)
+	if err != nil {
+		return err
+	}
 
-		sshClient, err := a.ssh.Authenticate(AuthenticateArgs{
-			Host:          server.Host,
-			Port:          server.Port,
-			User:          server.User,
-			Password:      server.SshPassword,
-			PrivateSshKey: server.PrivateSshKey,
-		})
-		if err != nil {
-			return err
-		}
+	// Actions, copied files and rendered templates are shipped along, the
+	// workflow refers to them in the workspace
+	data.Facts = facts
+	data.Inputs = inputs
+	data.Workflow = wc.Name
 
-		fmt.Print("Installing storm on server ... ")
+	wc, bundle, err := bundleWorkflow(wc, workspace, data)
+	if err != nil {
+		return err
+	}
 
-		err = a.ssh.CopyTo(sshClient, "./storm", fmt.Sprintf("/home/%s/.storm/bin/storm", server.User))
-		if err != nil {
-			fmt.Print(errors.Join(errors.New("ssh can't copy file"), err))
+	content, err := a.workflow.Dump(wc)
+	if err != nil {
+		log.Println(err)
 
-			return err
-		}
+		return errors.Join(errors.New("could dump workflow config"), err)
+	}
 
-		_, _, err = a.ssh.ExecuteCommand(ExecuteCommandArgs{
-			Client:         sshClient,
-			Command:        "chmod +x ~/.storm/bin/storm",
-			OutputCallback: func(s string) {},
-			ErrorCallback:  func(s string) { fmt.Println("> ", s) },
-		})
+	destinationFilePath := path.Join(workspace, "workflow.yaml")
+	err = a.ssh.WriteFile(sshClient, []byte(*content), destinationFilePath, 0600)
+	if err != nil {
+		return errors.Join(errors.New("could generate workflow file"), err)
+	}
+
+	command := fmt.Sprintf("~/.storm/bin/storm run -t=false --history=false -f=%s", RendererJson)
+
+	factsContent, err := json.Marshal(facts)
+	if err != nil {
+		return err
+	}
+
+	factsFilePath := path.Join(workspace, "facts.json")
+	err = a.ssh.WriteFile(sshClient, factsContent, factsFilePath, 0600)
+	if err != nil {
+		return errors.Join(errors.New("could not ship facts"), err)
+	}
+
+	command += fmt.Sprintf(" --facts=%s", ShellQuote(factsFilePath))
+
+	if args.Check {
+		command += " --check"
+	}
+	if args.Diff {
+		command += " --diff"
+	}
+
+	if bundle != nil {
+		bundleFilePath := path.Join(workspace, "bundle.tar.gz")
+		err = a.ssh.WriteFile(sshClient, bundle, bundleFilePath, 0600)
 		if err != nil {
-			return err
+			return errors.Join(errors.New("could not ship bundle"), err)
 		}
 
-		fmt.Println("Storm is Ready!")
+		command += fmt.Sprintf(" --bundle=%s", ShellQuote(bundleFilePath))
 	}
 
-	return nil
-}
+	for _, variable := range args.Env {
+		command += fmt.Sprintf(" --env=%s", ShellQuote(variable))
+	}
 
-func (a *Agent) InstallProd(ic InventoryConfig) error {
-	for _, server := range ic.Servers {
-		fmt.Printf("Server: [%s]\n", server.Name)
+	for name, value := range inputs {
+		command += fmt.Sprintf(" --input=%s", ShellQuote(name+"="+value))
+	}
 
-		sshClient, err := a.ssh.Authenticate(AuthenticateArgs{
-			Host:          server.Host,
-			Port:          server.Port,
-			User:          server.User,
-			Password:      server.SshPassword,
-			PrivateSshKey: server.PrivateSshKey,
-		})
+	if resume != nil {
+		content, err := resume.Dump()
 		if err != nil {
 			return err
 		}
 
-		platform := strings.Split(runtime.GOOS, "/")[0]
-		fmt.Println("Installing storm on server ... ")
-
-		switch platform {
-		case "windows":
-			_, _, err := a.ssh.ExecuteCommand(ExecuteCommandArgs{
-				Client:         sshClient,
-				Command:        "powershell -c irm https://raw.githubusercontent.com/Overal-X/formatio.storm/main/scripts/install.sh | iex",
-				OutputCallback: func(s string) {},
-				ErrorCallback:  func(s string) {},
-			})
-			if err != nil {
-				return errors.Join(err, errors.New("build failed; could not install storm"))
-			}
-		case "linux":
-		case "darwin":
-			_, _, err := a.ssh.ExecuteCommand(ExecuteCommandArgs{
-				Client:         sshClient,
-				Command:        "curl -fsSL https://raw.githubusercontent.com/Overal-X/formatio.storm/main/scripts/install.sh | bash",
-				OutputCallback: func(s string) { fmt.Println("> ", s) },
-				ErrorCallback:  func(s string) { fmt.Println("> ", s) },
-			})
+		resumeFilePath := path.Join(workspace, "resume.json")
+		err = a.ssh.WriteFile(sshClient, content, resumeFilePath, 0600)
+		if err != nil {
+			return errors.Join(errors.New("could not generate resume state file"), err)
+		}
+
+		command += fmt.Sprintf(" --resume-state=%s", ShellQuote(resumeFilePath))
+	}
+
+	callback := func(stream string) func(string) {
+		return func(line string) {
+			event, err := UnmarshalEvent([]byte(line))
 			if err != nil {
-				return errors.Join(err, errors.New("build failed; could not install storm"))
+				// Anything that is not an event is passed through as-is
+				event = &StepOutput{
+					EventMeta: EventMeta{Time: time.Now().UTC()},
+					Stream:    stream,
+					Line:      line,
+				}
 			}
-		default:
-			return errors.New("platform not supported")
+
+			emit(event)
 		}
+	}
 
-		fmt.Println("Storm is Ready!")
+	_, _, err = a.ssh.ExecuteCommand(ExecuteCommandArgs{
+		Client:         sshClient,
+		Command:        fmt.Sprintf("%s %s", command, ShellQuote(destinationFilePath)),
+		OutputCallback: callback(StreamStdout),
+		ErrorCallback:  callback(StreamStderr),
+	})
+	if err != nil {
+		return err
 	}
 
 	return nil
 }
 
+// Create a private directory for a single run under the remote user's home;
+// `~/.storm/workspace/<run-id>`
+func (a *Agent) createWorkspace(client *ssh.Client, runId string) (string, error) {
+	home, err := a.ssh.HomeDirectory(client)
+	if err != nil {
+		return "", err
+	}
+
+	workspace := path.Join(home, ".storm", "workspace", runId)
+	err = a.ssh.CreatePrivateDirectory(client, workspace)
+	if err != nil {
+		return "", err
+	}
+
+	return workspace, nil
+}
+
+// Build storm from the source in the current directory for the platform of
+// every server and install it; meant for testing locally or in CI
+func (a *Agent) InstallDev(ic InventoryConfig) error {
+	return a.install(ic, buildBinary)
+}
+
+// Install storm from a local release directory, for the platform of every
+// server; servers need no internet access
+func (a *Agent) InstallProd(ic InventoryConfig, releaseDirectory string) error {
+	return a.install(ic, releaseBinary(releaseDirectory))
+}
+
 type InstallArgs struct {
 	If string
 	Ic InventoryConfig
 
 	// Installation mode; options are `dev` or `prod`
 	Mode string
+
+	// Where `prod` installations take storm from; defaults to goreleaser's
+	// `./dist`
+	ReleaseDirectory string
 }
 
 func (a *Agent) Install(args InstallArgs) error {
@@ -262,7 +534,7 @@ func (a *Agent) Install(args InstallArgs) error {
 	case "dev":
 		return a.InstallDev(*ic)
 	case "prod":
-		return a.InstallProd(*ic)
+		return a.InstallProd(*ic, lo.Ternary(args.ReleaseDirectory != "", args.ReleaseDirectory, DefaultReleaseDirectory))
 	default:
 		return errors.New("installation mode not supported")
 	}
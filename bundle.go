@@ -0,0 +1,277 @@
+package storm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// A file or directory of a bundle; read from `source`, or made of `content`
+type bundleEntry struct {
+	// Path in the archive
+	name string
+
+	source  string
+	content []byte
+}
+
+// Pack what the workflow's steps read on the controller into a tar.gz; the
+// actions they use, the files they copy and their templates, rendered with
+// `data`. Steps are pointed at where `ExtractBundle` unpacks the archive in
+// the workspace, and templates become copies of their rendered files. Without
+// any, the workflow is returned as-is and the archive is nil.
+func bundleWorkflow(wc WorkflowConfig, workspace string, data TemplateData) (WorkflowConfig, []byte, error) {
+	// Local path => path in the archive
+	names := map[string]string{}
+	entries := []bundleEntry{}
+
+	add := func(directory string, source string, content []byte) string {
+		if name, found := names[source]; found && content == nil {
+			return name
+		}
+
+		name := path.Join(directory, fmt.Sprintf("%d-%s", len(entries), filepath.Base(source)))
+		if content == nil {
+			names[source] = name
+		}
+		entries = append(entries, bundleEntry{name: name, source: source, content: content})
+
+		return name
+	}
+
+	bundleSteps := func(job Job, steps []Step) ([]Step, error) {
+		if steps == nil {
+			return nil, nil
+		}
+
+		bundled := make([]Step, len(steps))
+
+		for i, step := range steps {
+			switch {
+			case step.Uses != "":
+				step.Uses = path.Join(workspace, add("actions", step.Uses, nil))
+			case step.Copy != nil:
+				copied := *step.Copy
+				copied.Src = path.Join(workspace, add("files", copied.Src, nil))
+				step.Copy = &copied
+			case step.Template != nil:
+				jobData := data
+				jobData.Job = job.Name
+
+				content, err := renderTemplate(step.Template.Src, jobData)
+				if err != nil {
+					return nil, errors.Join(fmt.Errorf("could not render %s", step.Template.Src), err)
+				}
+
+				// Servers copy the rendered file, they do not have the variables
+				rendered := *step.Template
+				rendered.Src = path.Join(workspace, add("files", step.Template.Src, content))
+				step.Copy, step.Template = &rendered, nil
+			}
+
+			bundled[i] = step
+		}
+
+		return bundled, nil
+	}
+
+	jobs := make([]Job, len(wc.Jobs))
+	for i, job := range wc.Jobs {
+		steps, err := bundleSteps(job, job.Steps)
+		if err != nil {
+			return wc, nil, err
+		}
+
+		handlers, err := bundleSteps(job, job.Handlers)
+		if err != nil {
+			return wc, nil, err
+		}
+
+		job.Steps = steps
+		job.Handlers = handlers
+		jobs[i] = job
+	}
+
+	if len(entries) == 0 {
+		return wc, nil, nil
+	}
+
+	wc.Jobs = jobs
+
+	buffer := bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for _, entry := range entries {
+		var err error
+		if entry.content != nil {
+			err = archiveContent(tarWriter, entry.name, entry.content, templateMode)
+		} else {
+			err = archivePath(tarWriter, entry.source, entry.name)
+		}
+
+		if err != nil {
+			return wc, nil, errors.Join(fmt.Errorf("could not bundle %s", entry.source), err)
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return wc, nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return wc, nil, err
+	}
+
+	return wc, buffer.Bytes(), nil
+}
+
+// Add a file, or a directory's files, to an archive as `name`, keeping their
+// modes and the symlinks inside directories
+func archivePath(tarWriter *tar.Writer, source string, name string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return archiveFile(tarWriter, source, info, name)
+	}
+
+	return filepath.WalkDir(source, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(source, file)
+		if err != nil {
+			return err
+		}
+
+		return archiveFile(tarWriter, file, info, path.Join(name, filepath.ToSlash(relative)))
+	})
+}
+
+func archiveFile(tarWriter *tar.Writer, file string, info fs.FileInfo, name string) error {
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(file); err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	source, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	_, err = io.Copy(tarWriter, source)
+
+	return err
+}
+
+func archiveContent(tarWriter *tar.Writer, name string, content []byte, mode fs.FileMode) error {
+	header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: int64(mode), Size: int64(len(content))}
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := tarWriter.Write(content)
+
+	return err
+}
+
+// Unpack what the agent bundled with a workflow next to the archive
+func ExtractBundle(archive string) error {
+	destination := filepath.Dir(archive)
+
+	file, err := os.Open(archive)
+	if err != nil {
+		return errors.Join(errors.New("could not open bundle"), err)
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return errors.Join(errors.New("invalid bundle"), err)
+	}
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Join(errors.New("invalid bundle"), err)
+		}
+
+		if !filepath.IsLocal(header.Name) {
+			return fmt.Errorf("invalid path %q in bundle", header.Name)
+		}
+
+		target := filepath.Join(destination, header.Name)
+		mode := header.FileInfo().Mode().Perm()
+
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode|0700)
+		case tar.TypeSymlink:
+			err = os.Symlink(header.Linkname, target)
+		case tar.TypeReg:
+			err = extractFile(tarReader, target, mode)
+		}
+
+		if err != nil {
+			return errors.Join(fmt.Errorf("could not extract %s", header.Name), err)
+		}
+	}
+}
+
+func extractFile(reader io.Reader, target string, mode fs.FileMode) error {
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, reader)
+	if err != nil {
+		return err
+	}
+
+	// The umask can narrow the mode of new files
+	return os.Chmod(target, mode)
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	_ "time/tzdata" // timezones of schedules, on hosts without a zoneinfo database
 
 	storm "github.com/Overal-X/formatio.storm"
 	"github.com/samber/lo"
@@ -25,7 +33,7 @@ var versionCmd = &cobra.Command{
 	Short: "Print the version number",
 	Long:  `All software has versions. This is the version of your application.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Printf("Version: %s\nCommit: %s\nBuild Date: %s\n", version, commit, buildDate)
+		fmt.Printf("Version: %s\nCommit: %s\nBuild Date: %s\nProtocol: %d\n", version, commit, buildDate, storm.AgentProtocolVersion)
 	},
 }
 
@@ -35,19 +43,130 @@ var agentCmd = &cobra.Command{
 }
 
 var agentRunWorkflowCmd = &cobra.Command{
-	Use:  "run",
-	Args: cobra.ExactArgs(1),
+	Use:  "run [workflow]",
+	Args: cobra.RangeArgs(0, 1),
 	Run: func(cmd *cobra.Command, args []string) {
-		workflowFile := args[0]
 		inventoryFile, _ := cmd.Flags().GetString("inventory")
-		format, _ := cmd.Flags().GetInt("format")
+		format, _ := cmd.Flags().GetString("format")
+		resumeRunId, _ := cmd.Flags().GetString("resume")
+		fromStep, _ := cmd.Flags().GetString("from-step")
+
+		if (len(args) == 0) == (resumeRunId == "") {
+			fmt.Println("either a workflow file or --resume must be specified")
+			os.Exit(1)
+		}
+
+		renderer, err := storm.NewRenderer(format, os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		inputs, err := parseInputs(cmd)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		options := []storm.RunOption{}
 
 		agent := storm.NewAgent()
-		err := agent.Run(
-			agent.AgentWithFiles(workflowFile, inventoryFile),
-			agent.AgentWithCallback(func(i interface{}) { fmt.Println(i) }, format),
-		)
+		options = append(options, agent.AgentWithHandler(renderer.Render))
+
+		if resumeRunId != "" {
+			record, wc, err := loadResume(resumeRunId, storm.RunModeAgent)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			inputs = lo.Assign(record.Inputs, inputs)
+
+			ic, err := storm.NewInventory().Load(inventoryFile)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			options = append(options,
+				agent.AgentWithConfigs(*wc, *ic),
+				agent.AgentWithResume(*record, fromStep),
+			)
+		} else {
+			options = append(options, agent.AgentWithFiles(args[0], inventoryFile))
+		}
+
+		if limit, _ := cmd.Flags().GetStringSlice("limit"); len(limit) > 0 {
+			options = append(options, agent.AgentWithLimit(limit...))
+		}
+
+		if env, _ := cmd.Flags().GetStringArray("env"); len(env) > 0 {
+			options = append(options, agent.AgentWithEnv(env...))
+		}
+
+		options = append(options, agent.AgentWithInputs(inputs))
+
+		factsCache, err := newFactsCache()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		factsMaxAge, _ := cmd.Flags().GetDuration("facts-max-age")
+		options = append(options, agent.AgentWithFactsCache(factsCache, factsMaxAge))
+
+		check, _ := cmd.Flags().GetBool("check")
+		if check {
+			options = append(options, agent.AgentWithCheck())
+		}
+		if diff, _ := cmd.Flags().GetBool("diff"); diff {
+			options = append(options, agent.AgentWithDiff())
+		}
+
+		if upgrade, _ := cmd.Flags().GetBool("upgrade"); upgrade {
+			releaseDirectory, _ := cmd.Flags().GetString("release-dir")
+			options = append(options, agent.AgentWithUpgrade(releaseDirectory))
+		}
+
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			if checkConnect, _ := cmd.Flags().GetBool("check-connect"); checkConnect {
+				options = append(options, agent.AgentWithConnectionCheck())
+			}
+
+			plan, err := agent.Plan(options...)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			printPlan(*plan, format)
+			if !plan.Reachable() {
+				os.Exit(1)
+			}
+
+			return
+		}
+
+		// Check runs change nothing, resuming one would skip jobs that never ran
+		if recordHistory, _ := cmd.Flags().GetBool("history"); recordHistory && !check {
+			history, err := newHistory()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			options = append(options, agent.AgentWithHistory(history))
+		}
+
+		err = agent.Run(options...)
 		if err != nil {
+			// Run failures are rendered as they happen, invalid files, inputs
+			// and server selections are not
+			diagnostics := storm.Diagnostics{}
+			if errors.As(err, &diagnostics) || errors.Is(err, storm.ErrInvalidInputs) || errors.Is(err, storm.ErrInvalidServerSelection) {
+				fmt.Println(err)
+			}
+
 			os.Exit(1)
 		}
 	},
@@ -58,13 +177,41 @@ var agentInstallCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		inventoryFile, _ := cmd.Flags().GetString("inventory")
 		installationMode, _ := cmd.Flags().GetString("mode")
+		releaseDirectory, _ := cmd.Flags().GetString("release-dir")
 
 		agent := storm.NewAgent()
 		err := agent.Install(storm.InstallArgs{
-			If:   inventoryFile,
-			Mode: installationMode,
+			If:               inventoryFile,
+			Mode:             installationMode,
+			ReleaseDirectory: releaseDirectory,
 		})
 		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+var agentUpgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Roll this version of storm out to the inventory's servers, rolling every server back when one fails",
+	Run: func(cmd *cobra.Command, args []string) {
+		inventoryFile, _ := cmd.Flags().GetString("inventory")
+		installationMode, _ := cmd.Flags().GetString("mode")
+		releaseDirectory, _ := cmd.Flags().GetString("release-dir")
+		limit, _ := cmd.Flags().GetStringSlice("limit")
+		force, _ := cmd.Flags().GetBool("force")
+
+		agent := storm.NewAgent()
+		err := agent.Upgrade(storm.UpgradeArgs{
+			If:               inventoryFile,
+			Limit:            limit,
+			Mode:             installationMode,
+			ReleaseDirectory: releaseDirectory,
+			Force:            force,
+		})
+		if err != nil {
+			fmt.Println(err)
 			os.Exit(1)
 		}
 	},
@@ -84,55 +231,964 @@ var agentUninstallCmd = &cobra.Command{
 }
 
 var runWorkflowCmd = &cobra.Command{
-	Use:  "run",
-	Args: cobra.ExactArgs(1),
+	Use:  "run [workflow]",
+	Args: cobra.RangeArgs(0, 1),
 	Run: func(cmd *cobra.Command, args []string) {
-		workflowFile := args[0]
 		trashWorkflow, _ := cmd.Flags().GetBool("trash-workflow")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
 		directory, _ := cmd.Flags().GetString("directory")
-		format, _ := cmd.Flags().GetInt("format")
+		format, _ := cmd.Flags().GetString("format")
+		resumeRunId, _ := cmd.Flags().GetString("resume")
+		fromStep, _ := cmd.Flags().GetString("from-step")
+		resumeStateFile, _ := cmd.Flags().GetString("resume-state")
+		bundle, _ := cmd.Flags().GetString("bundle")
+		factsFile, _ := cmd.Flags().GetString("facts")
 
-		if trashWorkflow {
-			defer os.Remove(workflowFile)
+		if (len(args) == 0) == (resumeRunId == "") {
+			fmt.Println("either a workflow file or --resume must be specified")
+			os.Exit(1)
 		}
 
-		workflow := storm.NewWorkflow()
+		renderer, err := storm.NewRenderer(format, os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
-		wc, err := workflow.Load(workflowFile)
+		inputs, err := parseInputs(cmd)
 		if err != nil {
+			fmt.Println(err)
 			os.Exit(1)
 		}
 
+		workflow := storm.NewWorkflow()
+		options := []storm.WorkflowRunOptions{}
+
+		var wc *storm.WorkflowConfig
+		if resumeRunId != "" {
+			record, _wc, err := loadResume(resumeRunId, storm.RunModeLocal)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			wc = _wc
+			inputs = lo.Assign(record.Inputs, inputs)
+			options = append(options, workflow.WorkflowWithResume(storm.NewResumeState(*record, storm.LocalHost, fromStep)))
+		} else {
+			workflowFile := args[0]
+			if trashWorkflow && !dryRun {
+				defer os.Remove(workflowFile)
+			}
+
+			// The agent ships the actions and files the workflow uses along with it
+			if bundle != "" {
+				if err := storm.ExtractBundle(bundle); err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
+
+			wc, err = workflow.Load(workflowFile)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		// The agent hands over what the controller recorded for this server
+		if resumeStateFile != "" {
+			state, err := storm.LoadResumeState(resumeStateFile)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			options = append(options, workflow.WorkflowWithResume(*state))
+		}
+
+		// The agent hands over the facts it gathered from this server
+		if factsFile != "" {
+			facts, err := storm.LoadFacts(factsFile)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			options = append(options, workflow.WorkflowWithFacts(*facts))
+		}
+
 		wc.Directory = lo.Ternary(wc.Directory == "" && directory != "", directory, wc.Directory)
 
-		err = workflow.Run(
+		options = append(options,
 			workflow.WorkflowWithConfig(*wc),
-			workflow.WorkflowWithCallback(func(i interface{}) { fmt.Println(i) }, format))
+			workflow.WorkflowWithHandler(renderer.Render),
+		)
+
+		if env, _ := cmd.Flags().GetStringArray("env"); len(env) > 0 {
+			options = append(options, workflow.WorkflowWithEnv(env...))
+		}
+
+		if _, err := storm.ResolveInputs(*wc, inputs); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		options = append(options, workflow.WorkflowWithInputs(inputs))
+
+		check, _ := cmd.Flags().GetBool("check")
+		if check {
+			options = append(options, workflow.WorkflowWithCheck())
+		}
+		if diff, _ := cmd.Flags().GetBool("diff"); diff {
+			options = append(options, workflow.WorkflowWithDiff())
+		}
+
+		// Check runs change nothing, resuming one would skip jobs that never ran
+		if recordHistory, _ := cmd.Flags().GetBool("history"); recordHistory && !check {
+			history, err := newHistory()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			options = append(options, workflow.WorkflowWithHistory(history))
+		}
+
+		if dryRun {
+			plan, err := workflow.Plan(options...)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			printPlan(*plan, format)
+
+			return
+		}
+
+		// Run failures are rendered as they happen, errors before the run
+		// starts, e.g. a step to resume from the workflow does not have, are not
+		finished := false
+		options = append(options, workflow.WorkflowWithHandler(func(event storm.Event) {
+			if _, ok := event.(*storm.RunFinished); ok {
+				finished = true
+			}
+		}))
+
+		err = workflow.Run(options...)
 		if err != nil {
+			if !finished {
+				fmt.Println(err)
+			}
+
 			os.Exit(1)
 		}
 	},
 }
 
+var hooksCmd = &cobra.Command{
+	Use:   "hooks",
+	Short: "Run workflows from git hooks",
+}
+
+var hooksInstallCmd = &cobra.Command{
+	Use:   "install [repository]",
+	Short: "Install git hooks running the workflows matching the `on.push` filters",
+	Args:  cobra.RangeArgs(0, 1),
+	Run: func(cmd *cobra.Command, args []string) {
+		workflows, _ := cmd.Flags().GetString("workflows")
+		inventoryFile, _ := cmd.Flags().GetString("inventory")
+		hookNames, _ := cmd.Flags().GetStringSlice("hooks")
+		force, _ := cmd.Flags().GetBool("force")
+
+		repository := ""
+		if len(args) > 0 {
+			repository = args[0]
+		}
+
+		installed, err := storm.NewHooks().Install(storm.HooksInstallArgs{
+			Repository: repository,
+			Workflows:  workflows,
+			Inventory:  inventoryFile,
+			Hooks:      hookNames,
+			Force:      force,
+		})
+		for _, hookFile := range installed {
+			fmt.Printf("Installed %s\n", hookFile)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+var hooksRunCmd = &cobra.Command{
+	Use:    "run <hook> [args...]",
+	Short:  "Run the workflows triggered by a git hook; called by the installed hooks",
+	Args:   cobra.MinimumNArgs(1),
+	Hidden: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		workflows, _ := cmd.Flags().GetString("workflows")
+		inventoryFile, _ := cmd.Flags().GetString("inventory")
+		format, _ := cmd.Flags().GetString("format")
+
+		renderer, err := storm.NewRenderer(format, os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		runArgs := storm.HooksRunArgs{
+			Hook:      args[0],
+			Input:     os.Stdin,
+			Workflows: workflows,
+			Inventory: inventoryFile,
+			Handlers:  []func(storm.Event){renderer.Render},
+		}
+
+		if recordHistory, _ := cmd.Flags().GetBool("history"); recordHistory {
+			runArgs.History, err = newHistory()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		// A failing pre-push hook stops the push
+		err = storm.NewHooks().Run(runArgs)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run workflows from GitHub, Gitea or GitLab webhooks",
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		secret, _ := cmd.Flags().GetString("secret")
+		workflows, _ := cmd.Flags().GetString("workflows")
+		inventoryFile, _ := cmd.Flags().GetString("inventory")
+		format, _ := cmd.Flags().GetString("format")
+
+		// Flags show up in the process list, the environment does not
+		secret = lo.Ternary(secret != "", secret, os.Getenv("STORM_WEBHOOK_SECRET"))
+
+		renderer, err := storm.NewRenderer(format, os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		serveArgs := storm.WebhookServeArgs{
+			Address:   address,
+			Secret:    secret,
+			Workflows: workflows,
+			Inventory: inventoryFile,
+			Handlers:  []func(storm.Event){renderer.Render},
+		}
+
+		if recordHistory, _ := cmd.Flags().GetBool("history"); recordHistory {
+			serveArgs.History, err = newHistory()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		err = storm.NewWebhooks().Serve(serveArgs)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+var schedulerCmd = &cobra.Command{
+	Use:   "scheduler",
+	Short: "Run workflows on their `on.schedule` cron expressions",
+	Run: func(cmd *cobra.Command, args []string) {
+		workflows, _ := cmd.Flags().GetString("workflows")
+		inventoryFile, _ := cmd.Flags().GetString("inventory")
+		timezone, _ := cmd.Flags().GetString("timezone")
+		format, _ := cmd.Flags().GetString("format")
+
+		renderer, err := storm.NewRenderer(format, os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			fmt.Printf("unknown timezone %s\n", timezone)
+			os.Exit(1)
+		}
+
+		schedulerArgs := storm.SchedulerArgs{
+			Workflows: workflows,
+			Inventory: inventoryFile,
+			Location:  location,
+			Handlers:  []func(storm.Event){renderer.Render},
+		}
+
+		if recordHistory, _ := cmd.Flags().GetBool("history"); recordHistory {
+			schedulerArgs.History, err = newHistory()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		err = storm.NewScheduler().Run(schedulerArgs)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func parseInputs(cmd *cobra.Command) (map[string]string, error) {
+	values, _ := cmd.Flags().GetStringArray("input")
+
+	return storm.ParseInputs(values)
+}
+
+// Load a recorded run, and the workflow it ran, to resume it
+func loadResume(runId string, mode string) (*storm.RunRecord, *storm.WorkflowConfig, error) {
+	history, err := newHistory()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	record, err := history.Get(runId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if record.Mode != mode {
+		return nil, nil, fmt.Errorf("run %s is a %s run; it can only be resumed as one", runId, record.Mode)
+	}
+
+	if record.Status == storm.StatusSucceeded {
+		return nil, nil, fmt.Errorf("run %s succeeded; there is nothing to resume", runId)
+	}
+
+	wc, err := history.Workflow(runId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return record, wc, nil
+}
+
+var cpCmd = &cobra.Command{
+	Use:   "cp <source> <destination>",
+	Short: "Copy files to or from servers; server:path picks servers by name or label",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		inventoryFile, _ := cmd.Flags().GetString("inventory")
+		recursive, _ := cmd.Flags().GetBool("recursive")
+		include, _ := cmd.Flags().GetStringArray("include")
+		exclude, _ := cmd.Flags().GetStringArray("exclude")
+		preserve, _ := cmd.Flags().GetBool("preserve")
+		symlinks, _ := cmd.Flags().GetString("symlinks")
+		parallel, _ := cmd.Flags().GetInt("parallel")
+		quiet, _ := cmd.Flags().GetBool("quiet")
+
+		if !lo.Contains([]string{storm.SymlinksKeep, storm.SymlinksFollow, storm.SymlinksSkip}, symlinks) {
+			fmt.Printf("invalid --symlinks %q; available options are; keep, follow, skip\n", symlinks)
+			os.Exit(1)
+		}
+
+		transferArgs := storm.TransferArgs{
+			Source:      args[0],
+			Destination: args[1],
+			Inventory:   inventoryFile,
+			Recursive:   recursive,
+			Include:     include,
+			Exclude:     exclude,
+			Preserve:    preserve,
+			Symlinks:    symlinks,
+			Parallel:    parallel,
+		}
+
+		if !quiet {
+			outputMutex := sync.Mutex{}
+
+			transferArgs.Progress = func(server string, progress storm.CopyProgress) {
+				if !progress.Done {
+					return
+				}
+
+				outputMutex.Lock()
+				defer outputMutex.Unlock()
+
+				fmt.Printf("[%s] %s (%d bytes)\n", server, progress.File, progress.Size)
+			}
+		}
+
+		err := storm.NewTransfer().Copy(transferArgs)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync <directory> <server:directory>",
+	Short: "Make directories of servers copies of a local one, sending only what changed",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		inventoryFile, _ := cmd.Flags().GetString("inventory")
+		include, _ := cmd.Flags().GetStringArray("include")
+		exclude, _ := cmd.Flags().GetStringArray("exclude")
+		symlinks, _ := cmd.Flags().GetString("symlinks")
+		parallel, _ := cmd.Flags().GetInt("parallel")
+		deleteExtraneous, _ := cmd.Flags().GetBool("delete")
+		checksum, _ := cmd.Flags().GetBool("checksum")
+		quiet, _ := cmd.Flags().GetBool("quiet")
+
+		if !lo.Contains([]string{storm.SymlinksKeep, storm.SymlinksFollow, storm.SymlinksSkip}, symlinks) {
+			fmt.Printf("invalid --symlinks %q; available options are; keep, follow, skip\n", symlinks)
+			os.Exit(1)
+		}
+
+		transferArgs := storm.TransferArgs{
+			Source:      args[0],
+			Destination: args[1],
+			Inventory:   inventoryFile,
+			Include:     include,
+			Exclude:     exclude,
+			Symlinks:    symlinks,
+			Parallel:    parallel,
+			Delete:      deleteExtraneous,
+			Checksum:    checksum,
+		}
+
+		if !quiet {
+			outputMutex := sync.Mutex{}
+
+			transferArgs.Progress = func(server string, progress storm.CopyProgress) {
+				if !progress.Done {
+					return
+				}
+
+				outputMutex.Lock()
+				defer outputMutex.Unlock()
+
+				fmt.Printf("[%s] %s (%d bytes)\n", server, progress.File, progress.Size)
+			}
+		}
+
+		results, err := storm.NewTransfer().Sync(transferArgs)
+		for _, result := range results {
+			fmt.Printf("[%s] %d transferred (%d bytes), %d unchanged, %d deleted\n", result.Server, result.Transferred, result.Bytes, result.Unchanged, result.Deleted)
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate [workflow...]",
+	Short: "Check workflow and inventory files against their schemas and rules",
+	Long: `Check workflow and inventory files against their schemas and rules.
+
+Problems are printed as "file:line:column: message", or as JSON with
+--format json, and the command exits with 1 when any is found.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		inventoryFiles, _ := cmd.Flags().GetStringSlice("inventory")
+		format, _ := cmd.Flags().GetString("format")
+
+		if len(args) == 0 && len(inventoryFiles) == 0 {
+			fmt.Println("nothing to validate; pass workflow files and/or inventories with -i")
+			os.Exit(1)
+		}
+
+		diagnostics := storm.Diagnostics{}
+
+		workflow := storm.NewWorkflow()
+		for _, file := range args {
+			diagnostics = append(diagnostics, workflow.Validate(file)...)
+		}
+
+		inventory := storm.NewInventory()
+		for _, file := range inventoryFiles {
+			diagnostics = append(diagnostics, inventory.Validate(file)...)
+		}
+
+		if format == storm.RendererJson {
+			printJson(map[string]any{
+				"valid":       len(diagnostics) == 0,
+				"diagnostics": diagnostics,
+			})
+		} else {
+			for _, diagnostic := range diagnostics {
+				fmt.Println(diagnostic)
+			}
+		}
+
+		if len(diagnostics) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+var graphCmd = &cobra.Command{
+	Use:   "graph <workflow>",
+	Short: "Draw the job dependency graph of a workflow",
+	Long: `Draw the job dependency graph of a workflow as Graphviz DOT, Mermaid or
+ASCII. With an inventory, the servers each job runs on are shown too.
+
+  storm graph -f dot workflow.yaml | dot -Tsvg > workflow.svg`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		inventoryFile, _ := cmd.Flags().GetString("inventory")
+		format, _ := cmd.Flags().GetString("format")
+
+		wc, err := storm.NewWorkflow().Load(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		var ic *storm.InventoryConfig
+		if inventoryFile != "" {
+			ic, err = storm.NewInventory().Load(inventoryFile)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		err = storm.RenderGraph(os.Stdout, storm.RenderGraphArgs{
+			Workflow:  *wc,
+			Inventory: ic,
+			Format:    format,
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func printPlan(plan storm.Plan, format string) {
+	if format == storm.RendererJson {
+		printJson(plan)
+		return
+	}
+
+	plan.Render(os.Stdout)
+}
+
+func newFactsCache() (*storm.FactsCache, error) {
+	dir, err := storm.DefaultFactsDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	return storm.NewFactsCache(dir), nil
+}
+
+var factsCmd = &cobra.Command{
+	Use:   "facts",
+	Short: "Gather and show the facts of the inventory's servers",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		inventoryFile, _ := cmd.Flags().GetString("inventory")
+		format, _ := cmd.Flags().GetString("format")
+		limit, _ := cmd.Flags().GetStringSlice("limit")
+		maxAge, _ := cmd.Flags().GetDuration("max-age")
+
+		ic, err := storm.NewInventory().Load(inventoryFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		cache, err := newFactsCache()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		gathered := storm.NewAgent().GatherFacts(storm.GatherFactsArgs{
+			Inventory: *ic,
+			Limit:     limit,
+			Cache:     cache,
+			MaxAge:    maxAge,
+		})
+
+		failed := lo.SomeBy(gathered, func(s storm.ServerFacts) bool { return s.Error != "" })
+
+		if format == storm.RendererJson {
+			printJson(gathered)
+		} else {
+			for i, serverFacts := range gathered {
+				if i > 0 {
+					fmt.Println()
+				}
+
+				fmt.Printf("Server: [%s]\n", serverFacts.Server)
+				if serverFacts.Error != "" {
+					fmt.Printf("  error: %s\n", strings.ReplaceAll(serverFacts.Error, "\n", "; "))
+					continue
+				}
+
+				facts := serverFacts.Facts
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				for _, fact := range [][2]string{
+					{"hostname", facts.Hostname},
+					{"os", facts.OS},
+					{"distro", facts.Distro},
+					{"distro-version", facts.DistroVersion},
+					{"distro-family", facts.DistroFamily},
+					{"kernel", facts.Kernel},
+					{"arch", facts.Arch},
+					{"cpus", fmt.Sprint(facts.CPUs)},
+					{"memory-mb", fmt.Sprint(facts.MemoryMB)},
+					{"ips", strings.Join(facts.IPs, " ")},
+					{"package-manager", facts.PackageManager},
+					{"init-system", facts.InitSystem},
+					{"gathered-at", facts.GatheredAt.Local().Format(time.DateTime)},
+				} {
+					fmt.Fprintf(w, "  %s\t%s\n", fact[0], fact[1])
+				}
+				w.Flush()
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func newHistory() (*storm.History, error) {
+	dir, err := storm.DefaultHistoryDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	return storm.NewHistory(dir), nil
+}
+
+var runsCmd = &cobra.Command{
+	Use:   "runs",
+	Short: "Inspect recorded workflow runs",
+}
+
+var runsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List recorded runs, most recent first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		format, _ := cmd.Flags().GetString("format")
+		limit, _ := cmd.Flags().GetInt("limit")
+
+		history, err := newHistory()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		records, err := history.List()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if limit > 0 && len(records) > limit {
+			records = records[:limit]
+		}
+
+		if format == storm.RendererJson {
+			printJson(records)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tWORKFLOW\tMODE\tSTATUS\tSTARTED\tDURATION")
+		for _, record := range records {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				record.Id,
+				record.Workflow,
+				record.Mode,
+				record.Status,
+				record.StartedAt.Local().Format(time.DateTime),
+				runDuration(record.StartedAt, record.FinishedAt),
+			)
+		}
+		w.Flush()
+	},
+}
+
+var runsShowCmd = &cobra.Command{
+	Use:   "show <run-id>",
+	Short: "Show the status of every host, job and step of a run",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		format, _ := cmd.Flags().GetString("format")
+
+		history, err := newHistory()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		record, err := history.Get(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if format == storm.RendererJson {
+			printJson(record)
+			return
+		}
+
+		fmt.Printf("Run: %s\n", record.Id)
+		fmt.Printf("Workflow: %s\n", record.Workflow)
+		fmt.Printf("Mode: %s\n", record.Mode)
+		if record.ResumedFrom != "" {
+			fmt.Printf("Resumed from: %s\n", record.ResumedFrom)
+		}
+		fmt.Printf("Status: %s\n", record.Status)
+		fmt.Printf("Started: %s\n", record.StartedAt.Local().Format(time.DateTime))
+		fmt.Printf("Duration: %s\n", runDuration(record.StartedAt, record.FinishedAt))
+		if record.Error != "" {
+			fmt.Printf("Error: %s\n", record.Error)
+		}
+
+		for _, host := range record.Hosts {
+			fmt.Printf("\nServer: [%s] %s\n", host.Name, host.Status)
+			if host.Error != "" {
+				fmt.Printf("  x  %s\n", host.Error)
+			}
+
+			for _, job := range host.Jobs {
+				fmt.Printf("  [%s] %s (exit %d, %s)\n", job.Name, job.Status, job.ExitCode, runDuration(job.StartedAt, job.FinishedAt))
+
+				for _, step := range job.Steps {
+					switch {
+					case step.Status == storm.StatusSkipped:
+						fmt.Printf("    -> %s %s (%s)\n", step.Name, step.Status, step.Error)
+					case step.Changed:
+						fmt.Printf("    -> %s %s, changed (exit %d, %s)\n", step.Name, step.Status, step.ExitCode, runDuration(step.StartedAt, step.FinishedAt))
+					default:
+						fmt.Printf("    -> %s %s (exit %d, %s)\n", step.Name, step.Status, step.ExitCode, runDuration(step.StartedAt, step.FinishedAt))
+					}
+					keys := lo.Keys(step.Outputs)
+					sort.Strings(keys)
+					for _, key := range keys {
+						fmt.Printf("       %s=%s\n", key, step.Outputs[key])
+					}
+				}
+			}
+		}
+	},
+}
+
+var runsLogsCmd = &cobra.Command{
+	Use:   "logs <run-id>",
+	Short: "Print the recorded output of a run",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		job, _ := cmd.Flags().GetString("job")
+		step, _ := cmd.Flags().GetString("step")
+		host, _ := cmd.Flags().GetString("host")
+		format, _ := cmd.Flags().GetString("format")
+
+		renderer, err := storm.NewRenderer(format, os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		history, err := newHistory()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		err = history.Events(args[0], func(e storm.Event) {
+			meta := e.Meta()
+
+			eventHost := lo.Ternary(meta.Host == "", storm.LocalHost, meta.Host)
+			if (host != "" && host != eventHost) || (job != "" && job != meta.Job) || (step != "" && step != meta.Step) {
+				return
+			}
+
+			renderer.Render(e)
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func runDuration(start time.Time, end *time.Time) string {
+	if end == nil {
+		return "-"
+	}
+
+	return end.Sub(start).Round(time.Millisecond).String()
+}
+
+func printJson(v any) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println(string(out))
+}
+
 func main() {
+	storm.Version = version
+
 	rootCmd.AddCommand(versionCmd)
 
 	agentInstallCmd.Flags().StringP("inventory", "i", "./inventory.yaml", "formatio storm inventory")
-	agentInstallCmd.Flags().StringP("mode", "m", "prod", "formatio storm installation type (prod or dev)")
+	agentInstallCmd.Flags().StringP("mode", "m", "prod", "formatio storm installation type; prod installs from the release directory, dev builds from the source in the current directory")
+	agentInstallCmd.Flags().String("release-dir", storm.DefaultReleaseDirectory, "directory of the release archives and checksums, or goreleaser's builds, that prod installations upload")
 	agentCmd.AddCommand(agentInstallCmd)
 
 	agentUninstallCmd.Flags().StringP("inventory", "i", "./inventory.yaml", "formatio storm inventory")
 	agentCmd.AddCommand(agentUninstallCmd)
 
+	agentUpgradeCmd.Flags().StringP("inventory", "i", "./inventory.yaml", "formatio storm inventory")
+	agentUpgradeCmd.Flags().StringP("mode", "m", "prod", "where the new binary comes from; prod takes it from the release directory, dev builds it from the source in the current directory")
+	agentUpgradeCmd.Flags().String("release-dir", storm.DefaultReleaseDirectory, "directory of the release archives and checksums, or goreleaser's builds, that prod upgrades upload")
+	agentUpgradeCmd.Flags().StringSlice("limit", []string{}, "only upgrade servers with these names or labels")
+	agentUpgradeCmd.Flags().Bool("force", false, "reinstall storm on servers that already run this version")
+	agentCmd.AddCommand(agentUpgradeCmd)
+
 	agentRunWorkflowCmd.Flags().StringP("inventory", "i", "./inventory.yaml", "formatio storm inventory")
-	agentRunWorkflowCmd.Flags().IntP("format", "f", 1, "available options are; 1 => plain, 2 => struct, 3 => json")
+	agentRunWorkflowCmd.Flags().StringP("format", "f", storm.RendererPlain, "available options are; plain, json")
+	agentRunWorkflowCmd.Flags().Bool("history", true, "record the run in the run history (~/.storm/history)")
+	agentRunWorkflowCmd.Flags().String("resume", "", "id of a failed run to resume; skips the jobs it completed on each server")
+	agentRunWorkflowCmd.Flags().String("from-step", "", "when resuming, restart the failed job from this step instead of its first step")
+	agentRunWorkflowCmd.Flags().StringSlice("limit", []string{}, "only run on servers with these names or labels")
+	agentRunWorkflowCmd.Flags().Bool("dry-run", false, "print what would run on which server, in what order, without running it")
+	agentRunWorkflowCmd.Flags().Bool("check-connect", false, "with --dry-run, connect to every server to check it is reachable")
+	agentRunWorkflowCmd.Flags().StringArray("input", []string{}, "name=value of one of the workflow's on.dispatch.inputs; can be used multiple times")
+	agentRunWorkflowCmd.Flags().StringArray("env", []string{}, "KEY=value environment variable set for every step; can be used multiple times")
+	agentRunWorkflowCmd.Flags().Bool("check", false, "report what would change without changing anything; run steps only run when check-safe")
+	agentRunWorkflowCmd.Flags().Bool("diff", false, "show changes to files as unified diffs")
+	agentRunWorkflowCmd.Flags().Bool("upgrade", false, "upgrade storm on servers where it is missing or incompatible instead of refusing to run on them")
+	agentRunWorkflowCmd.Flags().String("release-dir", storm.DefaultReleaseDirectory, "with --upgrade, directory of the release archives and checksums, or goreleaser's builds, to upgrade from")
+	agentRunWorkflowCmd.Flags().Duration("facts-max-age", 0, "use facts cached in ~/.storm/facts younger than this, e.g. 1h, instead of gathering them; 0 always gathers them")
 	agentCmd.AddCommand(agentRunWorkflowCmd)
 
 	runWorkflowCmd.Flags().BoolP("trash-workflow", "t", true, "remove workflow file if the workflow is complete")
 	runWorkflowCmd.Flags().StringP("directory", "d", ".", "directory to run the workflow from")
-	runWorkflowCmd.Flags().IntP("format", "f", 1, "available options are; 1 => plain, 2 => struct, 3 => json")
+	runWorkflowCmd.Flags().StringP("format", "f", storm.RendererPlain, "available options are; plain, json")
+	runWorkflowCmd.Flags().Bool("history", true, "record the run in the run history (~/.storm/history)")
+	runWorkflowCmd.Flags().String("resume", "", "id of a failed run to resume; skips the jobs it completed")
+	runWorkflowCmd.Flags().String("from-step", "", "when resuming, restart the failed job from this step instead of its first step")
+	runWorkflowCmd.Flags().Bool("dry-run", false, "print what would run, in what order, without running it")
+	runWorkflowCmd.Flags().StringArray("input", []string{}, "name=value of one of the workflow's on.dispatch.inputs; can be used multiple times")
+	runWorkflowCmd.Flags().StringArray("env", []string{}, "KEY=value environment variable set for every step; can be used multiple times")
+	runWorkflowCmd.Flags().Bool("check", false, "report what would change without changing anything; run steps only run when check-safe")
+	runWorkflowCmd.Flags().Bool("diff", false, "show changes to files as unified diffs")
+	runWorkflowCmd.Flags().String("resume-state", "", "resume state handed over by the agent")
+	runWorkflowCmd.Flags().MarkHidden("resume-state")
+	runWorkflowCmd.Flags().String("bundle", "", "archive of actions and files handed over by the agent")
+	runWorkflowCmd.Flags().MarkHidden("bundle")
+	runWorkflowCmd.Flags().String("facts", "", "facts of the host handed over by the agent")
+	runWorkflowCmd.Flags().MarkHidden("facts")
 	rootCmd.AddCommand(runWorkflowCmd)
 
+	runsListCmd.Flags().StringP("format", "f", storm.RendererPlain, "available options are; plain, json")
+	runsListCmd.Flags().IntP("limit", "n", 20, "number of runs to list, 0 lists every run")
+	runsCmd.AddCommand(runsListCmd)
+
+	runsShowCmd.Flags().StringP("format", "f", storm.RendererPlain, "available options are; plain, json")
+	runsCmd.AddCommand(runsShowCmd)
+
+	runsLogsCmd.Flags().String("job", "", "only show the output of this job")
+	runsLogsCmd.Flags().String("step", "", "only show the output of this step")
+	runsLogsCmd.Flags().String("host", "", "only show the output of this server")
+	runsLogsCmd.Flags().StringP("format", "f", storm.RendererPlain, "available options are; plain, json")
+	runsCmd.AddCommand(runsLogsCmd)
+
+	rootCmd.AddCommand(runsCmd)
+
+	factsCmd.Flags().StringP("inventory", "i", "./inventory.yaml", "formatio storm inventory")
+	factsCmd.Flags().StringP("format", "f", storm.RendererPlain, "available options are; plain, json")
+	factsCmd.Flags().StringSlice("limit", []string{}, "only gather the facts of servers with these names or labels")
+	factsCmd.Flags().Duration("max-age", 0, "show facts cached in ~/.storm/facts younger than this, e.g. 1h, instead of gathering them")
+	rootCmd.AddCommand(factsCmd)
+
+	graphCmd.Flags().StringP("inventory", "i", "", "formatio storm inventory; shows the servers each job runs on")
+	graphCmd.Flags().StringP("format", "f", storm.GraphFormatAscii, "available options are; dot, mermaid, ascii")
+	rootCmd.AddCommand(graphCmd)
+
+	validateCmd.Flags().StringSliceP("inventory", "i", []string{}, "inventory files to validate")
+	validateCmd.Flags().StringP("format", "f", storm.RendererPlain, "available options are; plain, json")
+	rootCmd.AddCommand(validateCmd)
+
+	hooksInstallCmd.Flags().String("workflows", storm.DefaultWorkflowsDirectory, "directory of the workflows, relative to the repository root")
+	hooksInstallCmd.Flags().StringP("inventory", "i", "", "run the workflows on the servers of this inventory instead of locally")
+	hooksInstallCmd.Flags().StringSlice("hooks", []string{}, "hooks to install; defaults to post-receive for bare repositories, post-commit and pre-push otherwise")
+	hooksInstallCmd.Flags().Bool("force", false, "replace hooks that were not installed by storm")
+	hooksCmd.AddCommand(hooksInstallCmd)
+
+	hooksRunCmd.Flags().String("workflows", storm.DefaultWorkflowsDirectory, "directory of the workflows, relative to the repository root")
+	hooksRunCmd.Flags().StringP("inventory", "i", "", "run the workflows on the servers of this inventory instead of locally")
+	hooksRunCmd.Flags().StringP("format", "f", storm.RendererPlain, "available options are; plain, json")
+	hooksRunCmd.Flags().Bool("history", true, "record the runs in the run history (~/.storm/history)")
+	hooksCmd.AddCommand(hooksRunCmd)
+
+	rootCmd.AddCommand(hooksCmd)
+
+	serveCmd.Flags().String("address", ":8080", "address to listen on")
+	serveCmd.Flags().String("secret", "", "webhook secret; defaults to the STORM_WEBHOOK_SECRET environment variable")
+	serveCmd.Flags().String("workflows", storm.DefaultWorkflowsDirectory, "directory of the workflows")
+	serveCmd.Flags().StringP("inventory", "i", "", "run the workflows on the servers of this inventory instead of locally")
+	serveCmd.Flags().StringP("format", "f", storm.RendererPlain, "available options are; plain, json")
+	serveCmd.Flags().Bool("history", true, "record the runs in the run history (~/.storm/history)")
+	rootCmd.AddCommand(serveCmd)
+
+	schedulerCmd.Flags().String("workflows", storm.DefaultWorkflowsDirectory, "directory of the workflows")
+	schedulerCmd.Flags().StringP("inventory", "i", "", "run the workflows on the servers of this inventory instead of locally")
+	schedulerCmd.Flags().String("timezone", "Local", "timezone of the schedules that do not name one, e.g. Europe/Berlin")
+	schedulerCmd.Flags().StringP("format", "f", storm.RendererPlain, "available options are; plain, json")
+	schedulerCmd.Flags().Bool("history", true, "record the runs in the run history (~/.storm/history)")
+	rootCmd.AddCommand(schedulerCmd)
+
+	cpCmd.Flags().StringP("inventory", "i", "", "inventory of the servers")
+	cpCmd.Flags().BoolP("recursive", "r", false, "copy directories")
+	cpCmd.Flags().StringArray("include", []string{}, "only copy files matching this glob; patterns without a / match at any depth")
+	cpCmd.Flags().StringArray("exclude", []string{}, "leave out files and directories matching this glob")
+	cpCmd.Flags().BoolP("preserve", "p", false, "keep permissions and modification times")
+	cpCmd.Flags().String("symlinks", storm.SymlinksKeep, "available options are; keep, follow, skip")
+	cpCmd.Flags().Int("parallel", 0, "servers copied to or from at the same time; 0 for all")
+	cpCmd.Flags().BoolP("quiet", "q", false, "do not list the copied files")
+	rootCmd.AddCommand(cpCmd)
+
+	syncCmd.Flags().StringP("inventory", "i", "", "inventory of the servers")
+	syncCmd.Flags().StringArray("include", []string{}, "only sync files matching this glob; patterns without a / match at any depth")
+	syncCmd.Flags().StringArray("exclude", []string{}, "leave out files and directories matching this glob; --delete keeps them too")
+	syncCmd.Flags().String("symlinks", storm.SymlinksKeep, "available options are; keep, follow, skip")
+	syncCmd.Flags().Int("parallel", 0, "servers synced at the same time; 0 for all")
+	syncCmd.Flags().Bool("delete", false, "remove what the local directory does not have")
+	syncCmd.Flags().Bool("checksum", false, "compare files by SHA-256 instead of size and modification time")
+	syncCmd.Flags().BoolP("quiet", "q", false, "do not list the transferred files")
+	rootCmd.AddCommand(syncCmd)
+
 	rootCmd.AddCommand(agentCmd)
 
 	if err := rootCmd.Execute(); err != nil {
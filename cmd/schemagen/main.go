@@ -0,0 +1,38 @@
+// Generates schema.workflow.json, schema.steps.json, schema.action.json and
+// schema.inventory.json from the config types; run with `go generate ./...`
+// from the repository root
+package main
+
+import (
+	"fmt"
+	"os"
+
+	storm "github.com/Overal-X/formatio.storm"
+)
+
+func main() {
+	schemas := []struct {
+		file  string
+		title string
+		value any
+	}{
+		{file: "schema.workflow.json", title: "Storm Workflow Schema", value: storm.WorkflowConfig{}},
+		{file: "schema.steps.json", title: "Storm Steps Schema", value: []storm.Step{}},
+		{file: "schema.action.json", title: "Storm Action Schema", value: storm.ActionConfig{}},
+		{file: "schema.inventory.json", title: "Storm Inventory Schema", value: storm.InventoryConfig{}},
+	}
+
+	for _, schema := range schemas {
+		content, err := storm.GenerateSchema(schema.title, schema.value)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		err = os.WriteFile(schema.file, content, 0644)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package storm
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Tokens of conditions; strings in single or double quotes, numbers and
+// versions, names such as facts.os, and operators
+var conditionToken = regexp.MustCompile(`^\s*('(?:[^']|'')*'|"[^"]*"|[0-9][0-9.]*|[A-Za-z_][A-Za-z0-9_-]*(?:\.[A-Za-z_][A-Za-z0-9_-]*)?|==|!=|<=|>=|&&|\|\||[<>!(),])`)
+
+// Functions conditions can call, with two arguments
+var conditionFunctions = map[string]func(string, string) bool{
+	"contains":   strings.Contains,
+	"startsWith": strings.HasPrefix,
+	"endsWith":   strings.HasSuffix,
+}
+
+// Whether the `if` of a job or step holds, e.g. `facts.distro == 'ubuntu' &&
+// facts.arch != 'arm64'`; it may be written in `${{ }}`. Values are compared
+// as text, `<` and the like compare numbers and versions part by part. Empty
+// values, false and 0 are false.
+func (c ExpressionContext) Condition(condition string) (bool, error) {
+	text := strings.TrimSpace(condition)
+	if match := expressionPattern.FindStringSubmatch(text); match != nil && match[0] == text {
+		text = match[1]
+	}
+
+	tokens := []string{}
+	for rest := text; strings.TrimSpace(rest) != ""; {
+		match := conditionToken.FindStringSubmatch(rest)
+		if match == nil {
+			return false, fmt.Errorf("invalid condition %q; unexpected %q", condition, strings.TrimSpace(rest))
+		}
+
+		tokens = append(tokens, match[1])
+		rest = rest[len(match[0]):]
+	}
+
+	p := conditionParser{context: c, tokens: tokens}
+
+	value, err := p.or()
+	if err == nil && p.position < len(tokens) {
+		err = fmt.Errorf("unexpected %q", tokens[p.position])
+	}
+	if err != nil {
+		return false, fmt.Errorf("invalid condition %q; %w", condition, err)
+	}
+
+	return truthy(value), nil
+}
+
+// A condition with its `inputs.<name>` replaced by the values of the inputs,
+// quoted; for conditions moved out of the workflow the inputs belong to, e.g.
+// when flattening a used workflow. Conditions that do not parse are kept as
+// they are, they are reported when they run.
+func bindConditionInputs(condition string, inputs map[string]string) string {
+	text := strings.TrimSpace(condition)
+	if match := expressionPattern.FindStringSubmatch(text); match != nil && match[0] == text {
+		text = match[1]
+	}
+
+	tokens := []string{}
+	for rest := text; strings.TrimSpace(rest) != ""; {
+		match := conditionToken.FindStringSubmatch(rest)
+		if match == nil {
+			return condition
+		}
+
+		token := match[1]
+		if name, found := strings.CutPrefix(token, "inputs."); found {
+			if value, found := inputs[name]; found {
+				token = "'" + strings.ReplaceAll(value, "'", "''") + "'"
+			}
+		}
+
+		tokens = append(tokens, token)
+		rest = rest[len(match[0]):]
+	}
+
+	return strings.Join(tokens, " ")
+}
+
+// Both conditions hold; either may be empty
+func joinConditions(a string, b string) string {
+	switch {
+	case strings.TrimSpace(a) == "":
+		return b
+	case strings.TrimSpace(b) == "":
+		return a
+	}
+
+	return fmt.Sprintf("(%s) && (%s)", a, b)
+}
+
+// Reads `or := and ('||' and)*`, `and := not ('&&' not)*`,
+// `not := '!' not | compare`, `compare := value (op value)?` and
+// `value := '(' or ')' | function '(' or ',' or ')' | string | number | name`
+type conditionParser struct {
+	context  ExpressionContext
+	tokens   []string
+	position int
+}
+
+func (p *conditionParser) peek() string {
+	if p.position < len(p.tokens) {
+		return p.tokens[p.position]
+	}
+
+	return ""
+}
+
+func (p *conditionParser) expect(token string) error {
+	if p.peek() != token {
+		return fmt.Errorf("expected %q", token)
+	}
+
+	p.position++
+
+	return nil
+}
+
+func (p *conditionParser) or() (string, error) {
+	left, err := p.and()
+	for err == nil && p.peek() == "||" {
+		p.position++
+
+		var right string
+		if right, err = p.and(); err == nil {
+			left = strconv.FormatBool(truthy(left) || truthy(right))
+		}
+	}
+
+	return left, err
+}
+
+func (p *conditionParser) and() (string, error) {
+	left, err := p.not()
+	for err == nil && p.peek() == "&&" {
+		p.position++
+
+		var right string
+		if right, err = p.not(); err == nil {
+			left = strconv.FormatBool(truthy(left) && truthy(right))
+		}
+	}
+
+	return left, err
+}
+
+func (p *conditionParser) not() (string, error) {
+	if p.peek() == "!" {
+		p.position++
+
+		value, err := p.not()
+		return strconv.FormatBool(!truthy(value)), err
+	}
+
+	return p.compare()
+}
+
+func (p *conditionParser) compare() (string, error) {
+	left, err := p.value()
+	if err != nil {
+		return "", err
+	}
+
+	operator := p.peek()
+	if !strings.Contains(" == != < <= > >= ", " "+operator+" ") {
+		return left, nil
+	}
+	p.position++
+
+	right, err := p.value()
+	if err != nil {
+		return "", err
+	}
+
+	order := compareVersions(left, right)
+
+	return strconv.FormatBool(map[string]bool{
+		"==": left == right,
+		"!=": left != right,
+		"<":  order < 0,
+		"<=": order <= 0,
+		">":  order > 0,
+		">=": order >= 0,
+	}[operator]), nil
+}
+
+func (p *conditionParser) value() (string, error) {
+	token := p.peek()
+	p.position++
+
+	switch {
+	case token == "":
+		return "", fmt.Errorf("unexpected end")
+	case token == "(":
+		value, err := p.or()
+		if err != nil {
+			return "", err
+		}
+
+		return value, p.expect(")")
+	case strings.HasPrefix(token, "'"):
+		return strings.ReplaceAll(token[1:len(token)-1], "''", "'"), nil
+	case strings.HasPrefix(token, `"`):
+		return token[1 : len(token)-1], nil
+	case token[0] >= '0' && token[0] <= '9', token == "true", token == "false":
+		return token, nil
+	case conditionFunctions[token] != nil:
+		if err := p.expect("("); err != nil {
+			return "", err
+		}
+
+		left, err := p.or()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect(","); err != nil {
+			return "", err
+		}
+
+		right, err := p.or()
+		if err != nil {
+			return "", err
+		}
+
+		return strconv.FormatBool(conditionFunctions[token](left, right)), p.expect(")")
+	case strings.Contains(token, "."):
+		return p.context.evaluate(token)
+	}
+
+	return "", fmt.Errorf("unexpected %q", token)
+}
+
+func truthy(value string) bool {
+	return value != "" && value != "false" && value != "0"
+}
+
+// Order of two numbers or versions, part by part; parts that are not numbers
+// are compared as text
+func compareVersions(a string, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aPart, bPart := "0", "0"
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+
+		aNumber, aErr := strconv.Atoi(aPart)
+		bNumber, bErr := strconv.Atoi(bPart)
+
+		switch {
+		case aErr == nil && bErr == nil && aNumber != bNumber:
+			return aNumber - bNumber
+		case (aErr != nil || bErr != nil) && aPart != bPart:
+			return strings.Compare(aPart, bPart)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,180 @@
+package storm
+
+import "testing"
+
+func TestCondition(t *testing.T) {
+	context := ExpressionContext{
+		Inputs: map[string]string{"env": "prod", "name": "it's", "replicas": "0", "empty": ""},
+		Facts:  map[string]string{"distro": "ubuntu", "distro_version": "22.04", "arch": "amd64"},
+	}
+
+	tests := []struct {
+		condition string
+		holds     bool
+	}{
+		// Values
+		{"true", true},
+		{"false", false},
+		{"1", true},
+		{"0", false},
+		{"inputs.env", true},
+		{"inputs.empty", false},
+		{"inputs.replicas", false},
+		{"${{ inputs.env == 'prod' }}", true},
+		{"  ${{ facts.arch == 'arm64' }}  ", false},
+
+		// Precedence; `!` before comparisons, comparisons before `&&`,
+		// `&&` before `||`
+		{"false && false || true", true},
+		{"true || true && false", true},
+		{"(true || true) && false", false},
+		{"false || false && true", false},
+		{"inputs.env == 'prod' && facts.distro == 'ubuntu'", true},
+		{"inputs.env == 'dev' || facts.distro == 'ubuntu' && facts.arch == 'arm64'", false},
+		{"(inputs.env == 'dev' || facts.distro == 'ubuntu') && facts.arch == 'amd64'", true},
+
+		// Negation
+		{"!false", true},
+		{"!true", false},
+		{"!!true", true},
+		{"!inputs.empty", true},
+		{"!false && false", false},
+		{"!(false && false)", true},
+		{"!(inputs.env == 'prod')", false},
+		{"!startsWith(facts.distro, 'ubu')", false},
+
+		// Quoting; `''` is a quote in single quoted strings
+		{"inputs.name == 'it''s'", true},
+		{`inputs.name == "it's"`, true},
+		{"'a''''b' == \"a''b\"", true},
+		{"'' == inputs.empty", true},
+		{"'a && b' == 'a && b'", true},
+		{"'prod' != inputs.env", false},
+
+		// Functions
+		{"contains(facts.distro, 'bun')", true},
+		{"endsWith(facts.distro, 'tu') && contains('it''s', '''')", true},
+
+		// Versions and numbers compare part by part
+		{"facts.distro_version >= '20.04'", true},
+		{"facts.distro_version < 22.10", true},
+		{"'1.10' > '1.9'", true},
+		{"'1.2' == '1.2.0'", false},
+		{"'1.2' >= '1.2.0'", true},
+		{"'1.2' <= '1.2.0'", true},
+		{"10 > 9", true},
+		{"'2.0.1' < '2.0'", false},
+		{"'1.0-rc' < '1.0-rc2'", true},
+		{"'bookworm' > 'bullseye'", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.condition, func(t *testing.T) {
+			holds, err := context.Condition(test.condition)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if holds != test.holds {
+				t.Errorf("got %v, want %v", holds, test.holds)
+			}
+		})
+	}
+}
+
+func TestConditionInvalid(t *testing.T) {
+	context := ExpressionContext{Inputs: map[string]string{"env": "prod"}, Facts: map[string]string{}}
+
+	for _, condition := range []string{
+		"",
+		"inputs.missing == 'x'",
+		"facts.missing",
+		"secrets.token",
+		"(true",
+		"true)",
+		"true &&",
+		"== 'prod'",
+		"'unterminated",
+		"inputs.env = 'prod'",
+		"contains(inputs.env)",
+		"unknown('a', 'b')",
+		"true false",
+	} {
+		t.Run(condition, func(t *testing.T) {
+			if _, err := context.Condition(condition); err == nil {
+				t.Errorf("expected %q to be invalid", condition)
+			}
+		})
+	}
+}
+
+func TestBindConditionInputs(t *testing.T) {
+	inputs := map[string]string{"env": "prod", "name": "it's"}
+	context := ExpressionContext{Facts: map[string]string{"distro": "ubuntu"}}
+
+	tests := []struct {
+		condition string
+		bound     string
+		holds     bool
+	}{
+		{"inputs.env == 'prod'", "'prod' == 'prod'", true},
+		{"${{ inputs.name == 'it''s' }}", "'it''s' == 'it''s'", true},
+		{"!inputs.env && facts.distro == 'ubuntu'", "! 'prod' && facts.distro == 'ubuntu'", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.condition, func(t *testing.T) {
+			bound := bindConditionInputs(test.condition, inputs)
+			if bound != test.bound {
+				t.Fatalf("got %q, want %q", bound, test.bound)
+			}
+
+			// Bound conditions no longer need the inputs
+			holds, err := context.Condition(bound)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if holds != test.holds {
+				t.Errorf("got %v, want %v", holds, test.holds)
+			}
+		})
+	}
+
+	// Unknown inputs are left for the run to report, invalid conditions are
+	// kept as they are
+	if bound := bindConditionInputs("inputs.missing", inputs); bound != "inputs.missing" {
+		t.Errorf("got %q, want the unknown input kept", bound)
+	}
+	if bound := bindConditionInputs("inputs.env = 'prod'", inputs); bound != "inputs.env = 'prod'" {
+		t.Errorf("got %q, want the invalid condition kept", bound)
+	}
+}
+
+func TestJoinConditions(t *testing.T) {
+	tests := []struct {
+		a      string
+		b      string
+		joined string
+	}{
+		{"", "", ""},
+		{"inputs.env == 'prod'", "", "inputs.env == 'prod'"},
+		{" ", "facts.arch == 'amd64'", "facts.arch == 'amd64'"},
+		{"true || false", "false", "(true || false) && (false)"},
+	}
+
+	for _, test := range tests {
+		if joined := joinConditions(test.a, test.b); joined != test.joined {
+			t.Errorf("joinConditions(%q, %q): got %q, want %q", test.a, test.b, joined, test.joined)
+		}
+	}
+
+	// Without the parentheses the `||` of the first would let the second be
+	// skipped
+	holds, err := ExpressionContext{}.Condition(joinConditions("true || false", "false"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holds {
+		t.Error("got true, want false")
+	}
+}
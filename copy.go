@@ -0,0 +1,424 @@
+package storm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// How symlinks are copied
+const (
+	// Copied as links pointing where the originals do
+	SymlinksKeep = "keep"
+
+	// Replaced by what they point to
+	SymlinksFollow = "follow"
+
+	// Left out
+	SymlinksSkip = "skip"
+)
+
+type CopyArgs struct {
+	Client      *ssh.Client
+	Source      string
+	Destination string
+
+	// Globs of the files to copy, relative to the source directory; patterns
+	// without a `/` match names at any depth. Everything is copied when empty.
+	Include []string
+
+	// Globs of the files and directories to leave out; excluded directories are
+	// not entered
+	Exclude []string
+
+	// Give copies the permissions and modification times of their sources;
+	// otherwise only new files get the permissions of their sources
+	Preserve bool
+
+	// keep, follow or skip; defaults to keep
+	Symlinks string
+
+	// Called as files are copied
+	Progress func(CopyProgress)
+}
+
+type CopyProgress struct {
+	// Path of the file, relative to the source directory
+	File string
+
+	Size   int64
+	Copied int64
+	Done   bool
+}
+
+// Copy a directory tree from local server to remote server; the destination
+// becomes a copy of the source directory
+func (s *Ssh) CopyDirTo(args CopyArgs) error {
+	return s.copy(args, true, true)
+}
+
+// Copy a file from remote server to local server
+func (s *Ssh) CopyFrom(args CopyArgs) error {
+	return s.copy(args, false, false)
+}
+
+// Copy a directory tree from remote server to local server; the destination
+// becomes a copy of the source directory
+func (s *Ssh) CopyDirFrom(args CopyArgs) error {
+	return s.copy(args, false, true)
+}
+
+func (s *Ssh) copy(args CopyArgs, upload bool, directory bool) error {
+	sftpClient, err := sftp.NewClient(args.Client, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		return fmt.Errorf("failed to create SFTP client: %w", err)
+	}
+	defer sftpClient.Close()
+
+	c := copier{from: localFs{}, to: remoteFs{sftpClient}, args: args, visited: map[string]bool{}}
+	if !upload {
+		c.from, c.to = c.to, c.from
+	}
+
+	info, err := c.from.Stat(args.Source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() != directory {
+		return fmt.Errorf("%s %s a directory", args.Source, lo.Ternary(directory, "is not", "is"))
+	}
+
+	return c.copy(args.Source, args.Destination, "")
+}
+
+// A side of a copy; the local filesystem or a server's over SFTP
+type copyFs interface {
+	Lstat(name string) (fs.FileInfo, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.FileInfo, error)
+	ReadLink(name string) (string, error)
+	RealPath(name string) (string, error)
+	Open(name string) (io.ReadCloser, error)
+
+	// Create or truncate a file; new files get `perm`
+	Create(name string, perm fs.FileMode) (io.WriteCloser, error)
+	MkdirAll(name string) error
+	Symlink(target string, name string) error
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, mtime time.Time) error
+	Remove(name string) error
+	Join(elem ...string) string
+}
+
+type localFs struct{}
+
+func (localFs) Lstat(name string) (fs.FileInfo, error)     { return os.Lstat(name) }
+func (localFs) Stat(name string) (fs.FileInfo, error)      { return os.Stat(name) }
+func (localFs) ReadLink(name string) (string, error)       { return os.Readlink(name) }
+func (localFs) RealPath(name string) (string, error)       { return filepath.EvalSymlinks(name) }
+func (localFs) Open(name string) (io.ReadCloser, error)    { return os.Open(name) }
+func (localFs) MkdirAll(name string) error                 { return os.MkdirAll(name, 0755) }
+func (localFs) Symlink(target string, name string) error   { return os.Symlink(target, name) }
+func (localFs) Chmod(name string, mode fs.FileMode) error  { return os.Chmod(name, mode) }
+func (localFs) Chtimes(name string, mtime time.Time) error { return os.Chtimes(name, mtime, mtime) }
+func (localFs) Remove(name string) error                   { return os.Remove(name) }
+func (localFs) Join(elem ...string) string                 { return filepath.Join(elem...) }
+
+func (localFs) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+func (localFs) ReadDir(name string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []fs.FileInfo{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+type remoteFs struct {
+	client *sftp.Client
+}
+
+func (r remoteFs) Lstat(name string) (fs.FileInfo, error)     { return r.client.Lstat(name) }
+func (r remoteFs) Stat(name string) (fs.FileInfo, error)      { return r.client.Stat(name) }
+func (r remoteFs) ReadDir(name string) ([]fs.FileInfo, error) { return r.client.ReadDir(name) }
+func (r remoteFs) ReadLink(name string) (string, error)       { return r.client.ReadLink(name) }
+func (r remoteFs) RealPath(name string) (string, error)       { return r.client.RealPath(name) }
+func (r remoteFs) Open(name string) (io.ReadCloser, error)    { return r.client.Open(name) }
+func (r remoteFs) MkdirAll(name string) error                 { return r.client.MkdirAll(name) }
+func (r remoteFs) Symlink(target string, name string) error   { return r.client.Symlink(target, name) }
+func (r remoteFs) Chmod(name string, mode fs.FileMode) error  { return r.client.Chmod(name, mode) }
+func (r remoteFs) Chtimes(name string, mtime time.Time) error {
+	return r.client.Chtimes(name, mtime, mtime)
+}
+func (r remoteFs) Remove(name string) error   { return r.client.Remove(name) }
+func (r remoteFs) Join(elem ...string) string { return path.Join(elem...) }
+
+func (r remoteFs) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	_, err := r.client.Lstat(name)
+	isNew := os.IsNotExist(err)
+
+	file, err := r.client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+
+	// SFTP creates files with the server's default permissions
+	if isNew {
+		if err := file.Chmod(perm); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return file, nil
+}
+
+type copier struct {
+	from copyFs
+	to   copyFs
+	args CopyArgs
+
+	// Real paths of the directories being copied, when following symlinks; a
+	// link to one of them is a loop
+	visited map[string]bool
+}
+
+// Copy a file, link or directory; `relative` is its path from the source
+// directory, as include and exclude patterns see it
+func (c *copier) copy(source string, destination string, relative string) error {
+	// The source itself is what the link points to
+	stat := lo.Ternary(relative == "", c.from.Stat, c.from.Lstat)
+
+	info, err := stat(source)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		switch c.args.Symlinks {
+		case SymlinksSkip:
+			return nil
+		case SymlinksFollow:
+			info, err = c.from.Stat(source)
+			if err != nil {
+				return fmt.Errorf("broken symlink %s: %w", source, err)
+			}
+		default:
+			return c.copyLink(source, destination)
+		}
+	}
+
+	switch {
+	case info.IsDir():
+		return c.copyDir(source, destination, relative, info)
+	case info.Mode().IsRegular():
+		return c.copyFile(source, destination, relative, info)
+	default:
+		// Devices, sockets and pipes have no content to copy
+		return nil
+	}
+}
+
+func (c *copier) copyDir(source string, destination string, relative string, info fs.FileInfo) error {
+	if c.args.Symlinks == SymlinksFollow {
+		real, err := c.from.RealPath(source)
+		if err != nil {
+			return err
+		}
+		if c.visited[real] {
+			return nil
+		}
+
+		c.visited[real] = true
+		defer delete(c.visited, real)
+	}
+
+	// With include patterns, only directories holding included files are made
+	if len(c.args.Include) == 0 {
+		if err := c.to.MkdirAll(destination); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", destination, err)
+		}
+	}
+
+	entries, err := c.from.ReadDir(source)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		entryRelative := path.Join(relative, entry.Name())
+
+		if matchCopyGlobs(c.args.Exclude, entryRelative) {
+			continue
+		}
+		if !entry.IsDir() && len(c.args.Include) > 0 && !matchCopyGlobs(c.args.Include, entryRelative) {
+			continue
+		}
+
+		err := c.copy(c.from.Join(source, entry.Name()), c.to.Join(destination, entry.Name()), entryRelative)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Writing the entries changed the modification time, it is set last
+	if _, err := c.to.Stat(destination); err == nil && c.args.Preserve {
+		return c.preserve(destination, info)
+	}
+
+	return nil
+}
+
+func (c *copier) copyFile(source string, destination string, relative string, info fs.FileInfo) error {
+	relative = lo.Ternary(relative != "", relative, path.Base(filepath.ToSlash(source)))
+
+	if err := c.to.MkdirAll(c.to.Join(destination, "..")); err != nil {
+		return fmt.Errorf("failed to create directory of %s: %w", destination, err)
+	}
+
+	// A link in the way would be written through
+	if existing, err := c.to.Lstat(destination); err == nil && existing.Mode()&fs.ModeSymlink != 0 {
+		if err := c.to.Remove(destination); err != nil {
+			return err
+		}
+	}
+
+	sourceFile, err := c.from.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	destinationFile, err := c.to.Create(destination, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", destination, err)
+	}
+
+	reader := &progressReader{
+		reader:   sourceFile,
+		progress: CopyProgress{File: relative, Size: info.Size()},
+		callback: c.args.Progress,
+	}
+
+	_, err = io.Copy(destinationFile, reader)
+	closeErr := destinationFile.Close()
+	if err = errors.Join(err, closeErr); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", source, err)
+	}
+
+	if c.args.Preserve {
+		if err := c.preserve(destination, info); err != nil {
+			return err
+		}
+	}
+
+	reader.done()
+
+	return nil
+}
+
+func (c *copier) copyLink(source string, destination string) error {
+	target, err := c.from.ReadLink(source)
+	if err != nil {
+		return err
+	}
+
+	if err := c.to.MkdirAll(c.to.Join(destination, "..")); err != nil {
+		return fmt.Errorf("failed to create directory of %s: %w", destination, err)
+	}
+
+	if _, err := c.to.Lstat(destination); err == nil {
+		if err := c.to.Remove(destination); err != nil {
+			return err
+		}
+	}
+
+	return c.to.Symlink(target, destination)
+}
+
+func (c *copier) preserve(destination string, info fs.FileInfo) error {
+	if err := c.to.Chmod(destination, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w", destination, err)
+	}
+
+	if err := c.to.Chtimes(destination, info.ModTime()); err != nil {
+		return fmt.Errorf("failed to set modification time on %s: %w", destination, err)
+	}
+
+	return nil
+}
+
+// Match a path against copy patterns; patterns without a `/` match names at
+// any depth, like .gitignore
+func matchCopyGlobs(patterns []string, relative string) bool {
+	anchored := make([]string, len(patterns))
+
+	for i, pattern := range patterns {
+		negated, isNegated := strings.CutPrefix(pattern, "!")
+		negated = strings.TrimPrefix(negated, "/")
+
+		if !strings.Contains(pattern, "/") {
+			negated = "**/" + negated
+		}
+
+		anchored[i] = lo.Ternary(isNegated, "!", "") + negated
+	}
+
+	return MatchGlobs(anchored, relative)
+}
+
+// Reports how much of a file was read; knowing what is left lets SFTP write
+// in parallel
+type progressReader struct {
+	reader   io.Reader
+	progress CopyProgress
+	callback func(CopyProgress)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+
+	if n > 0 && r.callback != nil {
+		r.progress.Copied += int64(n)
+		r.callback(r.progress)
+	}
+
+	return n, err
+}
+
+// Bytes left to read
+func (r *progressReader) Size() int64 {
+	return r.progress.Size - r.progress.Copied
+}
+
+func (r *progressReader) done() {
+	if r.callback != nil {
+		r.progress.Done = true
+		r.callback(r.progress)
+	}
+}
@@ -0,0 +1,203 @@
+package storm
+
+import (
+	"testing"
+	"time"
+)
+
+func cronTime(t *testing.T, location *time.Location, value string) time.Time {
+	t.Helper()
+
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expression string
+		valid      bool
+	}{
+		{"* * * * *", true},
+		{"0 2 * * *", true},
+		{"*/15 9-17 * * mon-fri", true},
+		{"0 0 1,15 jan,JUL *", true},
+		{"5/10 * * * *", true},
+		{"0 0 * * 7", true},
+		{"@daily", true},
+		{"@Weekly", true},
+		{" @hourly ", true},
+		{"", false},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"*/x * * * *", false},
+		{"* * * foo *", false},
+		{"@often", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			schedule, err := ParseCron(test.expression)
+			if test.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !test.valid && (err == nil || schedule != nil) {
+				t.Fatalf("expected %q to be invalid", test.expression)
+			}
+		})
+	}
+}
+
+func TestCronScheduleMatches(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		time       string
+		matches    bool
+	}{
+		{"every minute", "* * * * *", "2026-10-19 06:54", true},
+		{"value", "30 2 * * *", "2026-10-19 02:30", true},
+		{"value other minute", "30 2 * * *", "2026-10-19 02:31", false},
+		{"range", "0 9-17 * * *", "2026-10-19 17:00", true},
+		{"out of range", "0 9-17 * * *", "2026-10-19 18:00", false},
+		{"list", "0 0 1,15 * *", "2026-10-15 00:00", true},
+		{"not in list", "0 0 1,15 * *", "2026-10-14 00:00", false},
+		{"step", "*/15 * * * *", "2026-10-19 06:45", true},
+		{"off step", "*/15 * * * *", "2026-10-19 06:50", false},
+		{"step from value", "5/20 * * * *", "2026-10-19 06:45", true},
+		{"step from value before start", "5/20 * * * *", "2026-10-19 06:00", false},
+		{"step of range", "10-30/10 * * * *", "2026-10-19 06:20", true},
+		{"step of range after end", "10-30/10 * * * *", "2026-10-19 06:40", false},
+		{"month name", "0 0 * oct *", "2026-10-19 00:00", true},
+		{"month name other month", "0 0 * nov *", "2026-10-19 00:00", false},
+		{"day name", "0 0 * * mon", "2026-10-19 00:00", true},
+		{"day name range", "0 0 * * mon-fri", "2026-10-24 00:00", false},
+		{"sunday as 0", "0 0 * * 0", "2026-10-18 00:00", true},
+		{"sunday as 7", "0 0 * * 7", "2026-10-18 00:00", true},
+		{"sunday name", "0 0 * * SUN", "2026-10-18 00:00", true},
+		{"hourly", "@hourly", "2026-10-19 06:00", true},
+		{"daily", "@daily", "2026-10-19 00:00", true},
+		{"weekly on sunday", "@weekly", "2026-10-18 00:00", true},
+		{"weekly on monday", "@weekly", "2026-10-19 00:00", false},
+		{"monthly", "@monthly", "2026-10-01 00:00", true},
+		{"yearly", "@yearly", "2027-01-01 00:00", true},
+		{"yearly other day", "@annually", "2026-10-01 00:00", false},
+
+		// With both day fields restricted either of them is enough, with
+		// one of them `*` the other decides
+		{"day of month or week, month day", "0 0 13 * fri", "2026-10-13 00:00", true},
+		{"day of month or week, week day", "0 0 13 * fri", "2026-10-23 00:00", true},
+		{"day of month or week, neither", "0 0 13 * fri", "2026-10-22 00:00", false},
+		{"any day of month, week day", "0 0 * * fri", "2026-10-13 00:00", false},
+		{"any day of week, month day", "0 0 13 * *", "2026-10-23 00:00", false},
+		{"stepped day of month is any", "0 0 */2 * fri", "2026-10-22 00:00", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := ParseCron(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if matches := schedule.Matches(cronTime(t, time.UTC, test.time)); matches != test.matches {
+				t.Errorf("%q at %s: got %v, want %v", test.expression, test.time, matches, test.matches)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		from       string
+		next       string
+	}{
+		{"next minute", "* * * * *", "2026-10-19 06:54", "2026-10-19 06:55"},
+		{"later today", "30 9 * * *", "2026-10-19 06:54", "2026-10-19 09:30"},
+		{"tomorrow", "30 2 * * *", "2026-10-19 06:54", "2026-10-20 02:30"},
+		{"not the time itself", "30 2 * * *", "2026-10-19 02:30", "2026-10-20 02:30"},
+		{"step", "*/15 * * * *", "2026-10-19 06:54", "2026-10-19 07:00"},
+		{"next month", "0 0 1 * *", "2026-10-19 06:54", "2026-11-01 00:00"},
+		{"next year", "0 0 1 jan *", "2026-10-19 06:54", "2027-01-01 00:00"},
+		{"week day", "0 8 * * mon-fri", "2026-10-23 09:00", "2026-10-26 08:00"},
+		{"day of month or week", "0 0 13 * fri", "2026-10-19 06:54", "2026-10-23 00:00"},
+		{"leap day", "0 0 29 feb *", "2026-10-19 06:54", "2028-02-29 00:00"},
+		{"weekly", "@weekly", "2026-10-19 06:54", "2026-10-25 00:00"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := ParseCron(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			next := schedule.Next(cronTime(t, time.UTC, test.from))
+			if want := cronTime(t, time.UTC, test.next); !next.Equal(want) {
+				t.Errorf("%q after %s: got %s, want %s", test.expression, test.from, next, want)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNextNever(t *testing.T) {
+	schedule, err := ParseCron("0 0 30 feb *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if next := schedule.Next(cronTime(t, time.UTC, "2026-10-19 06:54")); !next.IsZero() {
+		t.Errorf("got %s, want the zero time", next)
+	}
+}
+
+// Europe/Berlin skips from 02:00 to 03:00 on 2026-03-29; times in the gap do
+// not fire that day, the schedule moves on to the next one
+func TestCronScheduleNextDaylightSaving(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		from       string
+		next       string
+	}{
+		{"skipped time", "30 2 * * *", "2026-03-28 12:00", "2026-03-30 02:30"},
+		{"skipped hour", "*/15 2 * * *", "2026-03-28 12:00", "2026-03-30 02:00"},
+		{"time after the gap", "30 3 * * *", "2026-03-28 12:00", "2026-03-29 03:30"},
+		{"every minute across the gap", "* * * * *", "2026-03-29 01:59", "2026-03-29 03:00"},
+		{"hourly across the gap", "0 * * * *", "2026-03-29 01:30", "2026-03-29 03:00"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := ParseCron(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			next := schedule.Next(cronTime(t, berlin, test.from))
+			if want := cronTime(t, berlin, test.next); !next.Equal(want) {
+				t.Errorf("%q after %s: got %s, want %s", test.expression, test.from, next, want)
+			}
+			if !schedule.Matches(next) {
+				t.Errorf("%q does not match its next time %s", test.expression, next)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package storm
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// A problem found in a workflow or inventory file
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+// `file:line:column: message`, leaving out the position parts that are unknown
+func (d Diagnostic) String() string {
+	position := d.File
+
+	if d.Line > 0 {
+		position = fmt.Sprintf("%s:%d", position, d.Line)
+	}
+	if d.Line > 0 && d.Column > 0 {
+		position = fmt.Sprintf("%s:%d", position, d.Column)
+	}
+
+	return fmt.Sprintf("%s: %s", position, d.Message)
+}
+
+// Every problem found in a file; used as the error returned by `Load`
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	return strings.Join(lo.Map(d, func(diagnostic Diagnostic, _ int) string { return diagnostic.String() }), "\n")
+}
+
+// Order diagnostics by position; those of each file stay together, files in
+// the order they were first reported, e.g. a workflow before what it includes
+func (d Diagnostics) sort() Diagnostics {
+	files := map[string]int{}
+	for _, diagnostic := range d {
+		if _, found := files[diagnostic.File]; !found {
+			files[diagnostic.File] = len(files)
+		}
+	}
+
+	sort.SliceStable(d, func(i, j int) bool {
+		if d[i].File != d[j].File {
+			return files[d[i].File] < files[d[j].File]
+		}
+		if d[i].Line != d[j].Line {
+			return d[i].Line < d[j].Line
+		}
+
+		return d[i].Column < d[j].Column
+	})
+
+	return d
+}
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+): (.*)`)
+
+// Parse yaml into a node tree so diagnostics can point at positions
+func parseYaml(file string, content []byte) (*yaml.Node, Diagnostics) {
+	document := yaml.Node{}
+
+	err := yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, Diagnostics{yamlErrorDiagnostic(file, strings.TrimPrefix(err.Error(), "yaml: "))}
+	}
+
+	if len(document.Content) == 0 {
+		return nil, Diagnostics{{File: file, Message: "file is empty"}}
+	}
+
+	return document.Content[0], nil
+}
+
+func yamlErrorDiagnostic(file string, message string) Diagnostic {
+	matches := yamlErrorLine.FindStringSubmatch(message)
+	if matches == nil {
+		return Diagnostic{File: file, Message: message}
+	}
+
+	line, _ := strconv.Atoi(matches[1])
+
+	return Diagnostic{File: file, Line: line, Message: matches[2]}
+}
+
+func describeNode(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	default:
+		return fmt.Sprintf("%q", node.Value)
+	}
+}
+
+// Find the node at a path of mapping keys and list indexes, e.g.
+// `jobs`, `2`, `needs`; falls back to the deepest node found
+func nodeAt(root *yaml.Node, path ...string) *yaml.Node {
+	node := root
+
+	for _, segment := range path {
+		if node.Kind == yaml.AliasNode {
+			node = node.Alias
+		}
+
+		var next *yaml.Node
+
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == segment {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			index, err := strconv.Atoi(segment)
+			if err == nil && index >= 0 && index < len(node.Content) {
+				next = node.Content[index]
+			}
+		}
+
+		if next == nil {
+			return node
+		}
+
+		node = next
+	}
+
+	return node
+}
+
+// Collects diagnostics positioned at paths of a document
+type diagnosticCollector struct {
+	file        string
+	root        *yaml.Node
+	diagnostics Diagnostics
+}
+
+func (c *diagnosticCollector) add(path []string, message string, args ...any) {
+	diagnostic := Diagnostic{File: c.file, Message: fmt.Sprintf(message, args...)}
+
+	if c.root != nil {
+		node := nodeAt(c.root, path...)
+		diagnostic.Line = node.Line
+		diagnostic.Column = node.Column
+	}
+
+	c.diagnostics = append(c.diagnostics, diagnostic)
+}
+
+func (c *diagnosticCollector) result() Diagnostics {
+	if len(c.diagnostics) == 0 {
+		return nil
+	}
+
+	return c.diagnostics.sort()
+}
@@ -0,0 +1,66 @@
+package storm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiagnosticsSort(t *testing.T) {
+	tests := []struct {
+		name        string
+		diagnostics Diagnostics
+		sorted      Diagnostics
+	}{
+		{
+			name:        "by line then column",
+			diagnostics: Diagnostics{{File: "w.yaml", Line: 9, Column: 3}, {File: "w.yaml", Line: 2, Column: 7}, {File: "w.yaml", Line: 2, Column: 5}},
+			sorted:      Diagnostics{{File: "w.yaml", Line: 2, Column: 5}, {File: "w.yaml", Line: 2, Column: 7}, {File: "w.yaml", Line: 9, Column: 3}},
+		},
+		{
+			name: "files stay together",
+			diagnostics: Diagnostics{
+				{File: "w.yaml", Line: 12, Message: "caller"},
+				{File: "steps.yaml", Line: 3, Message: "included"},
+				{File: "w.yaml", Line: 4, Message: "caller"},
+				{File: "steps.yaml", Line: 1, Message: "included"},
+			},
+			sorted: Diagnostics{
+				{File: "w.yaml", Line: 4, Message: "caller"},
+				{File: "w.yaml", Line: 12, Message: "caller"},
+				{File: "steps.yaml", Line: 1, Message: "included"},
+				{File: "steps.yaml", Line: 3, Message: "included"},
+			},
+		},
+		{
+			name:        "same position keeps its order",
+			diagnostics: Diagnostics{{File: "w.yaml", Message: "b"}, {File: "w.yaml", Message: "a"}},
+			sorted:      Diagnostics{{File: "w.yaml", Message: "b"}, {File: "w.yaml", Message: "a"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if sorted := test.diagnostics.sort(); !reflect.DeepEqual(sorted, test.sorted) {
+				t.Errorf("got %+v, want %+v", sorted, test.sorted)
+			}
+		})
+	}
+}
+
+func TestDiagnosticString(t *testing.T) {
+	tests := []struct {
+		diagnostic Diagnostic
+		text       string
+	}{
+		{Diagnostic{File: "w.yaml", Line: 3, Column: 5, Message: "oops"}, "w.yaml:3:5: oops"},
+		{Diagnostic{File: "w.yaml", Line: 3, Message: "oops"}, "w.yaml:3: oops"},
+		{Diagnostic{File: "w.yaml", Column: 5, Message: "oops"}, "w.yaml: oops"},
+		{Diagnostic{File: "w.yaml", Message: "file is empty"}, "w.yaml: file is empty"},
+	}
+
+	for _, test := range tests {
+		if text := test.diagnostic.String(); text != test.text {
+			t.Errorf("got %q, want %q", text, test.text)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package storm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// Lines of context around changes
+const diffContext = 3
+
+// Beyond this many line pairs, files are not compared line by line
+const diffMaxComparisons = 4_000_000
+
+// Unified diff of a file's content; nothing when it is the same. A missing
+// file is diffed from /dev/null.
+func unifiedDiff(file string, before []byte, after []byte, existed bool) []string {
+	if bytes.Equal(before, after) && existed {
+		return nil
+	}
+
+	header := []string{
+		"--- " + lo.Ternary(existed, file, "/dev/null"),
+		"+++ " + file,
+	}
+
+	if bytes.IndexByte(before, 0) >= 0 || bytes.IndexByte(after, 0) >= 0 {
+		return append(header, "binary content differs")
+	}
+
+	a := splitLines(before)
+	b := splitLines(after)
+
+	if len(a)*len(b) > diffMaxComparisons {
+		return append(header, fmt.Sprintf("too large to compare; %d lines before, %d after", len(a), len(b)))
+	}
+
+	return append(header, diffHunks(a, b)...)
+}
+
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return []string{}
+	}
+
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// Edits turning a into b, from their longest common subsequence; ' ' keeps a
+// line, '-' removes one of a and '+' adds one of b
+type diffEdit struct {
+	kind byte
+	line string
+}
+
+func diffEdits(a []string, b []string) []diffEdit {
+	// lcs[i][j] is the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	edits := []diffEdit{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, diffEdit{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, diffEdit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, diffEdit{'+', b[j]})
+			j++
+		}
+	}
+
+	return edits
+}
+
+// Group edits into `@@ -start,count +start,count @@` hunks with context
+func diffHunks(a []string, b []string) []string {
+	edits := diffEdits(a, b)
+	lines := []string{}
+
+	for start := 0; start < len(edits); {
+		// Next change
+		for start < len(edits) && edits[start].kind == ' ' {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+
+		// Hunks go on while changes are close enough to share context
+		end := start
+		for unchanged := 0; end < len(edits) && unchanged <= 2*diffContext; end++ {
+			unchanged = lo.Ternary(edits[end].kind == ' ', unchanged+1, 0)
+		}
+		for end > start && edits[end-1].kind == ' ' {
+			end--
+		}
+
+		first := max(start-diffContext, 0)
+		last := min(end+diffContext, len(edits))
+
+		// Line numbers of the hunk's first line in a and b
+		aLine, bLine := 1, 1
+		for _, edit := range edits[:first] {
+			aLine += lo.Ternary(edit.kind != '+', 1, 0)
+			bLine += lo.Ternary(edit.kind != '-', 1, 0)
+		}
+
+		hunk := []string{}
+		aCount, bCount := 0, 0
+		for _, edit := range edits[first:last] {
+			hunk = append(hunk, string(edit.kind)+edit.line)
+			aCount += lo.Ternary(edit.kind != '+', 1, 0)
+			bCount += lo.Ternary(edit.kind != '-', 1, 0)
+		}
+
+		lines = append(lines, fmt.Sprintf("@@ -%s +%s @@", hunkRange(aLine, aCount), hunkRange(bLine, bCount)))
+		lines = append(lines, hunk...)
+
+		start = last
+	}
+
+	return lines
+}
+
+// Empty ranges start at the line before them
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start-1)
+	}
+
+	return fmt.Sprintf("%d,%d", start, count)
+}
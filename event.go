@@ -0,0 +1,366 @@
+package storm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// Version of the line-delimited event protocol spoken between the controller
+// and the storm binary on remote servers. Bump it whenever a field changes
+// meaning or a new event type is added.
+const EventProtocolVersion = 2
+
+type EventType string
+
+const (
+	EventRunStarted   EventType = "run.started"
+	EventJobStarted   EventType = "job.started"
+	EventStepStarted  EventType = "step.started"
+	EventStepOutput   EventType = "step.output"
+	EventStepFinished EventType = "step.finished"
+	EventStepSkipped  EventType = "step.skipped"
+	EventJobFinished  EventType = "job.finished"
+	EventJobSkipped   EventType = "job.skipped"
+	EventRunFinished  EventType = "run.finished"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// Emitted while a workflow runs, locally or on a remote server. Use a type
+// switch on the concrete types to handle them;
+//
+//	switch e := event.(type) {
+//	case *storm.StepOutput:
+//		fmt.Println(e.Host, e.Job, e.Step, e.Line)
+//	}
+type Event interface {
+	Type() EventType
+	Meta() *EventMeta
+}
+
+// Fields shared by every event
+type EventMeta struct {
+	RunId    string
+	Time     time.Time
+	Host     string
+	Workflow string
+	Job      string
+	Step     string
+}
+
+func (m *EventMeta) Meta() *EventMeta {
+	return m
+}
+
+type RunStarted struct {
+	EventMeta
+}
+
+type JobStarted struct {
+	EventMeta
+}
+
+type StepStarted struct {
+	EventMeta
+	Command string
+}
+
+type StepOutput struct {
+	EventMeta
+
+	// `stdout` or `stderr`
+	Stream string
+	Line   string
+}
+
+type StepFinished struct {
+	EventMeta
+	ExitCode int
+	Duration time.Duration
+	Outputs  map[string]string
+	Error    string
+
+	// Whether the step changed anything
+	Changed bool
+}
+
+// A step that did not run; its outputs are the ones recorded when it last ran
+type StepSkipped struct {
+	EventMeta
+	Reason  string
+	Outputs map[string]string
+}
+
+type JobFinished struct {
+	EventMeta
+	ExitCode int
+	Duration time.Duration
+	Error    string
+}
+
+type JobSkipped struct {
+	EventMeta
+	Reason string
+
+	// Run the job completed in, when it is skipped for a resumed run
+	ResumedFrom string
+}
+
+type RunFinished struct {
+	EventMeta
+	ExitCode int
+	Duration time.Duration
+	Error    string
+}
+
+func (e *RunStarted) Type() EventType   { return EventRunStarted }
+func (e *JobStarted) Type() EventType   { return EventJobStarted }
+func (e *StepStarted) Type() EventType  { return EventStepStarted }
+func (e *StepOutput) Type() EventType   { return EventStepOutput }
+func (e *StepFinished) Type() EventType { return EventStepFinished }
+func (e *StepSkipped) Type() EventType  { return EventStepSkipped }
+func (e *JobFinished) Type() EventType  { return EventJobFinished }
+func (e *JobSkipped) Type() EventType   { return EventJobSkipped }
+func (e *RunFinished) Type() EventType  { return EventRunFinished }
+
+// Fan out events to subscribers over channels
+//
+//	@example
+//
+//	bus := NewEventBus()
+//	events, unsubscribe := bus.Subscribe(64)
+//	go func() {
+//		for event := range events {
+//			fmt.Println(event.Type())
+//		}
+//	}()
+//	workflow.Run(workflow.WorkflowWithFile("./workflow.yaml"), workflow.WorkflowWithEvents(bus))
+//	unsubscribe()
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers map[*eventSubscriber]struct{}
+}
+
+// A subscriber's channel; `done` is closed on unsubscribe to release the
+// publishers waiting on a full buffer, the channel is closed once they left
+type eventSubscriber struct {
+	mu     sync.RWMutex
+	events chan Event
+	done   chan struct{}
+	closed bool
+}
+
+func (s *eventSubscriber) send(event Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.events <- event:
+	case <-s.done:
+	}
+}
+
+// Subscribe to every event published from now on; `Publish` blocks while a
+// subscriber's buffer is full, so keep reading until unsubscribed
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	subscriber := &eventSubscriber{events: make(chan Event, buffer), done: make(chan struct{})}
+
+	b.mu.Lock()
+	b.subscribers[subscriber] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := sync.OnceFunc(func() {
+		b.mu.Lock()
+		delete(b.subscribers, subscriber)
+		b.mu.Unlock()
+
+		close(subscriber.done)
+
+		subscriber.mu.Lock()
+		subscriber.closed = true
+		close(subscriber.events)
+		subscriber.mu.Unlock()
+	})
+
+	return subscriber.events, unsubscribe
+}
+
+// Send an event to every subscriber; the bus is not locked while sending, a
+// subscriber can unsubscribe while a publisher waits on it
+func (b *EventBus) Publish(event Event) {
+	b.mu.RLock()
+	subscribers := lo.Keys(b.subscribers)
+	b.mu.RUnlock()
+
+	for _, subscriber := range subscribers {
+		subscriber.send(event)
+	}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: map[*eventSubscriber]struct{}{}}
+}
+
+// Serialise concurrent emitters (stdout and stderr streams) into handlers
+func newEventDispatcher(handlers []func(Event)) func(Event) {
+	var mu sync.Mutex
+
+	return func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, handler := range handlers {
+			handler(event)
+		}
+	}
+}
+
+// A single entry of the event protocol; one JSON object per line
+//
+//	example;
+//	{"v":1,"type":"step.output","time":"2024-08-30T14:25:01Z","job":"build","step":"Install curl","stream":"stdout","line":"..."}
+type eventEnvelope struct {
+	Version  int       `json:"v"`
+	Type     EventType `json:"type"`
+	RunId    string    `json:"run,omitempty"`
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host,omitempty"`
+	Workflow string    `json:"workflow,omitempty"`
+	Job      string    `json:"job,omitempty"`
+	Step     string    `json:"step,omitempty"`
+
+	// Set on `step.started`
+	Command string `json:"command,omitempty"`
+
+	// Set on `step.output`
+	Stream string `json:"stream,omitempty"`
+	Line   string `json:"line,omitempty"`
+
+	// Set on `*.finished`; duration is in seconds
+	ExitCode *int              `json:"exit_code,omitempty"`
+	Duration float64           `json:"duration,omitempty"`
+	Outputs  map[string]string `json:"outputs,omitempty"`
+	Error    string            `json:"error,omitempty"`
+
+	// Set on `step.finished`
+	Changed bool `json:"changed,omitempty"`
+
+	// Set on `*.skipped`
+	Reason string `json:"reason,omitempty"`
+
+	// Set on `job.skipped` of jobs a resumed run completed
+	ResumedFrom string `json:"resumed_from,omitempty"`
+}
+
+// Encode an event as a single protocol line (without the trailing newline)
+func MarshalEvent(event Event) ([]byte, error) {
+	meta := event.Meta()
+	envelope := eventEnvelope{
+		Version:  EventProtocolVersion,
+		Type:     event.Type(),
+		RunId:    meta.RunId,
+		Time:     meta.Time,
+		Host:     meta.Host,
+		Workflow: meta.Workflow,
+		Job:      meta.Job,
+		Step:     meta.Step,
+	}
+
+	switch e := event.(type) {
+	case *StepStarted:
+		envelope.Command = e.Command
+	case *StepOutput:
+		envelope.Stream = e.Stream
+		envelope.Line = e.Line
+	case *StepFinished:
+		envelope.ExitCode = &e.ExitCode
+		envelope.Duration = e.Duration.Seconds()
+		envelope.Outputs = e.Outputs
+		envelope.Error = e.Error
+		envelope.Changed = e.Changed
+	case *StepSkipped:
+		envelope.Reason = e.Reason
+		envelope.Outputs = e.Outputs
+	case *JobSkipped:
+		envelope.Reason = e.Reason
+		envelope.ResumedFrom = e.ResumedFrom
+	case *JobFinished:
+		envelope.ExitCode = &e.ExitCode
+		envelope.Duration = e.Duration.Seconds()
+		envelope.Error = e.Error
+	case *RunFinished:
+		envelope.ExitCode = &e.ExitCode
+		envelope.Duration = e.Duration.Seconds()
+		envelope.Error = e.Error
+	}
+
+	return json.Marshal(&envelope)
+}
+
+// Parse a protocol line back into an event; lines that are not events (plain
+// output from the remote shell, for example) return an error
+func UnmarshalEvent(line []byte) (Event, error) {
+	envelope := eventEnvelope{}
+
+	err := json.Unmarshal(line, &envelope)
+	if err != nil {
+		return nil, errors.Join(errors.New("not an event"), err)
+	}
+
+	if envelope.Version == 0 || envelope.Type == "" {
+		return nil, errors.New("not an event; missing version or type")
+	}
+
+	if envelope.Version > EventProtocolVersion {
+		return nil, fmt.Errorf("unsupported event protocol version %d; expected %d or lower", envelope.Version, EventProtocolVersion)
+	}
+
+	meta := EventMeta{
+		RunId:    envelope.RunId,
+		Time:     envelope.Time,
+		Host:     envelope.Host,
+		Workflow: envelope.Workflow,
+		Job:      envelope.Job,
+		Step:     envelope.Step,
+	}
+	exitCode := 0
+	if envelope.ExitCode != nil {
+		exitCode = *envelope.ExitCode
+	}
+	duration := time.Duration(envelope.Duration * float64(time.Second))
+
+	switch envelope.Type {
+	case EventRunStarted:
+		return &RunStarted{EventMeta: meta}, nil
+	case EventJobStarted:
+		return &JobStarted{EventMeta: meta}, nil
+	case EventStepStarted:
+		return &StepStarted{EventMeta: meta, Command: envelope.Command}, nil
+	case EventStepOutput:
+		return &StepOutput{EventMeta: meta, Stream: envelope.Stream, Line: envelope.Line}, nil
+	case EventStepFinished:
+		return &StepFinished{EventMeta: meta, ExitCode: exitCode, Duration: duration, Outputs: envelope.Outputs, Error: envelope.Error, Changed: envelope.Changed}, nil
+	case EventStepSkipped:
+		return &StepSkipped{EventMeta: meta, Reason: envelope.Reason, Outputs: envelope.Outputs}, nil
+	case EventJobSkipped:
+		return &JobSkipped{EventMeta: meta, Reason: envelope.Reason, ResumedFrom: envelope.ResumedFrom}, nil
+	case EventJobFinished:
+		return &JobFinished{EventMeta: meta, ExitCode: exitCode, Duration: duration, Error: envelope.Error}, nil
+	case EventRunFinished:
+		return &RunFinished{EventMeta: meta, ExitCode: exitCode, Duration: duration, Error: envelope.Error}, nil
+	default:
+		return nil, fmt.Errorf("unknown event type %s", envelope.Type)
+	}
+}
@@ -0,0 +1,200 @@
+package storm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// `${{ namespace.name }}`
+var expressionPattern = regexp.MustCompile(`\$\{\{\s*(.*?)\s*\}\}`)
+
+// Values expressions can refer to
+type ExpressionContext struct {
+	Inputs map[string]string
+
+	// Facts of the host the workflow runs on; without them, until the host is
+	// known, facts expressions are left as they are
+	Facts map[string]string
+
+	// Quotes inputs written into shell commands; ShellQuote when nil
+	quoteInput func(string) string
+}
+
+// Replace every `${{ ... }}` expression of the text with its value
+func (c ExpressionContext) Interpolate(text string) (string, error) {
+	return c.interpolate(text, nil)
+}
+
+// Replace the expressions of a shell command; inputs are quoted so they are
+// a single word whatever they hold, facts are written as they are
+func (c ExpressionContext) interpolateCommand(text string) (string, error) {
+	return c.interpolate(text, lo.Ternary(c.quoteInput != nil, c.quoteInput, ShellQuote))
+}
+
+func (c ExpressionContext) interpolate(text string, quoteInput func(string) string) (string, error) {
+	var err error
+
+	result := expressionPattern.ReplaceAllStringFunc(text, func(match string) string {
+		expression := expressionPattern.FindStringSubmatch(match)[1]
+		if c.Facts == nil && strings.HasPrefix(expression, "facts.") {
+			return match
+		}
+
+		value, evaluateErr := c.evaluate(expression)
+		if evaluateErr != nil && err == nil {
+			err = evaluateErr
+		}
+
+		if quoteInput != nil && evaluateErr == nil && strings.HasPrefix(expression, "inputs.") {
+			return quoteInput(value)
+		}
+
+		return value
+	})
+
+	return result, err
+}
+
+func (c ExpressionContext) evaluate(expression string) (string, error) {
+	namespace, name, _ := strings.Cut(expression, ".")
+
+	switch namespace {
+	case "inputs":
+		value, found := c.Inputs[name]
+		if !found {
+			return "", fmt.Errorf("unknown input %q in ${{ %s }}", name, expression)
+		}
+
+		return value, nil
+	case "facts":
+		value, found := c.Facts[name]
+		if !found {
+			return "", fmt.Errorf("unknown fact %q in ${{ %s }}; facts are %s", name, expression, strings.Join(factNames(), ", "))
+		}
+
+		return value, nil
+	default:
+		return "", fmt.Errorf("unknown expression ${{ %s }}; expected inputs.<name> or facts.<name>", expression)
+	}
+}
+
+// Interpolate the commands, names, directories, guards and destinations of
+// the workflow's steps
+func (c ExpressionContext) interpolateWorkflow(wc WorkflowConfig) (WorkflowConfig, error) {
+	directory, err := c.Interpolate(wc.Directory)
+	if err != nil {
+		return wc, err
+	}
+	wc.Directory = directory
+
+	jobs := make([]Job, len(wc.Jobs))
+	for i, job := range wc.Jobs {
+		steps, err := c.interpolateSteps(job, job.Steps)
+		if err != nil {
+			return wc, err
+		}
+
+		handlers, err := c.interpolateSteps(job, job.Handlers)
+		if err != nil {
+			return wc, err
+		}
+
+		job.Steps = steps
+		job.Handlers = handlers
+		jobs[i] = job
+	}
+	wc.Jobs = jobs
+
+	return wc, nil
+}
+
+// Interpolate steps of a job, or its handlers
+func (c ExpressionContext) interpolateSteps(job Job, steps []Step) ([]Step, error) {
+	if steps == nil {
+		return nil, nil
+	}
+
+	result := make([]Step, len(steps))
+
+	for i, step := range steps {
+		for _, field := range []*string{&step.Name, &step.Directory, &step.Creates, &step.Removes} {
+			value, err := c.Interpolate(*field)
+			if err != nil {
+				return nil, fmt.Errorf("%s job, %s step; %w", job.Name, step.Name, err)
+			}
+
+			*field = value
+		}
+
+		for _, field := range []*string{&step.Run, &step.Unless, &step.OnlyIf} {
+			value, err := c.interpolateCommand(*field)
+			if err != nil {
+				return nil, fmt.Errorf("%s job, %s step; %w", job.Name, step.Name, err)
+			}
+
+			*field = value
+		}
+
+		if fileStep, _ := step.file(); fileStep != nil {
+			interpolated := *fileStep
+			for _, field := range []*string{&interpolated.Dest, &interpolated.Mode, &interpolated.Owner} {
+				value, err := c.Interpolate(*field)
+				if err != nil {
+					return nil, fmt.Errorf("%s job, %s step; %w", job.Name, step.Name, err)
+				}
+
+				*field = value
+			}
+
+			if step.Template != nil {
+				step.Template = &interpolated
+			} else {
+				step.Copy = &interpolated
+			}
+		}
+
+		if step.With != nil {
+			with := map[string]string{}
+			for name, value := range step.With {
+				interpolated, err := c.Interpolate(value)
+				if err != nil {
+					return nil, fmt.Errorf("%s job, %s step; %w", job.Name, step.Name, err)
+				}
+
+				with[name] = interpolated
+			}
+			step.With = with
+		}
+
+		result[i] = step
+	}
+
+	return result, nil
+}
+
+// Quote an input written into a shell command before the expressions of its
+// value are interpolated, e.g. a used workflow's `with` referring to the
+// inputs of the workflow using it; only the text around the expressions is
+// quoted, the expressions are quoted when their own values are known
+func shellQuoteExpressions(value string) string {
+	quoted := ""
+	previous := 0
+
+	for _, match := range expressionPattern.FindAllStringIndex(value, -1) {
+		if match[0] > previous {
+			quoted += ShellQuote(value[previous:match[0]])
+		}
+
+		quoted += value[match[0]:match[1]]
+		previous = match[1]
+	}
+
+	if previous < len(value) || quoted == "" {
+		quoted += ShellQuote(value[previous:])
+	}
+
+	return quoted
+}
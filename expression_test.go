@@ -0,0 +1,101 @@
+package storm
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	context := ExpressionContext{
+		Inputs: map[string]string{"msg": "hello; echo INJECTED $(whoami)", "version": "1.4.2", "name": "it's"},
+		Facts:  map[string]string{"os": "linux"},
+	}
+
+	tests := []struct {
+		text         string
+		interpolated string
+		command      string
+	}{
+		{"plain", "plain", "plain"},
+		{"${{ inputs.version }}", "1.4.2", "'1.4.2'"},
+		{"v${{inputs.version}}-${{ facts.os }}", "v1.4.2-linux", "v'1.4.2'-linux"},
+		{"echo ${{ inputs.msg }}", "echo hello; echo INJECTED $(whoami)", "echo 'hello; echo INJECTED $(whoami)'"},
+		{"echo ${{ inputs.name }}", "echo it's", `echo 'it'\''s'`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			interpolated, err := context.Interpolate(test.text)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if interpolated != test.interpolated {
+				t.Errorf("Interpolate: got %q, want %q", interpolated, test.interpolated)
+			}
+
+			command, err := context.interpolateCommand(test.text)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if command != test.command {
+				t.Errorf("interpolateCommand: got %q, want %q", command, test.command)
+			}
+		})
+	}
+}
+
+func TestInterpolateUnknown(t *testing.T) {
+	context := ExpressionContext{Inputs: map[string]string{}, Facts: map[string]string{}}
+
+	for _, text := range []string{"${{ inputs.missing }}", "${{ facts.missing }}", "${{ secrets.token }}"} {
+		if _, err := context.interpolateCommand(text); err == nil {
+			t.Errorf("expected %q to fail", text)
+		}
+	}
+
+	// Until the host is known facts are kept for later
+	text, err := ExpressionContext{}.interpolateCommand("uname -m # ${{ facts.arch }}")
+	if err != nil || text != "uname -m # ${{ facts.arch }}" {
+		t.Errorf("got %q, %v; want the fact kept", text, err)
+	}
+}
+
+// Inputs of used workflows may refer to the inputs of the workflow using
+// them; quoted once the outer values are known, commands still get a single
+// word for each
+func TestShellQuoteExpressions(t *testing.T) {
+	tests := []struct {
+		value  string
+		quoted string
+		outer  string
+		word   string
+	}{
+		{"", "''", "", ""},
+		{"a b", "'a b'", "", "a b"},
+		{"${{ inputs.root }}", "${{ inputs.root }}", "/srv/my app", "/srv/my app"},
+		{"${{ inputs.root }}/it's", "${{ inputs.root }}'/it'\\''s'", "/srv/$(id)", "/srv/$(id)/it's"},
+		{"pre ${{ inputs.root }} ${{ facts.os }}", "'pre '${{ inputs.root }}' '${{ facts.os }}", "; id", "pre ; id linux"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			quoted := shellQuoteExpressions(test.value)
+			if quoted != test.quoted {
+				t.Fatalf("got %q, want %q", quoted, test.quoted)
+			}
+
+			command, err := ExpressionContext{Inputs: map[string]string{"root": test.outer}, Facts: map[string]string{"os": "linux"}}.interpolateCommand("printf %s " + quoted)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			output, err := exec.Command("sh", "-c", command).Output()
+			if err != nil {
+				t.Fatalf("%s: %v", command, err)
+			}
+			if string(output) != test.word {
+				t.Errorf("%s: got %q, want %q", command, output, test.word)
+			}
+		})
+	}
+}
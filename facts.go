@@ -0,0 +1,370 @@
+package storm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// What a host is; gathered before its jobs run, and available to expressions
+// and conditions as `facts.<name>` and to templates as `.Facts`
+type Facts struct {
+	Hostname string `json:"hostname"`
+
+	// Lower cased `uname -s`; linux or darwin
+	OS string `json:"os"`
+
+	// `ID`, `VERSION_ID` and the first of `ID_LIKE` of /etc/os-release, e.g.
+	// ubuntu, 22.04 and debian; macos on darwin
+	Distro        string `json:"distro"`
+	DistroVersion string `json:"distro-version"`
+	DistroFamily  string `json:"distro-family"`
+
+	Kernel string `json:"kernel"`
+
+	// Named like Go's GOARCH; amd64, arm64, arm, 386...
+	Arch string `json:"arch"`
+
+	CPUs     int `json:"cpus"`
+	MemoryMB int `json:"memory-mb"`
+
+	// Global addresses of the host's interfaces
+	IPs []string `json:"ips"`
+
+	// apt, dnf, yum, apk or pacman, as the package module uses them; and
+	// systemd, openrc or launchd
+	PackageManager string `json:"package-manager"`
+	InitSystem     string `json:"init-system"`
+
+	GatheredAt time.Time `json:"gathered-at"`
+}
+
+// Prints `name=value` lines; run with sh, on any unix
+var factsScript = `
+echo "hostname=$(hostname 2>/dev/null || uname -n)"
+echo "os=$(uname -s)"
+echo "kernel=$(uname -r)"
+echo "machine=$(uname -m)"
+if [ -r /etc/os-release ]; then
+	. /etc/os-release
+	echo "distro=$ID"
+	echo "distro-version=$VERSION_ID"
+	echo "distro-family=${ID_LIKE:-$ID}"
+elif command -v sw_vers >/dev/null 2>&1; then
+	echo "distro=macos"
+	echo "distro-version=$(sw_vers -productVersion)"
+	echo "distro-family=darwin"
+fi
+echo "cpus=$(getconf _NPROCESSORS_ONLN 2>/dev/null || sysctl -n hw.ncpu 2>/dev/null)"
+if [ -r /proc/meminfo ]; then
+	awk '/^MemTotal:/ { print "memory-kb=" $2 }' /proc/meminfo
+else
+	echo "memory-bytes=$(sysctl -n hw.memsize 2>/dev/null)"
+fi
+if command -v ip >/dev/null 2>&1; then
+	ip -o addr show scope global 2>/dev/null | awk '{ split($4, a, "/"); print "ip=" a[1] }'
+elif command -v ifconfig >/dev/null 2>&1; then
+	ifconfig 2>/dev/null | awk '$1 == "inet" || $1 == "inet6" { sub("addr:", "", $2); print "ip=" $2 }' | grep -v -e '=127\.' -e '=::1$' -e '=fe80:'
+fi
+for manager in ` + strings.Join(lo.Map(packageManagers, func(m packageManager, _ int) string { return m.name }), " ") + `; do
+	program=$manager
+	[ "$manager" = apt ] && program=apt-get
+	if command -v $program >/dev/null 2>&1; then
+		echo "package-manager=$manager"
+		break
+	fi
+done
+if [ -d /run/systemd/system ]; then
+	echo "init-system=systemd"
+elif command -v rc-service >/dev/null 2>&1; then
+	echo "init-system=openrc"
+elif command -v launchctl >/dev/null 2>&1; then
+	echo "init-system=launchd"
+fi
+`
+
+// `uname -m` names of architectures, by GOARCH
+var unameArchs = map[string][]string{
+	"amd64":   {"x86_64", "amd64"},
+	"arm64":   {"aarch64", "arm64"},
+	"arm":     {"armv5l", "armv6l", "armv7l", "armhf"},
+	"386":     {"i386", "i486", "i586", "i686", "x86"},
+	"ppc64le": {"ppc64le"},
+	"s390x":   {"s390x"},
+	"riscv64": {"riscv64"},
+}
+
+// GOARCH name of a `uname -m` architecture; unknown ones are kept as they are
+func normalizeArch(machine string) string {
+	for arch, names := range unameArchs {
+		if lo.Contains(names, machine) {
+			return arch
+		}
+	}
+
+	return machine
+}
+
+// Read the output of the facts script
+func parseFacts(output string) Facts {
+	facts := Facts{IPs: []string{}, GatheredAt: time.Now().UTC()}
+
+	for _, line := range strings.Split(output, "\n") {
+		name, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found || value == "" {
+			continue
+		}
+
+		switch name {
+		case "hostname":
+			facts.Hostname = value
+		case "os":
+			facts.OS = strings.ToLower(value)
+		case "kernel":
+			facts.Kernel = value
+		case "machine":
+			facts.Arch = normalizeArch(value)
+		case "distro":
+			facts.Distro = value
+		case "distro-version":
+			facts.DistroVersion = value
+		case "distro-family":
+			facts.DistroFamily = strings.Fields(value)[0]
+		case "cpus":
+			facts.CPUs, _ = strconv.Atoi(value)
+		case "memory-kb":
+			kb, _ := strconv.Atoi(value)
+			facts.MemoryMB = kb / 1024
+		case "memory-bytes":
+			bytes, _ := strconv.ParseInt(value, 10, 64)
+			facts.MemoryMB = int(bytes / 1024 / 1024)
+		case "ip":
+			facts.IPs = append(facts.IPs, value)
+		case "package-manager":
+			facts.PackageManager = value
+		case "init-system":
+			facts.InitSystem = value
+		}
+	}
+
+	return facts
+}
+
+// Facts as expressions see them; every value is a string, addresses are
+// separated by spaces
+func (f Facts) values() map[string]string {
+	return map[string]string{
+		"hostname":        f.Hostname,
+		"os":              f.OS,
+		"distro":          f.Distro,
+		"distro-version":  f.DistroVersion,
+		"distro-family":   f.DistroFamily,
+		"kernel":          f.Kernel,
+		"arch":            f.Arch,
+		"cpus":            strconv.Itoa(f.CPUs),
+		"memory-mb":       strconv.Itoa(f.MemoryMB),
+		"ip":              lo.FirstOrEmpty(f.IPs),
+		"ips":             strings.Join(f.IPs, " "),
+		"package-manager": f.PackageManager,
+		"init-system":     f.InitSystem,
+	}
+}
+
+// Names of the facts, sorted
+func factNames() []string {
+	names := lo.Keys(Facts{}.values())
+	sort.Strings(names)
+
+	return names
+}
+
+// Facts with every name and no value; for checking expressions before any
+// host is known
+func declaredFacts() map[string]string {
+	return lo.SliceToMap(factNames(), func(name string) (string, string) { return name, "" })
+}
+
+// Facts of the current machine; what Go knows of it when the facts script
+// cannot run, e.g. on windows
+func GatherLocalFacts() Facts {
+	output, err := exec.Command("sh", "-c", factsScript).Output()
+	if err == nil {
+		return parseFacts(string(output))
+	}
+
+	hostname, _ := os.Hostname()
+
+	return Facts{
+		Hostname:   hostname,
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		CPUs:       runtime.NumCPU(),
+		IPs:        []string{},
+		GatheredAt: time.Now().UTC(),
+	}
+}
+
+// Gather a server's facts over an established connection
+func (a *Agent) gatherFacts(client *ssh.Client) (Facts, error) {
+	output, _, err := a.ssh.ExecuteCommand(ExecuteCommandArgs{
+		Client:         client,
+		Command:        "sh -c " + ShellQuote(factsScript),
+		OutputCallback: func(string) {},
+		ErrorCallback:  func(string) {},
+	})
+	if err != nil {
+		return Facts{}, errors.Join(errors.New("could not gather facts"), err)
+	}
+
+	return parseFacts(output), nil
+}
+
+// Facts of a server; cached ones when they are recent enough, otherwise
+// gathered and cached
+func (a *Agent) serverFacts(client *ssh.Client, server Server, cache *FactsCache, maxAge time.Duration) (Facts, error) {
+	if cache != nil && maxAge > 0 {
+		if cached, err := cache.Load(server.Name); err == nil && cached != nil && time.Since(cached.GatheredAt) < maxAge {
+			return *cached, nil
+		}
+	}
+
+	facts, err := a.gatherFacts(client)
+	if err != nil {
+		return facts, err
+	}
+
+	if cache != nil {
+		if err := cache.Save(server.Name, facts); err != nil {
+			return facts, err
+		}
+	}
+
+	return facts, nil
+}
+
+type GatherFactsArgs struct {
+	Inventory InventoryConfig
+
+	// Only gather the facts of servers matching these names or labels
+	Limit []string
+
+	Cache *FactsCache
+
+	// Use cached facts younger than this instead of gathering them
+	MaxAge time.Duration
+}
+
+// Facts of a server, or why they could not be gathered
+type ServerFacts struct {
+	Server string `json:"server"`
+	Facts  *Facts `json:"facts,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Gather the facts of the inventory's servers; servers that cannot be reached
+// are reported, the others are still gathered
+func (a *Agent) GatherFacts(args GatherFactsArgs) []ServerFacts {
+	result := []ServerFacts{}
+
+	for _, server := range args.Inventory.Select(args.Limit...) {
+		serverFacts := ServerFacts{Server: server.Name}
+
+		facts, err := func() (Facts, error) {
+			client, err := a.ssh.Authenticate(AuthenticateArgs{
+				Host:          server.Host,
+				Port:          server.Port,
+				User:          server.User,
+				Password:      server.SshPassword,
+				PrivateSshKey: server.PrivateSshKey,
+			})
+			if err != nil {
+				return Facts{}, errors.Join(err, errors.New("authentication failed"))
+			}
+			defer client.Close()
+
+			return a.serverFacts(client, server, args.Cache, args.MaxAge)
+		}()
+		if err != nil {
+			serverFacts.Error = err.Error()
+		} else {
+			serverFacts.Facts = &facts
+		}
+
+		result = append(result, serverFacts)
+	}
+
+	return result
+}
+
+// Local store of the last facts gathered from each server; one
+// `<server>.json` file per server
+type FactsCache struct {
+	dir string
+}
+
+// Default facts cache location; `~/.storm/facts`
+func DefaultFactsDirectory() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Join(errors.New("cannot resolve home directory"), err)
+	}
+
+	return filepath.Join(home, ".storm", "facts"), nil
+}
+
+func (c *FactsCache) file(server string) string {
+	return filepath.Join(c.dir, server+".json")
+}
+
+// Cached facts of a server; nothing when there are none
+func (c *FactsCache) Load(server string) (*Facts, error) {
+	facts, err := LoadFacts(c.file(server))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	return facts, err
+}
+
+func (c *FactsCache) Save(server string, facts Facts) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(facts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(c.file(server), content, 0600, -1, -1)
+}
+
+// Read facts written as JSON; the agent hands them over to the server's run
+func LoadFacts(file string) (*Facts, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	facts := Facts{}
+	if err := json.Unmarshal(content, &facts); err != nil {
+		return nil, fmt.Errorf("invalid facts in %s; %w", file, err)
+	}
+
+	return &facts, nil
+}
+
+func NewFactsCache(dir string) *FactsCache {
+	return &FactsCache{dir: dir}
+}
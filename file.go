@@ -0,0 +1,340 @@
+package storm
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/samber/lo"
+)
+
+// New files written by templates get this mode, unless the step has one
+const templateMode fs.FileMode = 0644
+
+// What templates can refer to, e.g. `{{ .Vars.port }}` or `{{ .Host.Name }}`
+type TemplateData struct {
+	// The inventory's variables for the host; see `InventoryConfig.ServerVars`
+	Vars map[string]any
+
+	Host     TemplateHost
+	Facts    Facts
+	Inputs   map[string]string
+	Workflow string
+	Job      string
+}
+
+type TemplateHost struct {
+	Name    string
+	Address string
+	User    string
+	Labels  []string
+}
+
+// Template data of a server of the inventory
+func NewTemplateData(ic InventoryConfig, server Server) TemplateData {
+	return TemplateData{
+		Vars: ic.ServerVars(server),
+		Host: TemplateHost{Name: server.Name, Address: server.Host, User: server.User, Labels: server.Labels},
+	}
+}
+
+// Functions templates can use besides Go's own
+var templateFuncs = template.FuncMap{
+	// `{{ index .Vars "port" | default 80 }}`
+	"default": func(fallback any, value any) any {
+		if value == nil || value == "" {
+			return fallback
+		}
+
+		return value
+	},
+}
+
+func parseTemplate(name string, content []byte) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Funcs(templateFuncs).Parse(string(content))
+}
+
+// Render a template file; unknown variables are errors, `index` and `default`
+// give them a fallback
+func renderTemplate(file string, data TemplateData) ([]byte, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := parseTemplate(filepath.Base(file), content)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := bytes.Buffer{}
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// The copy or template of a step, and its key in the workflow
+func (s Step) file() (*FileStep, string) {
+	if s.Template != nil {
+		return s.Template, "template"
+	}
+
+	return s.Copy, "copy"
+}
+
+// Check the source a copy or template step reads and make it absolute; the
+// step is named after its destination unless it has a name
+func (r *includeResolver) file(c *diagnosticCollector, file string, step Step, path []string) Step {
+	fileStep, key := step.file()
+	srcPath := append(append([]string{}, path...), key, "src")
+
+	src := filepath.Clean(fileStep.Src)
+	if !filepath.IsAbs(src) {
+		src = filepath.Join(filepath.Dir(file), fileStep.Src)
+	}
+
+	content, err := os.ReadFile(src)
+	if err != nil {
+		c.add(srcPath, "cannot read %s; %s", fileStep.Src, err)
+		return step
+	}
+
+	if step.Template != nil {
+		if _, err := parseTemplate(filepath.Base(src), content); err != nil {
+			c.add(srcPath, "%s", err)
+			return step
+		}
+	}
+
+	absolute, err := filepath.Abs(src)
+	if err != nil {
+		c.add(srcPath, "%s", err)
+		return step
+	}
+
+	resolved := *fileStep
+	resolved.Src = absolute
+
+	if step.Template != nil {
+		step.Template = &resolved
+	} else {
+		step.Copy = &resolved
+	}
+	step.Name = lo.Ternary(step.Name != "", step.Name, key+" "+resolved.Dest)
+
+	return step
+}
+
+// Write the file a copy or template step makes, unless its destination already
+// has the same content, mode and owner; reports whether anything changed
+func (w *Workflow) executeFile(step Step, args ExecuteArgs, data TemplateData) (bool, error) {
+	fileStep, _ := step.file()
+
+	var content []byte
+	var mode fs.FileMode
+	var err error
+
+	if step.Template != nil {
+		content, err = renderTemplate(fileStep.Src, data)
+		mode = templateMode
+	} else {
+		var info fs.FileInfo
+		if info, err = os.Stat(fileStep.Src); err == nil {
+			mode = info.Mode().Perm()
+			content, err = os.ReadFile(fileStep.Src)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	destination, err := expandHome(fileStep.Dest)
+	if err != nil {
+		return false, err
+	}
+	if !filepath.IsAbs(destination) && args.Directory != "" {
+		destination = filepath.Join(args.Directory, destination)
+	}
+
+	if fileStep.Mode != "" {
+		if mode, err = parseFileMode(fileStep.Mode); err != nil {
+			return false, err
+		}
+	}
+
+	uid, gid := -1, -1
+	if fileStep.Owner != "" {
+		if uid, gid, err = lookupOwner(fileStep.Owner); err != nil {
+			return false, err
+		}
+	}
+
+	report := func(changed bool) (bool, error) {
+		args.OutputCallback(fmt.Sprintf("%s %s", lo.Ternary(changed, lo.Ternary(args.Check, "would change", "changed"), "unchanged"), destination))
+		return changed, nil
+	}
+
+	info, err := os.Stat(destination)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	exists := err == nil
+
+	existing := []byte{}
+	if exists {
+		if info.IsDir() {
+			return false, fmt.Errorf("%s is a directory", destination)
+		}
+
+		// Existing files keep their mode unless the step has one
+		mode = lo.Ternary(fileStep.Mode != "", mode, info.Mode().Perm())
+
+		if existing, err = os.ReadFile(destination); err != nil {
+			return false, err
+		}
+
+		fileUid, fileGid := fileOwner(info)
+		sameOwner := (uid < 0 || uid == fileUid) && (gid < 0 || gid == fileGid)
+		sameMode := info.Mode().Perm() == mode
+
+		if bytes.Equal(existing, content) {
+			if sameMode && sameOwner {
+				return report(false)
+			}
+
+			if args.Check {
+				return report(true)
+			}
+
+			if !sameMode {
+				if err := os.Chmod(destination, mode); err != nil {
+					return false, err
+				}
+			}
+			if !sameOwner {
+				if err := os.Chown(destination, uid, gid); err != nil {
+					return false, err
+				}
+			}
+
+			return report(true)
+		}
+	}
+
+	if args.Diff {
+		for _, line := range unifiedDiff(destination, existing, content, exists) {
+			args.OutputCallback(line)
+		}
+	}
+
+	if !args.Check {
+		if err := writeFileAtomic(destination, content, mode, uid, gid); err != nil {
+			return false, err
+		}
+	}
+
+	return report(true)
+}
+
+// Write a file next to its destination and rename it into place, so readers
+// never see it half written
+func writeFileAtomic(destination string, content []byte, mode fs.FileMode, uid int, gid int) error {
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(destination), "."+filepath.Base(destination)+".storm-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(file.Name(), mode); err != nil {
+		return err
+	}
+
+	if uid >= 0 || gid >= 0 {
+		if err := os.Chown(file.Name(), uid, gid); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(file.Name(), destination)
+}
+
+// Octal permissions such as 644 or 0755
+func parseFileMode(mode string) (fs.FileMode, error) {
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed > 0777 {
+		return 0, fmt.Errorf("invalid mode %q; expected octal permissions such as 0644", mode)
+	}
+
+	return fs.FileMode(parsed), nil
+}
+
+// Ids of `user` or `user:group`; names or numeric ids. Without a group, the
+// user's primary group.
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, hasGroup := strings.Cut(owner, ":")
+
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return -1, -1, fmt.Errorf("unknown user %s", userName)
+		}
+	}
+
+	gid := u.Gid
+	if hasGroup {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return -1, -1, fmt.Errorf("unknown group %s", groupName)
+			}
+		}
+
+		gid = g.Gid
+	}
+
+	uidValue, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return -1, -1, fmt.Errorf("user %s has no numeric id", userName)
+	}
+
+	gidValue, err := strconv.Atoi(gid)
+	if err != nil {
+		return -1, -1, fmt.Errorf("group %s has no numeric id", gid)
+	}
+
+	return uidValue, gidValue, nil
+}
+
+// Paths starting with `~/` are from the home directory
+func expandHome(file string) (string, error) {
+	if file != "~" && !strings.HasPrefix(file, "~/") {
+		return file, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, strings.TrimPrefix(file, "~")), nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package storm
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// Owner and group ids of a file; -1 when unknown
+func fileOwner(info fs.FileInfo) (int, int) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1
+	}
+
+	return int(stat.Uid), int(stat.Gid)
+}
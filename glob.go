@@ -0,0 +1,95 @@
+package storm
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var globCache sync.Map
+
+// Match a slash separated name against a glob pattern; `*` matches anything
+// but `/`, `**` anything including `/` (`**/` also no directory at all), `?`
+// a single character but `/` and `[a-z]` a character class
+func MatchGlob(pattern string, name string) bool {
+	re, err := compileGlob(pattern)
+	if err != nil {
+		return false
+	}
+
+	return re.MatchString(name)
+}
+
+// Match a name against a list of patterns, in order; patterns starting with
+// `!` exclude what earlier patterns included, so the last match wins
+func MatchGlobs(patterns []string, name string) bool {
+	matched := false
+
+	for _, pattern := range patterns {
+		if negated, found := strings.CutPrefix(pattern, "!"); found {
+			if MatchGlob(negated, name) {
+				matched = false
+			}
+
+			continue
+		}
+
+		if MatchGlob(pattern, name) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	if cached, found := globCache.Load(pattern); found {
+		return cached.(*regexp.Regexp), nil
+	}
+
+	expression := strings.Builder{}
+	expression.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expression.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expression.WriteString(".*")
+			i++
+		case c == '*':
+			expression.WriteString("[^/]*")
+		case c == '?':
+			expression.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				expression.WriteString(`\[`)
+				break
+			}
+
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expression.WriteString("[" + class + "]")
+			i += end
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	expression.WriteString("$")
+
+	re, err := regexp.Compile(expression.String())
+	if err != nil {
+		return nil, err
+	}
+
+	globCache.Store(pattern, re)
+
+	return re, nil
+}
@@ -0,0 +1,271 @@
+package storm
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// Dependencies between the jobs of a workflow, built from `needs`
+type JobGraph struct {
+	jobs  []Job
+	index map[string]int
+}
+
+func NewJobGraph(jobs []Job) *JobGraph {
+	index := map[string]int{}
+	for i, job := range jobs {
+		if _, found := index[job.Name]; !found {
+			index[job.Name] = i
+		}
+	}
+
+	return &JobGraph{jobs: jobs, index: index}
+}
+
+func (g *JobGraph) Job(name string) (Job, bool) {
+	i, found := g.index[name]
+	if !found {
+		return Job{}, false
+	}
+
+	return g.jobs[i], true
+}
+
+// Jobs in the order they run; a job always comes after the job it needs and
+// otherwise keeps its position in the workflow
+func (g *JobGraph) Order() ([]Job, error) {
+	for _, job := range g.jobs {
+		if job.Needs == "" {
+			continue
+		}
+
+		if _, found := g.index[job.Needs]; !found {
+			return nil, fmt.Errorf("job %s needs unknown job %s", job.Name, job.Needs)
+		}
+	}
+
+	if cycle := g.Cycle(); cycle != nil {
+		return nil, fmt.Errorf("jobs depend on each other; %s", strings.Join(cycle, " -> "))
+	}
+
+	ordered := make([]Job, 0, len(g.jobs))
+	placed := map[string]bool{}
+
+	var place func(job Job)
+	place = func(job Job) {
+		if placed[job.Name] {
+			return
+		}
+
+		if job.Needs != "" {
+			needed, _ := g.Job(job.Needs)
+			place(needed)
+		}
+
+		placed[job.Name] = true
+		ordered = append(ordered, job)
+	}
+
+	for _, job := range g.jobs {
+		place(job)
+	}
+
+	return ordered, nil
+}
+
+// The first dependency cycle found, e.g. `[a b a]`; nil when there is none
+func (g *JobGraph) Cycle() []string {
+	for _, job := range g.jobs {
+		path := []string{job.Name}
+		seen := map[string]bool{job.Name: true}
+
+		current := job
+		for current.Needs != "" {
+			path = append(path, current.Needs)
+			if current.Needs == job.Name {
+				return path
+			}
+			if seen[current.Needs] {
+				// A cycle that does not go through this job, it is reported
+				// when starting from one of its members
+				break
+			}
+			seen[current.Needs] = true
+
+			next, found := g.Job(current.Needs)
+			if !found {
+				break
+			}
+			current = next
+		}
+	}
+
+	return nil
+}
+
+// Jobs that need the given job, in workflow order
+func (g *JobGraph) Dependents(name string) []Job {
+	return lo.Filter(g.jobs, func(job Job, _ int) bool { return job.Needs == name })
+}
+
+const (
+	GraphFormatDot     = "dot"
+	GraphFormatMermaid = "mermaid"
+	GraphFormatAscii   = "ascii"
+)
+
+type RenderGraphArgs struct {
+	Workflow WorkflowConfig
+
+	// Optional; shows which servers each job runs on
+	Inventory *InventoryConfig
+
+	// `dot`, `mermaid` or `ascii`
+	Format string
+}
+
+// Draw the job dependency graph of a workflow
+func RenderGraph(w io.Writer, args RenderGraphArgs) error {
+	graph := NewJobGraph(args.Workflow.Jobs)
+
+	jobs, err := graph.Order()
+	if err != nil {
+		return err
+	}
+
+	hosts := func(job Job) []string {
+		if args.Inventory == nil {
+			return nil
+		}
+
+		servers := lo.Filter(args.Inventory.Servers, func(server Server, _ int) bool { return server.Matches(job.RunsOn) })
+
+		return lo.Map(servers, func(server Server, _ int) string { return server.Name })
+	}
+
+	switch args.Format {
+	case GraphFormatDot:
+		renderDot(w, args.Workflow.Name, jobs, hosts, args.Inventory)
+	case GraphFormatMermaid:
+		renderMermaid(w, jobs, hosts, args.Inventory)
+	case GraphFormatAscii:
+		renderAscii(w, graph, jobs, hosts, args.Inventory != nil)
+	default:
+		return fmt.Errorf("unknown graph format %s; available options are dot, mermaid and ascii", args.Format)
+	}
+
+	return nil
+}
+
+func renderDot(w io.Writer, name string, jobs []Job, hosts func(Job) []string, inventory *InventoryConfig) {
+	fmt.Fprintf(w, "digraph %s {\n", strconv.Quote(name))
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [shape=box];")
+
+	for _, job := range jobs {
+		fmt.Fprintf(w, "  %s [label=%s];\n", strconv.Quote(job.Name), strconv.Quote(fmt.Sprintf("%s\n%d step(s)", job.Name, len(job.Steps))))
+	}
+
+	for _, job := range jobs {
+		if job.Needs != "" {
+			fmt.Fprintf(w, "  %s -> %s;\n", strconv.Quote(job.Needs), strconv.Quote(job.Name))
+		}
+	}
+
+	if inventory != nil {
+		for _, server := range inventory.Servers {
+			fmt.Fprintf(w, "  %s [shape=ellipse, label=%s];\n", strconv.Quote("server:"+server.Name), strconv.Quote(server.Name))
+		}
+
+		for _, job := range jobs {
+			for _, host := range hosts(job) {
+				fmt.Fprintf(w, "  %s -> %s [style=dashed, arrowhead=none];\n", strconv.Quote(job.Name), strconv.Quote("server:"+host))
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "}")
+}
+
+func renderMermaid(w io.Writer, jobs []Job, hosts func(Job) []string, inventory *InventoryConfig) {
+	// Mermaid ids can't hold arbitrary names, labels can
+	label := func(s string) string {
+		return `"` + strings.ReplaceAll(s, `"`, "#quot;") + `"`
+	}
+	jobIds := map[string]string{}
+	for i, job := range jobs {
+		jobIds[job.Name] = fmt.Sprintf("job%d", i)
+	}
+
+	fmt.Fprintln(w, "flowchart LR")
+
+	for _, job := range jobs {
+		fmt.Fprintf(w, "  %s[%s]\n", jobIds[job.Name], label(fmt.Sprintf("%s (%d step(s))", job.Name, len(job.Steps))))
+	}
+
+	for _, job := range jobs {
+		if job.Needs != "" {
+			fmt.Fprintf(w, "  %s --> %s\n", jobIds[job.Needs], jobIds[job.Name])
+		}
+	}
+
+	if inventory != nil {
+		serverIds := map[string]string{}
+		for i, server := range inventory.Servers {
+			serverIds[server.Name] = fmt.Sprintf("server%d", i)
+			fmt.Fprintf(w, "  %s([%s])\n", serverIds[server.Name], label(server.Name))
+		}
+
+		for _, job := range jobs {
+			for _, host := range hosts(job) {
+				fmt.Fprintf(w, "  %s -.- %s\n", jobIds[job.Name], serverIds[host])
+			}
+		}
+	}
+}
+
+// A tree per job without dependencies
+//
+//	build
+//	├── test
+//	│   └── deploy [web-1, web-2]
+//	└── migrate [db-1]
+func renderAscii(w io.Writer, graph *JobGraph, jobs []Job, hosts func(Job) []string, withHosts bool) {
+	line := func(job Job) string {
+		if !withHosts {
+			return job.Name
+		}
+
+		servers := hosts(job)
+		if len(servers) == 0 {
+			return job.Name + " [no server]"
+		}
+
+		return fmt.Sprintf("%s [%s]", job.Name, strings.Join(servers, ", "))
+	}
+
+	var children func(name string, prefix string)
+	children = func(name string, prefix string) {
+		dependents := graph.Dependents(name)
+
+		for i, dependent := range dependents {
+			last := i == len(dependents)-1
+
+			fmt.Fprintf(w, "%s%s%s\n", prefix, lo.Ternary(last, "└── ", "├── "), line(dependent))
+			children(dependent.Name, prefix+lo.Ternary(last, "    ", "│   "))
+		}
+	}
+
+	for _, job := range jobs {
+		if job.Needs != "" {
+			continue
+		}
+
+		fmt.Fprintln(w, line(job))
+		children(job.Name, "")
+	}
+}
@@ -0,0 +1,50 @@
+package storm
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Whether the step has guards deciding if its work is already done
+func (s Step) guarded() bool {
+	return s.Creates != "" || s.Removes != "" || s.Unless != "" || s.OnlyIf != ""
+}
+
+// Why a step's guards skip it, or nothing when it runs. Paths are globs from
+// the step's directory; commands run like the step's, without their output.
+func (w *Workflow) guard(step Step, args ExecuteArgs) string {
+	exists := func(pattern string) bool {
+		pattern, err := expandHome(pattern)
+		if err != nil {
+			return false
+		}
+		if !filepath.IsAbs(pattern) && args.Directory != "" {
+			pattern = filepath.Join(args.Directory, pattern)
+		}
+
+		matches, _ := filepath.Glob(pattern)
+
+		return len(matches) > 0
+	}
+
+	succeeds := func(command string) bool {
+		args.Command = command
+		args.OutputCallback = func(string) {}
+		args.ErrorCallback = func(string) {}
+
+		return w.Execute(args) == nil
+	}
+
+	switch {
+	case step.Creates != "" && exists(step.Creates):
+		return fmt.Sprintf("%s exists", step.Creates)
+	case step.Removes != "" && !exists(step.Removes):
+		return fmt.Sprintf("%s does not exist", step.Removes)
+	case step.Unless != "" && succeeds(step.Unless):
+		return fmt.Sprintf("unless %q succeeded", step.Unless)
+	case step.OnlyIf != "" && !succeeds(step.OnlyIf):
+		return fmt.Sprintf("onlyif %q failed", step.OnlyIf)
+	}
+
+	return ""
+}
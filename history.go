@@ -0,0 +1,402 @@
+package storm
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusSkipped   = "skipped"
+)
+
+const (
+	RunModeLocal = "local"
+	RunModeAgent = "agent"
+)
+
+// Host name recorded for runs on the current machine
+const LocalHost = "local"
+
+type RunRecord struct {
+	Id         string       `json:"id"`
+	Workflow   string       `json:"workflow"`
+	Mode       string       `json:"mode"`
+	Status     string       `json:"status"`
+	Error      string       `json:"error,omitempty"`
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Hosts      []HostRecord `json:"hosts"`
+
+	// Id of the run this one resumed
+	ResumedFrom string `json:"resumed_from,omitempty"`
+
+	// Values of the workflow's `on.dispatch.inputs`
+	Inputs map[string]string `json:"inputs,omitempty"`
+}
+
+type HostRecord struct {
+	Name   string      `json:"name"`
+	Status string      `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Jobs   []JobRecord `json:"jobs"`
+}
+
+type JobRecord struct {
+	Name       string       `json:"name"`
+	Status     string       `json:"status"`
+	ExitCode   int          `json:"exit_code"`
+	Error      string       `json:"error,omitempty"`
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Steps      []StepRecord `json:"steps"`
+
+	// Run the job completed in, when it was skipped for resuming it; other
+	// skipped jobs did not complete, their conditions are checked again
+	ResumedFrom string `json:"resumed_from,omitempty"`
+}
+
+type StepRecord struct {
+	Name       string            `json:"name"`
+	Status     string            `json:"status"`
+	ExitCode   int               `json:"exit_code"`
+	Outputs    map[string]string `json:"outputs,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Changed    bool              `json:"changed,omitempty"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+}
+
+func (r *RunRecord) Host(name string) *HostRecord {
+	for i := range r.Hosts {
+		if r.Hosts[i].Name == name {
+			return &r.Hosts[i]
+		}
+	}
+
+	return nil
+}
+
+func (h *HostRecord) Job(name string) *JobRecord {
+	for i := range h.Jobs {
+		if h.Jobs[i].Name == name {
+			return &h.Jobs[i]
+		}
+	}
+
+	return nil
+}
+
+// Local store of past runs; one directory per run holding
+//
+//	run.json      => RunRecord
+//	events.jsonl  => every event of the run, in the event protocol
+//	workflow.yaml => the workflow as it was run
+type History struct {
+	dir string
+}
+
+// Default history location; `~/.storm/history`
+func DefaultHistoryDirectory() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Join(errors.New("cannot resolve home directory"), err)
+	}
+
+	return filepath.Join(home, ".storm", "history"), nil
+}
+
+type HistoryStartArgs struct {
+	Id          string
+	Mode        string
+	Workflow    WorkflowConfig
+	Inputs      map[string]string
+	ResumedFrom string
+}
+
+// Start recording a run; feed the recorder every event of the run and finish
+// it once the run is over
+func (h *History) Start(args HistoryStartArgs) (*RunRecorder, error) {
+	dir := filepath.Join(h.dir, args.Id)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, errors.Join(errors.New("cannot create run history directory"), err)
+	}
+
+	content, err := NewWorkflow().Dump(args.Workflow)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "workflow.yaml"), []byte(*content), 0600)
+	if err != nil {
+		return nil, errors.Join(errors.New("cannot save workflow to run history"), err)
+	}
+
+	events, err := os.OpenFile(filepath.Join(dir, "events.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Join(errors.New("cannot create run event log"), err)
+	}
+
+	recorder := &RunRecorder{
+		dir:    dir,
+		events: events,
+		record: RunRecord{
+			Id:        args.Id,
+			Workflow:  args.Workflow.Name,
+			Mode:      args.Mode,
+			Status:    StatusRunning,
+			StartedAt: time.Now().UTC(),
+			Hosts:     []HostRecord{},
+
+			ResumedFrom: args.ResumedFrom,
+			Inputs:      args.Inputs,
+		},
+	}
+
+	return recorder, recorder.save()
+}
+
+// List recorded runs, most recent first
+func (h *History) List() ([]RunRecord, error) {
+	entries, err := os.ReadDir(h.dir)
+	if os.IsNotExist(err) {
+		return []RunRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records := []RunRecord{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		record, err := h.Get(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		records = append(records, *record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].StartedAt.After(records[j].StartedAt)
+	})
+
+	return records, nil
+}
+
+func (h *History) Get(id string) (*RunRecord, error) {
+	content, err := os.ReadFile(filepath.Join(h.dir, id, "run.json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("run %s not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record := RunRecord{}
+	err = json.Unmarshal(content, &record)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("run %s is corrupted", id), err)
+	}
+
+	return &record, nil
+}
+
+// The workflow exactly as it was run
+func (h *History) Workflow(id string) (*WorkflowConfig, error) {
+	return NewWorkflow().Load(filepath.Join(h.dir, id, "workflow.yaml"))
+}
+
+// Replay the recorded events of a run
+func (h *History) Events(id string, handler func(Event)) error {
+	file, err := os.Open(filepath.Join(h.dir, id, "events.jsonl"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("run %s not found", id)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	for scanner.Scan() {
+		event, err := UnmarshalEvent(scanner.Bytes())
+		if err != nil {
+			continue
+		}
+
+		handler(event)
+	}
+
+	return scanner.Err()
+}
+
+func NewHistory(dir string) *History {
+	return &History{dir: dir}
+}
+
+// Keeps a run's record up to date from its events
+type RunRecorder struct {
+	mu     sync.Mutex
+	dir    string
+	events *os.File
+	record RunRecord
+}
+
+func (r *RunRecorder) Id() string {
+	return r.record.Id
+}
+
+func (r *RunRecorder) Handle(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	line, err := MarshalEvent(event)
+	if err == nil {
+		r.events.Write(append(line, '\n'))
+	}
+
+	meta := event.Meta()
+	host := r.host(meta.Host)
+
+	switch e := event.(type) {
+	case *JobStarted:
+		host.Jobs = append(host.Jobs, JobRecord{
+			Name:      e.Job,
+			Status:    StatusRunning,
+			StartedAt: e.Time,
+			Steps:     []StepRecord{},
+		})
+	case *StepStarted:
+		if job := host.Job(e.Job); job != nil {
+			job.Steps = append(job.Steps, StepRecord{
+				Name:      e.Step,
+				Status:    StatusRunning,
+				StartedAt: e.Time,
+			})
+		}
+	case *StepFinished:
+		job := host.Job(e.Job)
+		if job == nil || len(job.Steps) == 0 {
+			break
+		}
+
+		step := &job.Steps[len(job.Steps)-1]
+		step.Status = lo.Ternary(e.Error == "", StatusSucceeded, StatusFailed)
+		step.ExitCode = e.ExitCode
+		step.Outputs = e.Outputs
+		step.Error = e.Error
+		step.Changed = e.Changed
+		step.FinishedAt = &e.Time
+	case *StepSkipped:
+		if job := host.Job(e.Job); job != nil {
+			job.Steps = append(job.Steps, StepRecord{
+				Name:       e.Step,
+				Status:     StatusSkipped,
+				Outputs:    e.Outputs,
+				Error:      e.Reason,
+				StartedAt:  e.Time,
+				FinishedAt: &e.Time,
+			})
+		}
+	case *JobSkipped:
+		host.Jobs = append(host.Jobs, JobRecord{
+			Name:        e.Job,
+			Status:      StatusSkipped,
+			Error:       e.Reason,
+			StartedAt:   e.Time,
+			FinishedAt:  &e.Time,
+			Steps:       []StepRecord{},
+			ResumedFrom: e.ResumedFrom,
+		})
+		r.save()
+	case *JobFinished:
+		job := host.Job(e.Job)
+		if job == nil {
+			break
+		}
+
+		job.Status = lo.Ternary(e.Error == "", StatusSucceeded, StatusFailed)
+		job.ExitCode = e.ExitCode
+		job.Error = e.Error
+		job.FinishedAt = &e.Time
+		r.save()
+	case *RunFinished:
+		host.Status = lo.Ternary(e.Error == "", StatusSucceeded, StatusFailed)
+		host.Error = e.Error
+		r.save()
+	}
+}
+
+// Close the record with the run's final result
+func (r *RunRecorder) Finish(runErr error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	r.record.FinishedAt = &now
+	r.record.Status = StatusSucceeded
+
+	if runErr != nil {
+		r.record.Status = StatusFailed
+		r.record.Error = runErr.Error()
+	}
+
+	for i := range r.record.Hosts {
+		if r.record.Hosts[i].Status == StatusRunning {
+			r.record.Hosts[i].Status = StatusFailed
+		}
+	}
+
+	r.events.Close()
+
+	return r.save()
+}
+
+func (r *RunRecorder) host(name string) *HostRecord {
+	if name == "" {
+		name = LocalHost
+	}
+
+	host := r.record.Host(name)
+	if host == nil {
+		r.record.Hosts = append(r.record.Hosts, HostRecord{Name: name, Status: StatusRunning, Jobs: []JobRecord{}})
+		host = &r.record.Hosts[len(r.record.Hosts)-1]
+	}
+
+	return host
+}
+
+func (r *RunRecorder) save() error {
+	content, err := json.MarshalIndent(&r.record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a half written record
+	tmp := filepath.Join(r.dir, "run.json.tmp")
+	err = os.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return errors.Join(errors.New("cannot save run record"), err)
+	}
+
+	return os.Rename(tmp, filepath.Join(r.dir, "run.json"))
+}
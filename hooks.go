@@ -0,0 +1,375 @@
+package storm
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+const (
+	HookPostCommit  = "post-commit"
+	HookPrePush     = "pre-push"
+	HookPostReceive = "post-receive"
+)
+
+const DefaultWorkflowsDirectory = ".storm/workflows"
+
+// Marks the hooks storm installed, so they can be replaced safely
+const hookMarker = "# Installed by storm hooks install"
+
+// A null object id; the old side of a created ref, the new side of a deleted
+// one
+const zeroSha = "0000000000000000000000000000000000000000"
+
+type Hooks struct {
+	workflow  *Workflow
+	inventory *Inventory
+	agent     *Agent
+}
+
+type HooksInstallArgs struct {
+	// Defaults to the current directory
+	Repository string
+
+	// Directory of the workflows, relative to the repository root
+	Workflows string
+
+	// When set, workflows run on the inventory's servers instead of locally
+	Inventory string
+
+	// Defaults to post-receive for bare repositories, post-commit and
+	// pre-push otherwise
+	Hooks []string
+
+	// Replace hooks that were not installed by storm
+	Force bool
+}
+
+// Write git hooks running the workflows their commits or pushes trigger; returns
+// the hook files written
+func (h *Hooks) Install(args HooksInstallArgs) ([]string, error) {
+	repository := lo.Ternary(args.Repository != "", args.Repository, ".")
+	workflows := lo.Ternary(args.Workflows != "", args.Workflows, DefaultWorkflowsDirectory)
+
+	bare, err := git("-C", repository, "rev-parse", "--is-bare-repository")
+	if err != nil {
+		return nil, errors.Join(errors.New("not a git repository"), err)
+	}
+
+	hooks := args.Hooks
+	if len(hooks) == 0 {
+		hooks = lo.Ternary(bare == "true", []string{HookPostReceive}, []string{HookPostCommit, HookPrePush})
+	}
+
+	for _, hook := range hooks {
+		if !lo.Contains([]string{HookPostCommit, HookPrePush, HookPostReceive}, hook) {
+			return nil, fmt.Errorf("unsupported hook %s; available options are; %s, %s, %s", hook, HookPostCommit, HookPrePush, HookPostReceive)
+		}
+	}
+
+	hooksDirectory, err := git("-C", repository, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(hooksDirectory) {
+		hooksDirectory = filepath.Join(repository, hooksDirectory)
+	}
+
+	if err := os.MkdirAll(hooksDirectory, 0755); err != nil {
+		return nil, errors.Join(errors.New("could not create hooks directory"), err)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, errors.Join(errors.New("could not find the storm executable"), err)
+	}
+
+	command := fmt.Sprintf("%s hooks run --workflows=%s", ShellQuote(executable), ShellQuote(workflows))
+	if args.Inventory != "" {
+		// Hooks do not run from where they were installed
+		inventory, err := filepath.Abs(args.Inventory)
+		if err != nil {
+			return nil, err
+		}
+
+		command += fmt.Sprintf(" --inventory=%s", ShellQuote(inventory))
+	}
+
+	installed := []string{}
+
+	for _, hook := range hooks {
+		hookFile := filepath.Join(hooksDirectory, hook)
+
+		existing, err := os.ReadFile(hookFile)
+		if err == nil && !bytes.Contains(existing, []byte(hookMarker)) && !args.Force {
+			return installed, fmt.Errorf("%s hook already exists, use --force to replace it", hookFile)
+		}
+
+		content := fmt.Sprintf("#!/bin/sh\n%s\nexec %s %s \"$@\"\n", hookMarker, command, hook)
+		if err := os.WriteFile(hookFile, []byte(content), 0755); err != nil {
+			return installed, errors.Join(fmt.Errorf("could not write %s hook", hookFile), err)
+		}
+
+		installed = append(installed, hookFile)
+	}
+
+	return installed, nil
+}
+
+type HooksRunArgs struct {
+	Hook string
+
+	// Standard input git handed to the hook
+	Input io.Reader
+
+	// Directory of the workflows, relative to the repository root
+	Workflows string
+
+	// When set, workflows run on the inventory's servers instead of locally
+	Inventory string
+
+	Handlers []func(Event)
+	History  *History
+}
+
+// Run, from a git hook, the workflows triggered by the commit or the pushed
+// refs. Workflows, and the actions and files they use, are read from the
+// pushed commit, not the working tree; a bare repository has none.
+func (h *Hooks) Run(args HooksRunArgs) error {
+	workflows := lo.Ternary(args.Workflows != "", args.Workflows, DefaultWorkflowsDirectory)
+
+	triggers, err := h.triggers(args.Hook, args.Input)
+	if err != nil {
+		return err
+	}
+
+	var ic *InventoryConfig
+	if args.Inventory != "" {
+		ic, err = h.inventory.Load(args.Inventory)
+		if err != nil {
+			return err
+		}
+	}
+
+	errs := []error{}
+
+	for _, trigger := range triggers {
+		err := func() error {
+			checkout, err := checkoutCommit(trigger.Sha)
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(checkout)
+
+			configs, err := h.workflows(checkout, workflows)
+
+			for _, wc := range configs {
+				if !wc.TriggeredBy(trigger) {
+					continue
+				}
+
+				runErr := runTriggered(h.workflow, h.agent, triggeredRunArgs{
+					Config:    wc,
+					Trigger:   trigger,
+					Inventory: ic,
+					Handlers:  args.Handlers,
+					History:   args.History,
+				})
+				if runErr != nil {
+					err = errors.Join(err, fmt.Errorf("%s workflow failed for %s; %w", wc.Name, trigger.Ref, runErr))
+				}
+			}
+
+			return err
+		}()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// The push events a hook was called for; post-commit is a push of the
+// current branch, pre-push and post-receive read the updated refs from their
+// input. Deleted refs trigger nothing.
+func (h *Hooks) triggers(hook string, input io.Reader) ([]TriggerContext, error) {
+	repository, err := repositoryName()
+	if err != nil {
+		return nil, err
+	}
+
+	triggers := []TriggerContext{}
+
+	switch hook {
+	case HookPostCommit:
+		ref, err := git("symbolic-ref", "-q", "HEAD")
+		if err != nil {
+			// Commits on a detached HEAD are not pushes to any branch
+			return triggers, nil
+		}
+
+		sha, err := git("rev-parse", "HEAD")
+		if err != nil {
+			return nil, err
+		}
+
+		before, _ := git("rev-parse", "-q", "--verify", "HEAD~1")
+
+		triggers = append(triggers, TriggerContext{Ref: ref, Sha: sha, Before: lo.Ternary(before != "", before, zeroSha)})
+	case HookPrePush, HookPostReceive:
+		scanner := bufio.NewScanner(input)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != lo.Ternary(hook == HookPrePush, 4, 3) {
+				continue
+			}
+
+			trigger := TriggerContext{}
+			if hook == HookPrePush {
+				// <local ref> <local sha> <remote ref> <remote sha>
+				trigger.Sha, trigger.Ref, trigger.Before = fields[1], fields[2], fields[3]
+			} else {
+				// <old sha> <new sha> <ref>
+				trigger.Before, trigger.Sha, trigger.Ref = fields[0], fields[1], fields[2]
+			}
+
+			if trigger.Sha == zeroSha {
+				continue
+			}
+
+			triggers = append(triggers, trigger)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Join(errors.New("could not read hook input"), err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported hook %s", hook)
+	}
+
+	for i := range triggers {
+		triggers[i].Event = TriggerPush
+		triggers[i].Repository = repository
+		triggers[i].Actor, _ = git("log", "-1", "--format=%an", triggers[i].Sha)
+
+		if _, refType := triggers[i].RefName(); refType == RefTypeBranch {
+			triggers[i].ChangedPaths = changedPaths(triggers[i].Before, triggers[i].Sha)
+		}
+	}
+
+	return triggers, nil
+}
+
+// Export the files of a commit into a temporary directory, with `git
+// archive`; what a hook runs is taken from there
+func checkoutCommit(sha string) (string, error) {
+	dir, err := os.MkdirTemp("", "storm-hook-")
+	if err != nil {
+		return "", err
+	}
+
+	archive := filepath.Join(dir, ".storm-commit.tar.gz")
+	if _, err := git("archive", "--format=tar.gz", "-o", archive, sha); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	err = ExtractBundle(archive)
+	os.Remove(archive)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", errors.Join(fmt.Errorf("could not check out %s", sha), err)
+	}
+
+	return dir, nil
+}
+
+// Every workflow in the directory of a checked out commit; invalid ones are
+// reported and the others kept
+func (h *Hooks) workflows(checkout string, directory string) ([]WorkflowConfig, error) {
+	entries, err := os.ReadDir(filepath.Join(checkout, directory))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	configs := []WorkflowConfig{}
+	errs := []error{}
+
+	for _, entry := range entries {
+		if ext := filepath.Ext(entry.Name()); entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		// Files the workflow uses or includes resolve into the checkout
+		wc, err := h.workflow.Load(filepath.Join(checkout, directory, entry.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		configs = append(configs, *wc)
+	}
+
+	return configs, errors.Join(errs...)
+}
+
+// Files changed between two commits; when the old one is unknown, e.g. a new
+// branch, the files changed by the last commit
+func changedPaths(before string, sha string) []string {
+	out, err := git("diff", "--name-only", before, sha)
+	if before == zeroSha || err != nil {
+		out, err = git("diff-tree", "--no-commit-id", "--name-only", "-r", "--root", sha)
+		if err != nil {
+			return nil
+		}
+	}
+
+	return lo.Compact(strings.Split(out, "\n"))
+}
+
+// Name of the repository; its directory without the `.git` suffix
+func repositoryName() (string, error) {
+	gitDirectory, err := git("rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return "", errors.Join(errors.New("not a git repository"), err)
+	}
+
+	if filepath.Base(gitDirectory) == ".git" {
+		gitDirectory = filepath.Dir(gitDirectory)
+	}
+
+	return strings.TrimSuffix(filepath.Base(gitDirectory), ".git"), nil
+}
+
+func git(args ...string) (string, error) {
+	stderr := bytes.Buffer{}
+
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("git %s failed; %s", strings.Join(args, " "), strings.TrimSpace(stderr.String())), err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func NewHooks() *Hooks {
+	return &Hooks{
+		workflow:  NewWorkflow(),
+		inventory: NewInventory(),
+		agent:     NewAgent(),
+	}
+}
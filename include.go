@@ -0,0 +1,219 @@
+package storm
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// Resolves the `uses` of jobs and the `include` of steps into plain steps,
+// reading the files they refer to relative to the file referring to them;
+// the actions steps use are checked and stay as they are
+type includeResolver struct {
+	workflow *Workflow
+
+	// Files being resolved, outermost first; a file in here referred to again
+	// is a cycle
+	stack []string
+}
+
+// Replace the workflow's `uses` jobs and `include` steps with the steps they
+// refer to
+func (r *includeResolver) resolveWorkflow(file string, content []byte, wc *WorkflowConfig) Diagnostics {
+	root, diagnostics := parseYaml(file, content)
+	if len(diagnostics) > 0 {
+		return diagnostics
+	}
+
+	c := diagnosticCollector{file: file, root: root}
+
+	r.stack = append(r.stack, filepath.Clean(file))
+	defer func() { r.stack = r.stack[:len(r.stack)-1] }()
+
+	for i, job := range wc.Jobs {
+		jobPath := []string{"jobs", strconv.Itoa(i)}
+
+		handlers, handlersDiagnostics := r.resolveSteps(&c, file, job.Handlers, append(append([]string{}, jobPath...), "handlers"))
+		c.diagnostics = append(c.diagnostics, handlersDiagnostics...)
+
+		if job.Uses != "" {
+			steps, usedHandlers, usesDiagnostics := r.uses(&c, file, job, jobPath)
+			c.diagnostics = append(c.diagnostics, usesDiagnostics...)
+
+			wc.Jobs[i].Steps = steps
+			wc.Jobs[i].Handlers = append(usedHandlers, handlers...)
+			wc.Jobs[i].Uses = ""
+			wc.Jobs[i].With = nil
+
+			continue
+		}
+
+		steps, stepsDiagnostics := r.resolveSteps(&c, file, job.Steps, append(jobPath, "steps"))
+		c.diagnostics = append(c.diagnostics, stepsDiagnostics...)
+
+		wc.Jobs[i].Steps = steps
+		wc.Jobs[i].Handlers = handlers
+	}
+
+	// Included steps can refer to the inputs of the workflow running them
+	if len(r.stack) == 1 && len(c.diagnostics) == 0 {
+		declared := map[string]string{}
+		if wc.On.Dispatch != nil {
+			declared = lo.MapValues(wc.On.Dispatch.Inputs, func(_ DispatchInput, _ string) string { return "" })
+		}
+
+		for i, job := range wc.Jobs {
+			_, err := ExpressionContext{Inputs: declared, Facts: declaredFacts()}.interpolateWorkflow(WorkflowConfig{Jobs: []Job{job}})
+			if err != nil {
+				c.add([]string{"jobs", strconv.Itoa(i)}, "%s", err)
+			}
+		}
+	}
+
+	return c.result()
+}
+
+// Steps and handlers of the workflow a job uses, in the order its jobs run,
+// with the job's `with` inputs interpolated and its jobs' `if` on each of them
+func (r *includeResolver) uses(c *diagnosticCollector, file string, job Job, jobPath []string) ([]Step, []Step, Diagnostics) {
+	path := append(append([]string{}, jobPath...), "uses")
+
+	usedFile, content, ok := r.open(c, file, job.Uses, path)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	used, diagnostics := r.workflow.check(usedFile, content)
+	if len(diagnostics) > 0 {
+		return nil, nil, diagnostics
+	}
+
+	diagnostics = r.resolveWorkflow(usedFile, content, used)
+	if len(diagnostics) > 0 {
+		return nil, nil, diagnostics
+	}
+
+	inputs, err := ResolveInputs(*used, job.With)
+	if err != nil {
+		c.add(append(append([]string{}, jobPath...), "with"), "%s: %s", job.Uses, strings.ReplaceAll(err.Error(), "\n", "; "))
+		return nil, nil, nil
+	}
+
+	interpolated, err := ExpressionContext{Inputs: inputs, quoteInput: shellQuoteExpressions}.interpolateWorkflow(*used)
+	if err != nil {
+		c.add(path, "%s", err)
+		return nil, nil, nil
+	}
+
+	jobs, err := NewJobGraph(interpolated.Jobs).Order()
+	if err != nil {
+		c.add(path, "%s", err)
+		return nil, nil, nil
+	}
+
+	// The jobs' conditions move to their steps; the inputs they refer to are
+	// the used workflow's, they are bound before leaving it
+	steps := []Step{}
+	handlers := []Step{}
+	for _, usedJob := range jobs {
+		jobIf := bindConditionInputs(usedJob.If, inputs)
+
+		for _, step := range usedJob.Steps {
+			step.Directory = lo.Ternary(step.Directory != "", step.Directory, interpolated.Directory)
+			step.If = joinConditions(jobIf, bindConditionInputs(step.If, inputs))
+			steps = append(steps, step)
+		}
+
+		for _, handler := range usedJob.Handlers {
+			handler.Directory = lo.Ternary(handler.Directory != "", handler.Directory, interpolated.Directory)
+			handler.If = joinConditions(jobIf, bindConditionInputs(handler.If, inputs))
+			handlers = append(handlers, handler)
+		}
+	}
+
+	return steps, handlers, nil
+}
+
+// Steps with every `include` replaced by the steps of the included file, and
+// the actions and files they use checked
+func (r *includeResolver) resolveSteps(c *diagnosticCollector, file string, steps []Step, path []string) ([]Step, Diagnostics) {
+	resolved := []Step{}
+	diagnostics := Diagnostics{}
+
+	for i, step := range steps {
+		if step.Uses != "" {
+			step, actionDiagnostics := r.action(c, file, step, append(append([]string{}, path...), strconv.Itoa(i)))
+			diagnostics = append(diagnostics, actionDiagnostics...)
+			resolved = append(resolved, step)
+
+			continue
+		}
+
+		if step.Copy != nil || step.Template != nil {
+			resolved = append(resolved, r.file(c, file, step, append(append([]string{}, path...), strconv.Itoa(i))))
+			continue
+		}
+
+		if step.Module != "" {
+			r.module(c, step, append(append([]string{}, path...), strconv.Itoa(i)))
+		}
+
+		if step.Include == "" {
+			resolved = append(resolved, step)
+			continue
+		}
+
+		includePath := append(append([]string{}, path...), strconv.Itoa(i), "include")
+
+		includedFile, content, ok := r.open(c, file, step.Include, includePath)
+		if !ok {
+			continue
+		}
+
+		included := []Step{}
+		includedDiagnostics := checkYaml(includedFile, content, stepsSchema, &included, func(root *yaml.Node) Diagnostics { return nil })
+		if len(includedDiagnostics) > 0 {
+			diagnostics = append(diagnostics, includedDiagnostics...)
+			continue
+		}
+
+		root, _ := parseYaml(includedFile, content)
+		includedCollector := diagnosticCollector{file: includedFile, root: root}
+
+		r.stack = append(r.stack, includedFile)
+		included, includedDiagnostics = r.resolveSteps(&includedCollector, includedFile, included, []string{})
+		r.stack = r.stack[:len(r.stack)-1]
+
+		diagnostics = append(append(diagnostics, includedDiagnostics...), includedCollector.diagnostics...)
+		resolved = append(resolved, included...)
+	}
+
+	return resolved, diagnostics
+}
+
+// Read a file referred to from another one; reports missing files and cycles
+func (r *includeResolver) open(c *diagnosticCollector, from string, reference string, path []string) (string, []byte, bool) {
+	file := filepath.Clean(reference)
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(from), reference)
+	}
+
+	if lo.Contains(r.stack, file) {
+		cycle := append(append([]string{}, r.stack[lo.IndexOf(r.stack, file):]...), file)
+		c.add(path, "%s is included in itself; %s", reference, strings.Join(cycle, " -> "))
+
+		return "", nil, false
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		c.add(path, "cannot read %s; %s", reference, err)
+		return "", nil, false
+	}
+
+	return file, content, true
+}
@@ -0,0 +1,243 @@
+package storm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Write files into a temporary directory; names are relative to it
+func writeWorkflowFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+type stepSummary struct {
+	Name      string
+	Run       string
+	If        string
+	Directory string
+}
+
+func summarizeSteps(steps []Step) []stepSummary {
+	summaries := []stepSummary{}
+	for _, step := range steps {
+		summaries = append(summaries, stepSummary{Name: step.Name, Run: step.Run, If: step.If, Directory: step.Directory})
+	}
+
+	return summaries
+}
+
+func TestIncludeSteps(t *testing.T) {
+	dir := writeWorkflowFiles(t, map[string]string{
+		"workflow.yaml": `
+name: include
+jobs:
+  - name: setup
+    steps:
+      - name: before
+        run: echo before
+      - include: ./steps/install.yaml
+      - name: after
+        run: echo after
+`,
+		"steps/install.yaml": `
+- name: download
+  run: echo download
+- include: ../common/check.yaml
+`,
+		"common/check.yaml": `
+- name: check
+  run: echo check
+  if: facts.os == 'linux'
+`,
+	})
+
+	wc, err := NewWorkflow().Load(filepath.Join(dir, "workflow.yaml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []stepSummary{
+		{Name: "before", Run: "echo before"},
+		{Name: "download", Run: "echo download"},
+		{Name: "check", Run: "echo check", If: "facts.os == 'linux'"},
+		{Name: "after", Run: "echo after"},
+	}
+	if steps := summarizeSteps(wc.Jobs[0].Steps); !reflect.DeepEqual(steps, want) {
+		t.Errorf("got %+v, want %+v", steps, want)
+	}
+}
+
+func TestUsesWorkflow(t *testing.T) {
+	dir := writeWorkflowFiles(t, map[string]string{
+		"workflow.yaml": `
+name: caller
+on:
+  dispatch:
+    inputs:
+      root:
+        default: /srv
+jobs:
+  - name: build
+    steps:
+      - name: build
+        run: echo build
+  - name: deploy
+    needs: build
+    uses: ./deploy/common.yaml
+    with:
+      service: api
+      path: ${{ inputs.root }}/api
+`,
+		"deploy/common.yaml": `
+name: common
+directory: /opt
+on:
+  dispatch:
+    inputs:
+      service:
+        required: true
+      path:
+        required: true
+      restart:
+        type: boolean
+jobs:
+  - name: restart
+    needs: upload
+    if: inputs.restart
+    steps:
+      - name: Restart ${{ inputs.service }}
+        run: systemctl restart ${{ inputs.service }}
+        if: facts.init-system == 'systemd'
+    handlers:
+      - name: notify
+        run: echo restarted
+  - name: upload
+    steps:
+      - name: Upload ${{ inputs.service }}
+        run: cp build ${{ inputs.path }}
+        directory: /tmp
+`,
+	})
+
+	wc, err := NewWorkflow().Load(filepath.Join(dir, "workflow.yaml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deploy := wc.Jobs[1]
+	if deploy.Uses != "" || deploy.With != nil || deploy.Needs != "build" {
+		t.Errorf("got uses %q, with %v and needs %q; want the job flattened, needing build", deploy.Uses, deploy.With, deploy.Needs)
+	}
+
+	// The used jobs run in dependency order, with their inputs bound and
+	// their `if` on each of their steps
+	wantSteps := []stepSummary{
+		{Name: "Upload api", Run: "cp build ${{ inputs.root }}'/api'", Directory: "/tmp"},
+		{Name: "Restart api", Run: "systemctl restart 'api'", If: "('false') && (facts.init-system == 'systemd')", Directory: "/opt"},
+	}
+	if steps := summarizeSteps(deploy.Steps); !reflect.DeepEqual(steps, wantSteps) {
+		t.Errorf("got steps %+v, want %+v", steps, wantSteps)
+	}
+
+	wantHandlers := []stepSummary{{Name: "notify", Run: "echo restarted", If: "'false'", Directory: "/opt"}}
+	if handlers := summarizeSteps(deploy.Handlers); !reflect.DeepEqual(handlers, wantHandlers) {
+		t.Errorf("got handlers %+v, want %+v", handlers, wantHandlers)
+	}
+}
+
+func TestIncludeInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		message string
+	}{
+		{
+			name: "included in itself",
+			files: map[string]string{
+				"workflow.yaml": "name: w\njobs:\n  - name: j\n    steps:\n      - include: ./steps.yaml\n",
+				"steps.yaml":    "- name: s\n  run: echo s\n- include: ./steps.yaml\n",
+			},
+			message: "./steps.yaml is included in itself; ",
+		},
+		{
+			name: "included in each other",
+			files: map[string]string{
+				"workflow.yaml": "name: w\njobs:\n  - name: j\n    steps:\n      - include: ./a.yaml\n",
+				"a.yaml":        "- include: ./b.yaml\n",
+				"b.yaml":        "- include: ./a.yaml\n",
+			},
+			message: "./a.yaml is included in itself; ",
+		},
+		{
+			name: "workflow using itself",
+			files: map[string]string{
+				"workflow.yaml": "name: w\njobs:\n  - name: j\n    uses: ./workflow.yaml\n",
+			},
+			message: "./workflow.yaml is included in itself; ",
+		},
+		{
+			name: "workflows using each other",
+			files: map[string]string{
+				"workflow.yaml": "name: w\njobs:\n  - name: j\n    uses: ./used.yaml\n",
+				"used.yaml":     "name: used\njobs:\n  - name: k\n    uses: ./workflow.yaml\n",
+			},
+			message: "./workflow.yaml is included in itself; ",
+		},
+		{
+			name: "missing file",
+			files: map[string]string{
+				"workflow.yaml": "name: w\njobs:\n  - name: j\n    steps:\n      - include: ./missing.yaml\n",
+			},
+			message: "cannot read ./missing.yaml; ",
+		},
+		{
+			name: "unknown input",
+			files: map[string]string{
+				"workflow.yaml": "name: w\njobs:\n  - name: j\n    uses: ./used.yaml\n    with:\n      nope: x\n",
+				"used.yaml":     "name: used\njobs:\n  - name: k\n    steps:\n      - name: k\n        run: echo k\n",
+			},
+			message: "./used.yaml: invalid inputs; unknown input nope",
+		},
+		{
+			name: "missing required input",
+			files: map[string]string{
+				"workflow.yaml": "name: w\njobs:\n  - name: j\n    uses: ./used.yaml\n    with:\n      service: ''\n",
+				"used.yaml":     "name: used\non:\n  dispatch:\n    inputs:\n      service:\n        required: true\njobs:\n  - name: k\n    steps:\n      - name: k\n        run: echo k\n",
+			},
+			message: "./used.yaml: invalid inputs; input service is required",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeWorkflowFiles(t, test.files)
+
+			_, err := NewWorkflow().Load(filepath.Join(dir, "workflow.yaml"))
+
+			diagnostics := Diagnostics{}
+			if !errors.As(err, &diagnostics) {
+				t.Fatalf("got %v, want diagnostics", err)
+			}
+			if !strings.Contains(err.Error(), test.message) {
+				t.Errorf("got %q, want it to contain %q", err.Error(), test.message)
+			}
+		})
+	}
+}
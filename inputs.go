@@ -0,0 +1,158 @@
+package storm
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+const (
+	InputString  = "string"
+	InputNumber  = "number"
+	InputBoolean = "boolean"
+	InputChoice  = "choice"
+)
+
+var ErrInvalidInputs = errors.New("invalid inputs")
+
+// Characters that cannot be part of an environment variable name
+var envNameReplacer = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// Parse `name=value` inputs as given on the command line
+func ParseInputs(values []string) (map[string]string, error) {
+	inputs := map[string]string{}
+
+	for _, value := range values {
+		name, inputValue, found := strings.Cut(value, "=")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid input %q; expected name=value", value)
+		}
+
+		inputs[strings.TrimSpace(name)] = inputValue
+	}
+
+	return inputs, nil
+}
+
+// Check given inputs against the workflow's `on.dispatch.inputs` and fill in
+// defaults; every declared input has a value afterwards, `false` for booleans
+// and empty for the others when not given
+func ResolveInputs(wc WorkflowConfig, given map[string]string) (map[string]string, error) {
+	declared := map[string]DispatchInput{}
+	if wc.On.Dispatch != nil {
+		declared = wc.On.Dispatch.Inputs
+	}
+
+	return resolveInputs(declared, given)
+}
+
+// Check given inputs against declared ones and fill in defaults
+func resolveInputs(declared map[string]DispatchInput, given map[string]string) (map[string]string, error) {
+	errs := []error{}
+	resolved := map[string]string{}
+
+	for _, name := range lo.Keys(given) {
+		if _, found := declared[name]; !found {
+			errs = append(errs, fmt.Errorf("unknown input %s", name))
+		}
+	}
+
+	names := lo.Keys(declared)
+	sort.Strings(names)
+
+	for _, name := range names {
+		input := declared[name]
+
+		value, found := given[name]
+		if !found {
+			value = lo.Ternary(input.Default == "" && input.Type == InputBoolean, "false", input.Default)
+		}
+
+		// Given empty or not, a required input needs a value
+		if input.Required && value == "" {
+			errs = append(errs, fmt.Errorf("input %s is required", name))
+			continue
+		}
+
+		// Optional inputs without a value or default stay empty
+		if !found && value == "" {
+			resolved[name] = value
+			continue
+		}
+
+		value, err := input.check(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("input %s; %w", name, err))
+			continue
+		}
+
+		resolved[name] = value
+	}
+
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+		return nil, errors.Join(append([]error{ErrInvalidInputs}, errs...)...)
+	}
+
+	return resolved, nil
+}
+
+// Check a value against the input's type; booleans are normalised to `true`
+// and `false`
+func (d DispatchInput) check(value string) (string, error) {
+	switch d.Type {
+	case InputNumber:
+		if value == "" {
+			return value, nil
+		}
+
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "", fmt.Errorf("%q is not a number", value)
+		}
+	case InputBoolean:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a boolean; expected true or false", value)
+		}
+
+		return strconv.FormatBool(parsed), nil
+	case InputChoice:
+		if !lo.Contains(d.Options, value) {
+			return "", fmt.Errorf("%q is not one of %s", value, strings.Join(d.Options, ", "))
+		}
+	}
+
+	return value, nil
+}
+
+// `STORM_INPUT_<NAME>=value` variables of the inputs; names are upper cased
+// and characters other than letters, digits and `_` become `_`
+func InputsEnv(inputs map[string]string) []string {
+	names := lo.Keys(inputs)
+	sort.Strings(names)
+
+	return lo.Map(names, func(name string, _ int) string {
+		return fmt.Sprintf("STORM_INPUT_%s=%s", strings.ToUpper(envNameReplacer.ReplaceAllString(name, "_")), inputs[name])
+	})
+}
+
+// Resolve the inputs of a run and interpolate them, and the host's facts when
+// they are known, into the workflow
+func applyInputs(wc WorkflowConfig, given map[string]string, facts map[string]string) (WorkflowConfig, map[string]string, error) {
+	inputs, err := ResolveInputs(wc, given)
+	if err != nil {
+		return wc, nil, err
+	}
+
+	wc, err = ExpressionContext{Inputs: inputs, Facts: facts}.interpolateWorkflow(wc)
+	if err != nil {
+		return wc, nil, err
+	}
+
+	return wc, inputs, nil
+}
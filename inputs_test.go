@@ -0,0 +1,197 @@
+package storm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseInputs(t *testing.T) {
+	tests := []struct {
+		values []string
+		inputs map[string]string
+		valid  bool
+	}{
+		{nil, map[string]string{}, true},
+		{[]string{"env=prod", " version =1.2=3"}, map[string]string{"env": "prod", "version": "1.2=3"}, true},
+		{[]string{"env="}, map[string]string{"env": ""}, true},
+		{[]string{"env=dev", "env=prod"}, map[string]string{"env": "prod"}, true},
+		{[]string{"env"}, nil, false},
+		{[]string{"=prod"}, nil, false},
+	}
+
+	for _, test := range tests {
+		inputs, err := ParseInputs(test.values)
+		if test.valid != (err == nil) {
+			t.Errorf("ParseInputs(%q): got error %v, want valid %v", test.values, err, test.valid)
+			continue
+		}
+
+		if test.valid && !reflect.DeepEqual(inputs, test.inputs) {
+			t.Errorf("ParseInputs(%q): got %v, want %v", test.values, inputs, test.inputs)
+		}
+	}
+}
+
+func TestResolveInputs(t *testing.T) {
+	declared := map[string]DispatchInput{
+		"version":  {Type: InputString, Required: true},
+		"env":      {Type: InputChoice, Options: []string{"staging", "production"}, Default: "staging"},
+		"target":   {Type: InputChoice, Options: []string{"a", "b"}},
+		"replicas": {Type: InputNumber},
+		"dry-run":  {Type: InputBoolean},
+		"notify":   {Type: InputBoolean, Default: "T"},
+	}
+
+	tests := []struct {
+		name     string
+		declared map[string]DispatchInput
+		given    map[string]string
+		resolved map[string]string
+	}{
+		{
+			name:     "defaults",
+			declared: declared,
+			given:    map[string]string{"version": "1.4.2"},
+			resolved: map[string]string{"version": "1.4.2", "env": "staging", "target": "", "replicas": "", "dry-run": "false", "notify": "true"},
+		},
+		{
+			name:     "given values",
+			declared: declared,
+			given:    map[string]string{"version": "1.4.2", "env": "production", "target": "b", "replicas": "2.5", "dry-run": "1", "notify": "False"},
+			resolved: map[string]string{"version": "1.4.2", "env": "production", "target": "b", "replicas": "2.5", "dry-run": "true", "notify": "false"},
+		},
+		{
+			name:     "empty optional number",
+			declared: declared,
+			given:    map[string]string{"version": "1.4.2", "replicas": ""},
+			resolved: map[string]string{"version": "1.4.2", "env": "staging", "target": "", "replicas": "", "dry-run": "false", "notify": "true"},
+		},
+		{
+			name:     "required with default",
+			declared: map[string]DispatchInput{"env": {Required: true, Default: "staging"}},
+			given:    map[string]string{},
+			resolved: map[string]string{"env": "staging"},
+		},
+		{
+			name:     "empty choice among the options",
+			declared: map[string]DispatchInput{"suffix": {Type: InputChoice, Options: []string{"", "-rc"}}},
+			given:    map[string]string{"suffix": ""},
+			resolved: map[string]string{"suffix": ""},
+		},
+		{
+			name:     "nothing declared",
+			declared: map[string]DispatchInput{},
+			given:    map[string]string{},
+			resolved: map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolved, err := resolveInputs(test.declared, test.given)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(resolved, test.resolved) {
+				t.Errorf("got %v, want %v", resolved, test.resolved)
+			}
+		})
+	}
+}
+
+func TestResolveInputsInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		declared map[string]DispatchInput
+		given    map[string]string
+		message  string
+	}{
+		{
+			name:     "missing required",
+			declared: map[string]DispatchInput{"version": {Required: true}},
+			given:    map[string]string{},
+			message:  "invalid inputs\ninput version is required",
+		},
+		{
+			name:     "empty required",
+			declared: map[string]DispatchInput{"version": {Required: true}},
+			given:    map[string]string{"version": ""},
+			message:  "invalid inputs\ninput version is required",
+		},
+		{
+			name:     "empty required choice",
+			declared: map[string]DispatchInput{"env": {Type: InputChoice, Options: []string{"a", "b"}, Required: true}},
+			given:    map[string]string{"env": ""},
+			message:  "invalid inputs\ninput env is required",
+		},
+		{
+			name:     "empty choice",
+			declared: map[string]DispatchInput{"env": {Type: InputChoice, Options: []string{"a", "b"}}},
+			given:    map[string]string{"env": ""},
+			message:  `invalid inputs` + "\n" + `input env; "" is not one of a, b`,
+		},
+		{
+			name:     "unknown choice",
+			declared: map[string]DispatchInput{"env": {Type: InputChoice, Options: []string{"a", "b"}}},
+			given:    map[string]string{"env": "c"},
+			message:  `invalid inputs` + "\n" + `input env; "c" is not one of a, b`,
+		},
+		{
+			name:     "not a number",
+			declared: map[string]DispatchInput{"replicas": {Type: InputNumber}},
+			given:    map[string]string{"replicas": "two"},
+			message:  `invalid inputs` + "\n" + `input replicas; "two" is not a number`,
+		},
+		{
+			name:     "not a boolean",
+			declared: map[string]DispatchInput{"dry-run": {Type: InputBoolean}},
+			given:    map[string]string{"dry-run": "maybe"},
+			message:  `invalid inputs` + "\n" + `input dry-run; "maybe" is not a boolean; expected true or false`,
+		},
+		{
+			name:     "unknown input",
+			declared: map[string]DispatchInput{},
+			given:    map[string]string{"env": "prod"},
+			message:  "invalid inputs\nunknown input env",
+		},
+		{
+			name:     "every error, sorted",
+			declared: map[string]DispatchInput{"b": {Required: true}, "a": {Type: InputNumber}},
+			given:    map[string]string{"a": "x", "c": "1"},
+			message:  `invalid inputs` + "\n" + `input a; "x" is not a number` + "\n" + `input b is required` + "\n" + `unknown input c`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolved, err := resolveInputs(test.declared, test.given)
+			if !errors.Is(err, ErrInvalidInputs) {
+				t.Fatalf("got %v, want %v", err, ErrInvalidInputs)
+			}
+			if resolved != nil {
+				t.Errorf("got %v, want no inputs", resolved)
+			}
+
+			if err.Error() != test.message {
+				t.Errorf("got %q, want %q", err.Error(), test.message)
+			}
+		})
+	}
+}
+
+func TestInputsEnv(t *testing.T) {
+	env := InputsEnv(map[string]string{"version": "1.4.2", "dry-run": "true", "target.env": "a b", "empty": ""})
+
+	want := []string{
+		"STORM_INPUT_DRY_RUN=true",
+		"STORM_INPUT_EMPTY=",
+		"STORM_INPUT_TARGET_ENV=a b",
+		"STORM_INPUT_VERSION=1.4.2",
+	}
+
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("got %q, want %q", env, want)
+	}
+}
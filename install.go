@@ -0,0 +1,378 @@
+package storm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// Where goreleaser puts its archives and builds; what `prod` installations
+// take storm from by default
+const DefaultReleaseDirectory = "./dist"
+
+// Where storm is installed on servers, relative to the remote user's home
+const agentBinary = ".storm/bin/storm"
+
+// What a storm binary is built for; GOOS and GOARCH names, and GOARM for arm
+type Platform struct {
+	OS   string
+	Arch string
+	Arm  string
+}
+
+func (p Platform) String() string {
+	return fmt.Sprintf("%s/%s", p.OS, p.Arch) + lo.Ternary(p.Arm != "", "v"+p.Arm, "")
+}
+
+// ARM versions of `uname -m` names; hard-float boards run v7
+var unameArms = map[string]string{
+	"armv5l": "5",
+	"armv6l": "6",
+	"armv7l": "7",
+	"armhf":  "7",
+}
+
+// Platform of a server, from `uname -s` and `uname -m`
+func (a *Agent) detectPlatform(client *ssh.Client) (Platform, error) {
+	output, _, err := a.ssh.ExecuteCommand(ExecuteCommandArgs{
+		Client:         client,
+		Command:        "uname -s && uname -m",
+		OutputCallback: func(string) {},
+		ErrorCallback:  func(string) {},
+	})
+	fields := strings.Fields(output)
+	if err != nil || len(fields) != 2 {
+		return Platform{}, errors.Join(errors.New("could not detect the platform of the server; storm agents run on linux and darwin"), err)
+	}
+
+	platform := Platform{OS: strings.ToLower(fields[0]), Arch: normalizeArch(fields[1]), Arm: unameArms[fields[1]]}
+	if !lo.Contains([]string{"linux", "darwin"}, platform.OS) {
+		return platform, fmt.Errorf("unsupported platform %s; storm agents run on linux and darwin", platform)
+	}
+
+	return platform, nil
+}
+
+// Provides a storm binary for a platform, in a directory it can write to
+type binarySource func(platform Platform, dir string) (string, error)
+
+// Build storm from the source in the current directory, for another platform
+func buildBinary(platform Platform, dir string) (string, error) {
+	binary := filepath.Join(dir, "storm")
+
+	command := exec.Command("go", "build", "-trimpath", "-o", binary, "./cmd")
+	command.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS="+platform.OS, "GOARCH="+platform.Arch)
+	if platform.Arm != "" {
+		command.Env = append(command.Env, "GOARM="+platform.Arm)
+	}
+
+	output, err := command.CombinedOutput()
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("could not build storm for %s; %s", platform, strings.TrimSpace(string(output))), err)
+	}
+
+	return binary, nil
+}
+
+// Name goreleaser gives a platform's archive; the OS and arch as `uname`
+// prints them
+func releaseArchive(platform Platform) string {
+	arch := platform.Arch
+	switch arch {
+	case "amd64":
+		arch = "x86_64"
+	case "386":
+		arch = "i386"
+	}
+
+	return fmt.Sprintf("storm_%s%s_%s%s.tar.gz", strings.ToUpper(platform.OS[:1]), platform.OS[1:], arch, lo.Ternary(platform.Arm != "", "v"+platform.Arm, ""))
+}
+
+// Take storm from a release directory; goreleaser's `dist`, or a directory
+// the assets of a release were downloaded to. Archives are checked against
+// the checksums file next to them; without a matching archive or build,
+// servers of the controller's own platform get the running binary.
+func releaseBinary(releaseDirectory string) binarySource {
+	return func(platform Platform, dir string) (string, error) {
+		archive := filepath.Join(releaseDirectory, releaseArchive(platform))
+		if _, err := os.Stat(archive); err == nil {
+			if err := verifyReleaseChecksum(releaseDirectory, archive); err != nil {
+				return "", err
+			}
+
+			return extractBinary(archive, dir)
+		}
+
+		// Builds are in `storm_<os>_<arch>_<version>` directories, e.g.
+		// storm_linux_amd64_v1 or storm_linux_arm_7
+		patterns := lo.Ternary(
+			platform.Arm != "",
+			[]string{fmt.Sprintf("storm_%s_arm_%s", platform.OS, platform.Arm)},
+			[]string{fmt.Sprintf("storm_%s_%s", platform.OS, platform.Arch), fmt.Sprintf("storm_%s_%s_*", platform.OS, platform.Arch)},
+		)
+		for _, pattern := range patterns {
+			builds, _ := filepath.Glob(filepath.Join(releaseDirectory, pattern, "storm"))
+			if len(builds) > 0 {
+				return builds[0], nil
+			}
+		}
+
+		if platform.OS == runtime.GOOS && platform.Arch == runtime.GOARCH && platform.Arm == "" {
+			return os.Executable()
+		}
+
+		return "", fmt.Errorf("no storm release for %s in %s; expected %s, or a build of it", platform, releaseDirectory, releaseArchive(platform))
+	}
+}
+
+// Check an archive against the `*checksums.txt` file of its release; an
+// archive the file does not list is refused
+func verifyReleaseChecksum(releaseDirectory string, archive string) error {
+	checksumFiles, _ := filepath.Glob(filepath.Join(releaseDirectory, "*checksums.txt"))
+	if len(checksumFiles) == 0 {
+		return fmt.Errorf("no checksums file in %s to verify %s with", releaseDirectory, filepath.Base(archive))
+	}
+
+	content, err := os.ReadFile(checksumFiles[0])
+	if err != nil {
+		return err
+	}
+
+	// `<sha256>  <file>` lines, as sha256sum prints them
+	expected := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == filepath.Base(archive) {
+			expected = fields[0]
+		}
+	}
+	if expected == "" {
+		return fmt.Errorf("%s is not listed in %s", filepath.Base(archive), checksumFiles[0])
+	}
+
+	actual, err := fileChecksum(archive, -1)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("checksum of %s does not match %s; expected %s, got %s", filepath.Base(archive), checksumFiles[0], expected, actual)
+	}
+
+	return nil
+}
+
+// Extract the storm binary of a release archive
+func extractBinary(archive string, dir string) (string, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("cannot read %s", archive), err)
+	}
+
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("no storm binary in %s", archive)
+		}
+		if err != nil {
+			return "", errors.Join(fmt.Errorf("cannot read %s", archive), err)
+		}
+
+		if header.Typeflag != tar.TypeReg || path.Base(header.Name) != "storm" {
+			continue
+		}
+
+		binary := filepath.Join(dir, "storm")
+		out, err := os.OpenFile(binary, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+		if err != nil {
+			return "", err
+		}
+		defer out.Close()
+
+		if _, err := io.Copy(out, reader); err != nil {
+			return "", err
+		}
+
+		return binary, nil
+	}
+}
+
+// Binaries of a source, by platform; each is only built or extracted once
+type binaryCache struct {
+	source   binarySource
+	dir      string
+	binaries map[Platform]string
+}
+
+func newBinaryCache(source binarySource) (*binaryCache, error) {
+	dir, err := os.MkdirTemp("", "storm-install-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &binaryCache{source: source, dir: dir, binaries: map[Platform]string{}}, nil
+}
+
+func (c *binaryCache) binary(platform Platform) (string, error) {
+	if binary, found := c.binaries[platform]; found {
+		return binary, nil
+	}
+
+	platformDir := filepath.Join(c.dir, strings.ReplaceAll(platform.String(), "/", "-"))
+	if err := os.MkdirAll(platformDir, 0755); err != nil {
+		return "", err
+	}
+
+	binary, err := c.source(platform, platformDir)
+	if err != nil {
+		return "", err
+	}
+	c.binaries[platform] = binary
+
+	return binary, nil
+}
+
+// Remove the binaries that were built or extracted
+func (c *binaryCache) Close() error {
+	return os.RemoveAll(c.dir)
+}
+
+// Install storm on every server of the inventory, with a binary for the
+// server's platform; servers that fail are reported, the others are still
+// installed
+func (a *Agent) install(ic InventoryConfig, source binarySource) error {
+	binaries, err := newBinaryCache(source)
+	if err != nil {
+		return err
+	}
+	defer binaries.Close()
+
+	errs := []error{}
+	for _, server := range ic.Servers {
+		fmt.Printf("Server: [%s]\n", server.Name)
+
+		err := func() error {
+			client, err := a.connect(server)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+
+			platform, err := a.detectPlatform(client)
+			if err != nil {
+				return err
+			}
+
+			binary, err := binaries.binary(platform)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Installing storm for %s on server ... ", platform)
+
+			return a.installBinary(client, binary)
+		}()
+		if err != nil {
+			fmt.Println("failed")
+			errs = append(errs, fmt.Errorf("%s: %w", server.Name, err))
+
+			continue
+		}
+
+		fmt.Println("Storm is Ready!")
+	}
+
+	return errors.Join(errs...)
+}
+
+// Connect to a server of the inventory
+func (a *Agent) connect(server Server) (*ssh.Client, error) {
+	client, err := a.ssh.Authenticate(AuthenticateArgs{
+		Host:          server.Host,
+		Port:          server.Port,
+		User:          server.User,
+		Password:      server.SshPassword,
+		PrivateSshKey: server.PrivateSshKey,
+	})
+	if err != nil {
+		return nil, errors.Join(err, errors.New("authentication failed"))
+	}
+
+	return client, nil
+}
+
+// Run a command on a server and return its output; what it printed to stderr
+// is part of the error when it fails
+func (a *Agent) remoteCommand(client *ssh.Client, command string) (string, error) {
+	errorLines := []string{}
+	output, _, err := a.ssh.ExecuteCommand(ExecuteCommandArgs{
+		Client:         client,
+		Command:        command,
+		OutputCallback: func(string) {},
+		ErrorCallback:  func(line string) { errorLines = append(errorLines, line) },
+	})
+	if err != nil && len(errorLines) > 0 {
+		err = errors.Join(errors.New(strings.Join(errorLines, "\n")), err)
+	}
+
+	return strings.TrimSpace(output), err
+}
+
+// Upload a binary next to `~/.storm/bin/storm`, check it arrived intact and
+// runs, then move it in place; a failed upload leaves the installed binary as
+// it was
+func (a *Agent) installBinary(client *ssh.Client, binary string) error {
+	checksum, err := fileChecksum(binary, -1)
+	if err != nil {
+		return err
+	}
+
+	home, err := a.ssh.HomeDirectory(client)
+	if err != nil {
+		return err
+	}
+
+	destination := path.Join(home, agentBinary)
+	upload := path.Join(path.Dir(destination), fmt.Sprintf(".storm-%d", time.Now().UnixNano()))
+
+	if err := a.ssh.CopyTo(client, binary, upload); err != nil {
+		return errors.Join(errors.New("ssh can't copy file"), err)
+	}
+
+	remove := func() { _, _ = a.remoteCommand(client, "rm -f "+ShellQuote(upload)) }
+
+	remoteChecksum, err := a.remoteCommand(client, fmt.Sprintf("(sha256sum %[1]s 2>/dev/null || shasum -a 256 %[1]s) | cut -d ' ' -f 1", ShellQuote(upload)))
+	if err != nil || remoteChecksum == "" {
+		remove()
+		return errors.Join(errors.New("cannot compute the checksum of the upload; the server needs sha256sum or shasum"), err)
+	}
+	if remoteChecksum != checksum {
+		remove()
+		return fmt.Errorf("checksum of the upload does not match; expected %s, got %s", checksum, remoteChecksum)
+	}
+
+	if _, err := a.remoteCommand(client, fmt.Sprintf("chmod 755 %[1]s && %[1]s version >/dev/null && mv -f %[1]s %[2]s", ShellQuote(upload), ShellQuote(destination))); err != nil {
+		remove()
+		return errors.Join(errors.New("the uploaded binary does not run on the server"), err)
+	}
+
+	return nil
+}
@@ -3,27 +3,67 @@ package storm
 import (
 	"os"
 
-	"gopkg.in/yaml.v3"
+	"github.com/samber/lo"
 )
 
 type Inventory struct{}
 
+// Load an inventory file; every problem found in it is reported as `Diagnostics`
 func (c *Inventory) Load(file string) (*InventoryConfig, error) {
 	fileContent, err := os.ReadFile(file)
 	if err != nil {
-		return nil, err
+		return nil, Diagnostics{{File: file, Message: err.Error()}}
 	}
 
-	// Unmarshal the file content into the InventoryConfig struct
-	config := &InventoryConfig{}
-	err = yaml.Unmarshal(fileContent, &config)
-	if err != nil {
-		return nil, err
+	return c.Parse(file, fileContent)
+}
+
+// Parse inventory content; `file` is only used to report diagnostics
+func (c *Inventory) Parse(file string, content []byte) (*InventoryConfig, error) {
+	config, diagnostics := c.check(file, content)
+	if len(diagnostics) > 0 {
+		return nil, diagnostics
 	}
 
 	return config, nil
 }
 
+// Jobs with this `runs-on`, or none, run on every server
+const RunsOnAny = "self-hosted"
+
+// Whether a selector, such as a job's `runs-on`, picks the server; selectors
+// match the server's name or one of its labels
+func (s Server) Matches(selector string) bool {
+	if selector == "" || selector == RunsOnAny {
+		return true
+	}
+
+	return s.Name == selector || lo.Contains(s.Labels, selector)
+}
+
+// Servers matched by any of the selectors; every server when there is none
+func (ic InventoryConfig) Select(selectors ...string) []Server {
+	if len(selectors) == 0 {
+		return ic.Servers
+	}
+
+	return lo.Filter(ic.Servers, func(server Server, _ int) bool {
+		return lo.ContainsBy(selectors, server.Matches)
+	})
+}
+
+// Template variables of a server; the inventory's, overridden by those of the
+// groups of its labels in order, overridden by its own
+func (ic InventoryConfig) ServerVars(server Server) map[string]any {
+	vars := lo.Assign(ic.Vars)
+
+	for _, label := range server.Labels {
+		vars = lo.Assign(vars, ic.Groups[label].Vars)
+	}
+
+	return lo.Assign(vars, server.Vars)
+}
+
 func NewInventory() *Inventory {
 	return &Inventory{}
 }
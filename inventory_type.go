@@ -6,23 +6,45 @@ import (
 )
 
 type InventoryConfig struct {
-	Servers []Server `yaml:"servers"`
+	Servers []Server `yaml:"servers" description:"List of server configurations." schema:"required,minItems=1"`
+
+	// Template variables; a server's are these, those of the groups of its
+	// labels, then its own, the later overriding the earlier
+	Vars   map[string]any            `yaml:"vars,omitempty" description:"Variables of every server, available to templates as .Vars."`
+	Groups map[string]InventoryGroup `yaml:"groups,omitempty" description:"Variables of the servers with a label, keyed by the label."`
+}
+
+type InventoryGroup struct {
+	Vars map[string]any `yaml:"vars,omitempty" description:"Variables of the servers with the group's label, available to templates as .Vars."`
 }
 
 type Server struct {
-	Name string `yaml:"name"`
+	Name string `yaml:"name" description:"A unique name for the server." schema:"required,minLength=1"`
 
 	// IP Address or Domain
-	Host string `yaml:"host"`
+	Host string `yaml:"host" description:"The hostname or IP address of the server." schema:"required,minLength=1"`
 
 	// SSH Port, defaults to 22
-	Port         int    `yaml:"port,omitempty"`
-	User         string `yaml:"user"`
-	SudoPassword string `yaml:"sudo-pass"`
-	SshPassword  string `yaml:"ssh-pass"`
+	Port         int    `yaml:"port,omitempty" description:"The SSH port for the server." schema:"default=22,minimum=1,maximum=65535"`
+	User         string `yaml:"user" description:"The username to use for SSH." schema:"required,minLength=1"`
+	SudoPassword string `yaml:"sudo-pass" description:"The sudo password for the user."`
+	SshPassword  string `yaml:"ssh-pass" description:"The SSH password for the user."`
 
 	// File path to the SSH private key
-	PrivateSshKey string `yaml:"private-ssh-key"`
+	PrivateSshKey string `yaml:"private-ssh-key" description:"Path to the private SSH key file. This takes priority over password authentication."`
+
+	// Jobs select servers by name or label with `runs-on`
+	Labels []string `yaml:"labels,omitempty" description:"Labels jobs can select the server by with runs-on."`
+
+	Vars map[string]any `yaml:"vars,omitempty" description:"Variables of the server, available to templates as .Vars; override those of the inventory and its groups."`
+}
+
+// Either password or key authentication is required
+func (s *Server) extendSchema(schema *orderedObject) {
+	schema.Set("anyOf", []map[string][]string{
+		{"required": {"ssh-pass"}},
+		{"required": {"private-ssh-key"}},
+	})
 }
 
 // Custom UnmarshalYAML to read the private SSH key file
@@ -39,21 +61,13 @@ func (s *Server) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if raw.PrivateSshKey != "" {
 		// Check if the file exists
 		if _, err := os.Stat(raw.PrivateSshKey); os.IsNotExist(err) {
-			err = fmt.Errorf("SSH private key file %s does not exist", raw.PrivateSshKey)
-
-			fmt.Println(err)
-
-			return err
+			return fmt.Errorf("SSH private key file %s does not exist", raw.PrivateSshKey)
 		}
 
 		// Now read the private SSH key file content
 		keyContent, err := os.ReadFile(raw.PrivateSshKey)
 		if err != nil {
-			err = fmt.Errorf("failed to read SSH private key file %s: %w", raw.PrivateSshKey, err)
-
-			fmt.Println(err)
-
-			return err
+			return fmt.Errorf("failed to read SSH private key file %s: %w", raw.PrivateSshKey, err)
 		}
 
 		raw.PrivateSshKey = string(keyContent)
@@ -0,0 +1,261 @@
+package storm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// A built-in module; what a `module` step runs with its `with` parameters
+type moduleSpec struct {
+	// Parameters the module takes; the first ones up to `required` are
+	// required
+	params   []string
+	required int
+
+	// Values `state` accepts, the first one is the default
+	states []string
+
+	// Bring the system to the state the parameters describe; reports whether
+	// anything changed, or would have in check mode
+	run func(m *moduleContext) (bool, error)
+}
+
+var modules = map[string]moduleSpec{
+	"package": {
+		params:   []string{"name", "state", "manager", "update-cache"},
+		required: 1,
+		states:   []string{"present", "absent"},
+		run:      packageModule,
+	},
+	"service": {
+		params:   []string{"name", "state", "enabled", "daemon-reload"},
+		required: 1,
+		states:   []string{"", "started", "stopped", "restarted", "reloaded"},
+		run:      serviceModule,
+	},
+	"user": {
+		params:   []string{"name", "state", "uid", "group", "groups", "shell", "home", "system", "remove"},
+		required: 1,
+		states:   []string{"present", "absent"},
+		run:      userModule,
+	},
+	"group": {
+		params:   []string{"name", "state", "gid", "system"},
+		required: 1,
+		states:   []string{"present", "absent"},
+		run:      groupModule,
+	},
+	"file": {
+		params:   []string{"path", "state", "mode", "owner", "src", "force"},
+		required: 1,
+		states:   []string{"file", "directory", "link", "absent", "touch"},
+		run:      fileModule,
+	},
+	"lineinfile": {
+		params:   []string{"path", "line", "regexp", "state", "create", "mode", "owner"},
+		required: 1,
+		states:   []string{"present", "absent"},
+		run:      lineInFileModule,
+	},
+}
+
+// Names of the built-in modules, sorted
+func moduleNames() []string {
+	names := lo.Keys(modules)
+	sort.Strings(names)
+
+	return names
+}
+
+// Check the module a step runs and its parameters; values with expressions
+// are only known when the step runs, they are checked then
+func (r *includeResolver) module(c *diagnosticCollector, step Step, path []string) {
+	spec, found := modules[step.Module]
+	if !found {
+		c.add(append(append([]string{}, path...), "module"), "unknown module %q; available modules are %s", step.Module, strings.Join(moduleNames(), ", "))
+		return
+	}
+
+	withPath := append(append([]string{}, path...), "with")
+
+	for _, param := range spec.params[:spec.required] {
+		if step.With[param] == "" {
+			c.add(withPath, "%s module needs %s", step.Module, param)
+		}
+	}
+
+	for param, value := range step.With {
+		if !lo.Contains(spec.params, param) {
+			c.add(append(withPath, param), "%s module has no %s parameter; it takes %s", step.Module, param, strings.Join(spec.params, ", "))
+			continue
+		}
+
+		if expressionPattern.MatchString(value) {
+			continue
+		}
+
+		if err := spec.check(param, value); err != nil {
+			c.add(append(withPath, param), "%s", err)
+		}
+	}
+}
+
+// Check a parameter's value; states, booleans, ids and modes
+func (spec moduleSpec) check(param string, value string) error {
+	switch param {
+	case "state":
+		if !lo.Contains(spec.states, value) {
+			return fmt.Errorf("invalid state %q; expected %s", value, strings.Join(lo.Compact(spec.states), ", "))
+		}
+	case "enabled", "update-cache", "daemon-reload", "system", "remove", "force", "create":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid %s %q; expected true or false", param, value)
+		}
+	case "uid", "gid":
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("invalid %s %q; expected a number", param, value)
+		}
+	case "mode":
+		if _, err := parseFileMode(value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// What a module runs with; its parameters and how to run commands and report
+// what it does
+type moduleContext struct {
+	workflow *Workflow
+	args     ExecuteArgs
+	params   map[string]string
+}
+
+func (m *moduleContext) param(name string) string {
+	return m.params[name]
+}
+
+// Boolean parameters are checked when the workflow is loaded, or when the
+// module starts
+func (m *moduleContext) flag(name string) bool {
+	value, _ := strconv.ParseBool(m.params[name])
+	return value
+}
+
+// Tell what the module did, or would do in check mode
+func (m *moduleContext) report(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if m.args.Check {
+		message = "would " + message
+	}
+
+	m.args.OutputCallback(message)
+}
+
+// Show how a file's content changes, in diff mode
+func (m *moduleContext) diff(file string, before []byte, after []byte, existed bool) {
+	if !m.args.Diff {
+		return
+	}
+
+	for _, line := range unifiedDiff(file, before, after, existed) {
+		m.args.OutputCallback(line)
+	}
+}
+
+// Run a command and return its output; the output is only shown when it fails
+func (m *moduleContext) output(command string) (string, error) {
+	lines := []string{}
+	errorLines := []string{}
+
+	args := m.args
+	args.Command = command
+	args.OutputCallback = func(line string) { lines = append(lines, line) }
+	args.ErrorCallback = func(line string) { errorLines = append(errorLines, line) }
+
+	err := m.workflow.Execute(args)
+	if err != nil {
+		for _, line := range append(lines, errorLines...) {
+			m.args.ErrorCallback(line)
+		}
+	}
+
+	return strings.Join(lines, "\n"), err
+}
+
+// Whether a command succeeds; its output is not shown
+func (m *moduleContext) succeeds(command string) bool {
+	args := m.args
+	args.Command = command
+	args.OutputCallback = func(string) {}
+	args.ErrorCallback = func(string) {}
+
+	return m.workflow.Execute(args) == nil
+}
+
+// Run a command that changes the system, as root; skipped in check mode
+func (m *moduleContext) change(command string) error {
+	if m.args.Check {
+		return nil
+	}
+
+	_, err := m.output(privileged(command))
+
+	return err
+}
+
+// Run a command as root; with sudo, without prompting, for other users
+func privileged(command string) string {
+	if os.Geteuid() == 0 {
+		return command
+	}
+
+	return "sudo -n " + command
+}
+
+// Whether a program is on the PATH
+func installed(program string) bool {
+	_, err := exec.LookPath(program)
+	return err == nil
+}
+
+// Run the module a step uses; reports whether it changed anything
+func (w *Workflow) executeModule(step Step, args ExecuteArgs) (bool, error) {
+	spec, found := modules[step.Module]
+	if !found {
+		return false, fmt.Errorf("unknown module %q", step.Module)
+	}
+
+	params := lo.Assign(step.With)
+	if params["state"] == "" {
+		params["state"] = spec.states[0]
+	}
+
+	// Values with expressions are checked once interpolated; one that is
+	// empty would otherwise stand for nothing, e.g. the step's directory for
+	// an empty `path`
+	errs := []error{}
+	for _, param := range spec.params[:spec.required] {
+		if strings.TrimSpace(params[param]) == "" {
+			errs = append(errs, fmt.Errorf("%s module needs %s; it is empty", step.Module, param))
+		}
+	}
+	for param, value := range params {
+		if err := spec.check(param, value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return false, errors.Join(errs...)
+	}
+
+	return spec.run(&moduleContext{workflow: w, args: args, params: params})
+}
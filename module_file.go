@@ -0,0 +1,331 @@
+package storm
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// The module's `path`, with `~` expanded and relative to the step's directory
+func (m *moduleContext) path() (string, error) {
+	path, err := expandHome(m.param("path"))
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) && m.args.Directory != "" {
+		path = filepath.Join(m.args.Directory, path)
+	}
+
+	return path, nil
+}
+
+// Give an existing file the module's mode and owner; reports whether they
+// changed
+func (m *moduleContext) attributes(path string, info fs.FileInfo) (bool, error) {
+	changed := false
+
+	if m.param("mode") != "" {
+		mode, err := parseFileMode(m.param("mode"))
+		if err != nil {
+			return false, err
+		}
+
+		if info.Mode().Perm() != mode {
+			m.report("set mode %04o on %s", mode, path)
+			if !m.args.Check {
+				if err := os.Chmod(path, mode); err != nil {
+					return false, err
+				}
+			}
+
+			changed = true
+		}
+	}
+
+	if m.param("owner") != "" {
+		uid, gid, err := lookupOwner(m.param("owner"))
+		if err != nil {
+			return false, err
+		}
+
+		fileUid, fileGid := fileOwner(info)
+		if uid != fileUid || gid != fileGid {
+			m.report("set owner %s on %s", m.param("owner"), path)
+			if !m.args.Check {
+				if err := os.Lchown(path, uid, gid); err != nil {
+					return false, err
+				}
+			}
+
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// Make sure a path is a file, directory or link, or is absent, with a mode and
+// owner. Directories are created with their parents; links pointing elsewhere
+// are replaced, and files or empty directories in the way of one only with
+// `force`.
+func fileModule(m *moduleContext) (bool, error) {
+	path, err := m.path()
+	if err != nil {
+		return false, err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	exists := err == nil
+
+	unchanged := func() (bool, error) {
+		m.args.OutputCallback(fmt.Sprintf("unchanged %s", path))
+		return false, nil
+	}
+
+	changed := false
+
+	switch m.param("state") {
+	case "absent":
+		if !exists {
+			return unchanged()
+		}
+
+		m.report("remove %s", path)
+		if !m.args.Check {
+			if err := os.RemoveAll(path); err != nil {
+				return false, err
+			}
+		}
+
+		return true, nil
+
+	case "file":
+		if !exists {
+			return false, fmt.Errorf("%s does not exist; use state touch, or a copy step, to create it", path)
+		}
+		if !info.Mode().IsRegular() {
+			return false, fmt.Errorf("%s is not a file", path)
+		}
+
+	case "touch":
+		m.report("%s %s", lo.Ternary(exists, "touch", "create"), path)
+		if !m.args.Check {
+			if exists {
+				now := time.Now()
+				err = os.Chtimes(path, now, now)
+			} else {
+				err = os.WriteFile(path, nil, 0644)
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+
+		changed = true
+
+	case "directory":
+		if exists && !info.IsDir() {
+			return false, fmt.Errorf("%s is not a directory", path)
+		}
+
+		if !exists {
+			m.report("create directory %s", path)
+			if !m.args.Check {
+				if err := os.MkdirAll(path, 0755); err != nil {
+					return false, err
+				}
+			}
+
+			changed = true
+		}
+
+	case "link":
+		src := m.param("src")
+		if src == "" {
+			return false, errors.New("file module needs src to make a link")
+		}
+
+		if exists {
+			if info.Mode()&fs.ModeSymlink != 0 {
+				target, err := os.Readlink(path)
+				if err != nil {
+					return false, err
+				}
+				if target == src {
+					break
+				}
+			} else if !m.flag("force") {
+				return false, fmt.Errorf("%s exists and is not a link; set force to replace it", path)
+			}
+		}
+
+		m.report("link %s to %s", path, src)
+		if !m.args.Check {
+			if exists {
+				// Only empty directories are replaced
+				if err := os.Remove(path); err != nil {
+					return false, err
+				}
+			}
+			if err := os.Symlink(src, path); err != nil {
+				return false, err
+			}
+		}
+
+		changed = true
+	}
+
+	if m.args.Check && changed {
+		return true, nil
+	}
+
+	// Modes of links are their targets'
+	if info, err = os.Lstat(path); err != nil {
+		return false, err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 && m.param("mode") != "" {
+		return false, errors.New("links have no mode of their own")
+	}
+
+	attributesChanged, err := m.attributes(path, info)
+	if err != nil {
+		return false, err
+	}
+
+	if !changed && !attributesChanged {
+		return unchanged()
+	}
+
+	return true, nil
+}
+
+// Make sure a line is in a file, or is not. With `regexp`, the last line
+// matching it is replaced by `line`, or every matching line is removed;
+// without, lines equal to `line` are. Lines that are not there yet are added at
+// the end.
+func lineInFileModule(m *moduleContext) (bool, error) {
+	path, err := m.path()
+	if err != nil {
+		return false, err
+	}
+
+	present := m.param("state") == "present"
+	line := m.param("line")
+
+	if present && line == "" {
+		return false, errors.New("lineinfile module needs line")
+	}
+	if !present && line == "" && m.param("regexp") == "" {
+		return false, errors.New("lineinfile module needs line or regexp")
+	}
+
+	var pattern *regexp.Regexp
+	if m.param("regexp") != "" {
+		if pattern, err = regexp.Compile(m.param("regexp")); err != nil {
+			return false, fmt.Errorf("invalid regexp %q; %s", m.param("regexp"), err)
+		}
+	}
+
+	matches := func(l string) bool {
+		return lo.TernaryF(pattern != nil, func() bool { return pattern.MatchString(l) }, func() bool { return l == line })
+	}
+
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	exists := err == nil
+
+	if !exists && !present {
+		m.args.OutputCallback(fmt.Sprintf("unchanged %s", path))
+		return false, nil
+	}
+	if !exists && !m.flag("create") {
+		return false, fmt.Errorf("%s does not exist; set create to make it", path)
+	}
+
+	original := []byte{}
+	if exists {
+		if original, err = os.ReadFile(path); err != nil {
+			return false, err
+		}
+	}
+	lines := splitLines(original)
+
+	changed := false
+
+	if present {
+		last := -1
+		for i, l := range lines {
+			if matches(l) {
+				last = i
+			}
+		}
+
+		switch {
+		case last >= 0 && lines[last] != line:
+			m.report("replace line %d of %s", last+1, path)
+			lines[last] = line
+			changed = true
+		case last < 0 && !lo.Contains(lines, line):
+			m.report("add %q to %s", line, path)
+			lines = append(lines, line)
+			changed = true
+		}
+	} else {
+		kept := lo.Reject(lines, func(l string, _ int) bool { return matches(l) })
+		if len(kept) != len(lines) {
+			m.report("remove %d lines from %s", len(lines)-len(kept), path)
+			lines = kept
+			changed = true
+		}
+	}
+
+	content := []byte(strings.Join(lines, "\n") + "\n")
+	if changed {
+		m.diff(path, original, content, exists)
+	}
+
+	if changed && !m.args.Check {
+		mode := fs.FileMode(0644)
+		uid, gid := -1, -1
+		if exists {
+			mode = info.Mode().Perm()
+			uid, gid = fileOwner(info)
+		}
+
+		if err := writeFileAtomic(path, content, mode, uid, gid); err != nil {
+			return false, err
+		}
+	}
+
+	if m.args.Check && !exists {
+		return changed, nil
+	}
+
+	if info, err = os.Stat(path); err != nil {
+		return false, err
+	}
+
+	attributesChanged, err := m.attributes(path, info)
+	if err != nil {
+		return false, err
+	}
+
+	if !changed && !attributesChanged {
+		m.args.OutputCallback(fmt.Sprintf("unchanged %s", path))
+		return false, nil
+	}
+
+	return true, nil
+}
@@ -0,0 +1,118 @@
+package storm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// How to query and change packages with a package manager
+type packageManager struct {
+	name string
+
+	// Commands; `%s` is a package, or a list of them
+	installed string
+	install   string
+	remove    string
+	update    string
+}
+
+// In order of detection; dnf before yum, which some distributions keep as an
+// alias
+var packageManagers = []packageManager{
+	{
+		name:      "apt",
+		installed: "dpkg-query -W -f='${Status}' %s 2>/dev/null | grep -q 'ok installed'",
+		install:   "env DEBIAN_FRONTEND=noninteractive apt-get install -y %s",
+		remove:    "env DEBIAN_FRONTEND=noninteractive apt-get remove -y %s",
+		update:    "apt-get update",
+	},
+	{
+		name:      "dnf",
+		installed: "rpm -q %s",
+		install:   "dnf install -y %s",
+		remove:    "dnf remove -y %s",
+		update:    "dnf makecache",
+	},
+	{
+		name:      "yum",
+		installed: "rpm -q %s",
+		install:   "yum install -y %s",
+		remove:    "yum remove -y %s",
+		update:    "yum makecache",
+	},
+	{
+		name:      "apk",
+		installed: "apk info -e %s",
+		install:   "apk add %s",
+		remove:    "apk del %s",
+		update:    "apk update",
+	},
+	{
+		name:      "pacman",
+		installed: "pacman -Q %s",
+		install:   "pacman -S --noconfirm --needed %s",
+		remove:    "pacman -R --noconfirm %s",
+		update:    "pacman -Sy",
+	},
+}
+
+// The package manager of the system; the first one found, or the one asked for
+func detectPackageManager(name string) (packageManager, error) {
+	if name != "" {
+		manager, found := lo.Find(packageManagers, func(m packageManager) bool { return m.name == name })
+		if !found {
+			names := lo.Map(packageManagers, func(m packageManager, _ int) string { return m.name })
+			return manager, fmt.Errorf("unknown package manager %q; expected %s", name, strings.Join(names, ", "))
+		}
+
+		return manager, nil
+	}
+
+	for _, manager := range packageManagers {
+		if installed(lo.Ternary(manager.name == "apt", "apt-get", manager.name)) {
+			return manager, nil
+		}
+	}
+
+	return packageManager{}, errors.New("no supported package manager found; expected apt, dnf, yum, apk or pacman")
+}
+
+// Install or remove packages; `name` is a list separated by spaces or commas.
+// Only the packages not in the state already are installed or removed.
+func packageModule(m *moduleContext) (bool, error) {
+	manager, err := detectPackageManager(m.param("manager"))
+	if err != nil {
+		return false, err
+	}
+
+	names := strings.FieldsFunc(m.param("name"), func(r rune) bool { return r == ' ' || r == ',' })
+	present := m.param("state") == "present"
+
+	pending := lo.Filter(names, func(name string, _ int) bool {
+		return m.succeeds(fmt.Sprintf(manager.installed, ShellQuote(name))) != present
+	})
+
+	if len(pending) == 0 {
+		m.args.OutputCallback(fmt.Sprintf("%s already %s", strings.Join(names, ", "), m.param("state")))
+		return false, nil
+	}
+
+	if present && m.flag("update-cache") {
+		m.report("update the %s cache", manager.name)
+		if err := m.change(manager.update); err != nil {
+			return false, err
+		}
+	}
+
+	quoted := strings.Join(lo.Map(pending, func(name string, _ int) string { return ShellQuote(name) }), " ")
+
+	m.report("%s %s", lo.Ternary(present, "install", "remove"), strings.Join(pending, ", "))
+	if err := m.change(fmt.Sprintf(lo.Ternary(present, manager.install, manager.remove), quoted)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
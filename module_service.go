@@ -0,0 +1,71 @@
+package storm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Start, stop, restart or reload a systemd service, and enable or disable it
+// at boot. Restarts and reloads always change it; the rest only when it is
+// not in the state already.
+func serviceModule(m *moduleContext) (bool, error) {
+	if !installed("systemctl") {
+		return false, errors.New("service module needs systemd; systemctl is not installed")
+	}
+
+	name := ShellQuote(m.param("name"))
+	changed := false
+
+	if m.flag("daemon-reload") {
+		m.report("reload systemd units")
+		if err := m.change("systemctl daemon-reload"); err != nil {
+			return false, err
+		}
+	}
+
+	if m.param("enabled") != "" {
+		enabled := m.flag("enabled")
+
+		if m.succeeds(fmt.Sprintf("systemctl is-enabled --quiet %s", name)) != enabled {
+			action := map[bool]string{true: "enable", false: "disable"}[enabled]
+
+			m.report("%s %s", action, m.param("name"))
+			if err := m.change(fmt.Sprintf("systemctl %s %s", action, name)); err != nil {
+				return false, err
+			}
+
+			changed = true
+		}
+	}
+
+	action := ""
+	active := m.succeeds(fmt.Sprintf("systemctl is-active --quiet %s", name))
+
+	switch m.param("state") {
+	case "started":
+		action = map[bool]string{true: "", false: "start"}[active]
+	case "stopped":
+		action = map[bool]string{true: "stop", false: ""}[active]
+	case "restarted":
+		action = "restart"
+	case "reloaded":
+		action = "reload"
+	}
+
+	if action != "" {
+		m.report("%s %s", action, m.param("name"))
+		if err := m.change(fmt.Sprintf("systemctl %s %s", action, name)); err != nil {
+			return false, err
+		}
+
+		changed = true
+	}
+
+	if !changed && m.param("state") != "" {
+		m.args.OutputCallback(fmt.Sprintf("%s already %s", m.param("name"), m.param("state")))
+	} else if !changed {
+		m.args.OutputCallback(fmt.Sprintf("unchanged %s", m.param("name")))
+	}
+
+	return changed, nil
+}
@@ -0,0 +1,254 @@
+package storm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// Fields of a `getent` entry, or nothing when there is none
+func (m *moduleContext) getent(database string, name string) []string {
+	entry, err := m.output(fmt.Sprintf("getent %s %s || true", database, ShellQuote(name)))
+	if err != nil || entry == "" {
+		return nil
+	}
+
+	return strings.Split(entry, ":")
+}
+
+// Join a command and its arguments, quoting the arguments
+func shellCommand(command string, args ...string) string {
+	return strings.Join(append([]string{command}, lo.Map(args, func(arg string, _ int) string { return ShellQuote(arg) })...), " ")
+}
+
+// Create, change or remove a user. Existing users are changed with usermod,
+// only for the parameters that differ; `groups` is the full list of the user's
+// supplementary groups. Busybox systems without useradd use adduser and
+// deluser, and can only create and remove users.
+func userModule(m *moduleContext) (bool, error) {
+	name := m.param("name")
+	entry := m.getent("passwd", name)
+
+	if m.param("state") == "absent" {
+		if entry == nil {
+			m.args.OutputCallback(fmt.Sprintf("%s already absent", name))
+			return false, nil
+		}
+
+		command := ""
+		switch {
+		case installed("userdel"):
+			command = shellCommand("userdel", lo.Ternary(m.flag("remove"), []string{"-r", name}, []string{name})...)
+		case installed("deluser"):
+			command = shellCommand("deluser", lo.Ternary(m.flag("remove"), []string{"--remove-home", name}, []string{name})...)
+		default:
+			return false, errors.New("user module needs userdel or deluser")
+		}
+
+		m.report("remove user %s", name)
+		return true, m.change(command)
+	}
+
+	groups := strings.FieldsFunc(m.param("groups"), func(r rune) bool { return r == ' ' || r == ',' })
+
+	if entry == nil {
+		args := []string{}
+		command := ""
+
+		switch {
+		case installed("useradd"):
+			command = "useradd"
+			args = append(args, "-m")
+			if m.param("uid") != "" {
+				args = append(args, "-u", m.param("uid"))
+			}
+			if m.param("group") != "" {
+				args = append(args, "-g", m.param("group"))
+			}
+			if len(groups) > 0 {
+				args = append(args, "-G", strings.Join(groups, ","))
+			}
+			if m.param("shell") != "" {
+				args = append(args, "-s", m.param("shell"))
+			}
+			if m.param("home") != "" {
+				args = append(args, "-d", m.param("home"))
+			}
+			if m.flag("system") {
+				args = append(args, "-r")
+			}
+		case installed("adduser"):
+			if len(groups) > 0 {
+				return false, errors.New("user module needs useradd to set groups")
+			}
+
+			command = "adduser"
+			args = append(args, "-D")
+			if m.param("uid") != "" {
+				args = append(args, "-u", m.param("uid"))
+			}
+			if m.param("group") != "" {
+				args = append(args, "-G", m.param("group"))
+			}
+			if m.param("shell") != "" {
+				args = append(args, "-s", m.param("shell"))
+			}
+			if m.param("home") != "" {
+				args = append(args, "-h", m.param("home"))
+			}
+			if m.flag("system") {
+				args = append(args, "-S")
+			}
+		default:
+			return false, errors.New("user module needs useradd or adduser")
+		}
+
+		m.report("create user %s", name)
+		return true, m.change(shellCommand(command, append(args, name)...))
+	}
+
+	// name:password:uid:gid:gecos:home:shell
+	if len(entry) < 7 {
+		return false, fmt.Errorf("unexpected passwd entry for %s", name)
+	}
+
+	args := []string{}
+	changes := []string{}
+
+	if uid := m.param("uid"); uid != "" && uid != entry[2] {
+		args = append(args, "-u", uid)
+		changes = append(changes, "uid "+uid)
+	}
+
+	if group := m.param("group"); group != "" && group != entry[3] {
+		groupEntry := m.getent("group", group)
+		if groupEntry == nil && !m.args.Check {
+			return false, fmt.Errorf("unknown group %s", group)
+		}
+
+		if groupEntry == nil || groupEntry[2] != entry[3] {
+			args = append(args, "-g", group)
+			changes = append(changes, "group "+group)
+		}
+	}
+
+	if m.param("groups") != "" {
+		current, _ := m.output(shellCommand("id", "-Gn", name))
+		currentGroups := lo.Without(strings.Fields(current), m.primaryGroup(entry[3]))
+
+		sort.Strings(currentGroups)
+		wanted := lo.Uniq(groups)
+		sort.Strings(wanted)
+
+		if strings.Join(currentGroups, ",") != strings.Join(wanted, ",") {
+			args = append(args, "-G", strings.Join(wanted, ","))
+			changes = append(changes, "groups "+strings.Join(wanted, ","))
+		}
+	}
+
+	if shell := m.param("shell"); shell != "" && shell != entry[6] {
+		args = append(args, "-s", shell)
+		changes = append(changes, "shell "+shell)
+	}
+
+	if home := m.param("home"); home != "" && home != entry[5] {
+		args = append(args, "-d", home, "-m")
+		changes = append(changes, "home "+home)
+	}
+
+	if len(args) == 0 {
+		m.args.OutputCallback(fmt.Sprintf("%s already present", name))
+		return false, nil
+	}
+
+	if !installed("usermod") {
+		return false, errors.New("user module needs usermod to change existing users")
+	}
+
+	m.report("set %s of user %s", strings.Join(changes, ", "), name)
+	return true, m.change(shellCommand("usermod", append(args, name)...))
+}
+
+// Name of a group id, or the id when it has no name
+func (m *moduleContext) primaryGroup(gid string) string {
+	entry := m.getent("group", gid)
+	if entry == nil {
+		return gid
+	}
+
+	return entry[0]
+}
+
+// Create, change the id of, or remove a group; with groupadd, groupmod and
+// groupdel, or busybox's addgroup and delgroup
+func groupModule(m *moduleContext) (bool, error) {
+	name := m.param("name")
+	entry := m.getent("group", name)
+
+	if m.param("state") == "absent" {
+		if entry == nil {
+			m.args.OutputCallback(fmt.Sprintf("%s already absent", name))
+			return false, nil
+		}
+
+		command := ""
+		switch {
+		case installed("groupdel"):
+			command = shellCommand("groupdel", name)
+		case installed("delgroup"):
+			command = shellCommand("delgroup", name)
+		default:
+			return false, errors.New("group module needs groupdel or delgroup")
+		}
+
+		m.report("remove group %s", name)
+		return true, m.change(command)
+	}
+
+	gid := m.param("gid")
+
+	if entry == nil {
+		args := []string{}
+		command := ""
+
+		switch {
+		case installed("groupadd"):
+			command = "groupadd"
+			if gid != "" {
+				args = append(args, "-g", gid)
+			}
+			if m.flag("system") {
+				args = append(args, "-r")
+			}
+		case installed("addgroup"):
+			command = "addgroup"
+			if gid != "" {
+				args = append(args, "-g", gid)
+			}
+			if m.flag("system") {
+				args = append(args, "-S")
+			}
+		default:
+			return false, errors.New("group module needs groupadd or addgroup")
+		}
+
+		m.report("create group %s", name)
+		return true, m.change(shellCommand(command, append(args, name)...))
+	}
+
+	// name:password:gid:members
+	if gid == "" || len(entry) < 3 || entry[2] == gid {
+		m.args.OutputCallback(fmt.Sprintf("%s already present", name))
+		return false, nil
+	}
+
+	if !installed("groupmod") {
+		return false, errors.New("group module needs groupmod to change existing groups")
+	}
+
+	m.report("set gid %s of group %s", gid, name)
+	return true, m.change(shellCommand("groupmod", "-g", gid, name))
+}
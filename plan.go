@@ -0,0 +1,297 @@
+package storm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// What a run would do, on which server and in what order, without doing it
+type Plan struct {
+	Workflow string     `json:"workflow"`
+	Hosts    []HostPlan `json:"hosts"`
+}
+
+type HostPlan struct {
+	// Server name; `local` for runs on the current machine
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+
+	// Only set when reachability was checked
+	Reachable *bool  `json:"reachable,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	Jobs []JobPlan `json:"jobs"`
+}
+
+type JobPlan struct {
+	Name  string     `json:"name"`
+	Needs string     `json:"needs,omitempty"`
+	If    string     `json:"if,omitempty"`
+	Skip  string     `json:"skip,omitempty"`
+	Steps []StepPlan `json:"steps"`
+
+	// The job's `runs-on` when it does not select the server; the job still
+	// runs there, agent runs ignore `runs-on`
+	RunsOn string `json:"runs_on,omitempty"`
+
+	// Only run when notified
+	Handlers []StepPlan `json:"handlers,omitempty"`
+}
+
+type StepPlan struct {
+	Name      string `json:"name"`
+	Command   string `json:"command"`
+	Directory string `json:"directory,omitempty"`
+	If        string `json:"if,omitempty"`
+	Skip      string `json:"skip,omitempty"`
+	Notify    string `json:"notify,omitempty"`
+}
+
+// Keep reachability checks from hanging on servers that drop packets
+const planConnectTimeout = 10 * time.Second
+
+// Plan the jobs of a workflow in the order they run; resumed runs skip what
+// the previous run completed
+func planJobs(wc WorkflowConfig, resume *ResumeState) ([]JobPlan, error) {
+	jobs, err := NewJobGraph(wc.Jobs).Order()
+	if err != nil {
+		return nil, err
+	}
+
+	fromJob, fromStep := "", ""
+	if resume != nil {
+		fromJob, fromStep = resume.failedJob(), resume.FromStep
+	}
+
+	plans := []JobPlan{}
+	for _, job := range jobs {
+		jobPlan := JobPlan{Name: job.Name, Needs: job.Needs, If: job.If, Steps: []StepPlan{}}
+
+		if resume != nil && resume.CompletedJob(job.Name) != nil {
+			jobPlan.Skip = resume.reason()
+		}
+
+		for _, step := range job.Steps {
+			stepPlan := StepPlan{
+				Name:      step.Name,
+				Command:   step.command(),
+				Directory: lo.Ternary(step.Directory != "", step.Directory, wc.Directory),
+				If:        step.If,
+				Skip:      jobPlan.Skip,
+				Notify:    step.Notify,
+			}
+
+			if jobPlan.Skip == "" && fromStep != "" && job.Name == fromJob {
+				if step.Name == fromStep {
+					fromStep = ""
+				} else {
+					stepPlan.Skip = resume.reason()
+				}
+			}
+
+			jobPlan.Steps = append(jobPlan.Steps, stepPlan)
+		}
+
+		for _, handler := range job.Handlers {
+			jobPlan.Handlers = append(jobPlan.Handlers, StepPlan{
+				Name:      handler.Name,
+				Command:   handler.command(),
+				Directory: lo.Ternary(handler.Directory != "", handler.Directory, wc.Directory),
+				If:        handler.If,
+				Skip:      jobPlan.Skip,
+			})
+		}
+
+		plans = append(plans, jobPlan)
+	}
+
+	return plans, nil
+}
+
+// Plan a local run
+func (w *Workflow) Plan(opts ...WorkflowRunOptions) (*Plan, error) {
+	args := WorkflowRunArgs{}
+
+	for _, opt := range opts {
+		opt(&args)
+	}
+
+	if args.File == nil && args.Config == nil {
+		return nil, errors.New("either file or config must be specified to plan a workflow")
+	}
+
+	if args.File != nil && args.Config == nil {
+		_config, err := w.Load(*args.File)
+		if err != nil {
+			return nil, err
+		}
+
+		args.Config = _config
+	}
+
+	config, _, err := applyInputs(*args.Config, args.Inputs, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := planJobs(config, args.Resume)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Plan{
+		Workflow: args.Config.Name,
+		Hosts:    []HostPlan{{Name: LocalHost, Jobs: jobs}},
+	}, nil
+}
+
+// Plan an agent run; which servers are selected and the jobs each of them
+// runs, every job of the workflow. Nothing is connected to unless
+// reachability is checked.
+func (a *Agent) Plan(opts ...RunOption) (*Plan, error) {
+	args := RunArgs{}
+
+	for _, opt := range opts {
+		opt(&args)
+	}
+
+	wc, ic, err := a.configs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := applyInputs(*wc, args.Inputs, nil)
+	if err != nil {
+		return nil, err
+	}
+	wc = &config
+
+	plan := Plan{Workflow: wc.Name, Hosts: []HostPlan{}}
+
+	servers, err := selectServers(*ic, args.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, server := range servers {
+		var resume *ResumeState
+		if args.Resume != nil {
+			resume = lo.ToPtr(NewResumeState(*args.Resume, server.Name, args.FromStep))
+		}
+
+		jobs, err := planJobs(*wc, resume)
+		if err != nil {
+			return nil, err
+		}
+
+		// Agent runs do not route jobs, every server runs every job; jobs
+		// whose `runs-on` picks other servers are pointed out
+		for i := range jobs {
+			job, _ := lo.Find(wc.Jobs, func(j Job) bool { return j.Name == jobs[i].Name })
+			if !server.Matches(job.RunsOn) {
+				jobs[i].RunsOn = job.RunsOn
+			}
+		}
+
+		hostPlan := HostPlan{
+			Name:    server.Name,
+			Address: fmt.Sprintf("%s@%s:%d", server.User, server.Host, server.Port),
+			Jobs:    jobs,
+		}
+
+		if args.CheckConnect {
+			client, err := a.ssh.Authenticate(AuthenticateArgs{
+				Host:          server.Host,
+				Port:          server.Port,
+				User:          server.User,
+				Password:      server.SshPassword,
+				PrivateSshKey: server.PrivateSshKey,
+				Timeout:       planConnectTimeout,
+			})
+
+			hostPlan.Reachable = lo.ToPtr(err == nil)
+			if err != nil {
+				hostPlan.Error = err.Error()
+			} else {
+				client.Close()
+			}
+		}
+
+		plan.Hosts = append(plan.Hosts, hostPlan)
+	}
+
+	return &plan, nil
+}
+
+// Whether every server that was checked is reachable
+func (p Plan) Reachable() bool {
+	return lo.EveryBy(p.Hosts, func(host HostPlan) bool { return host.Reachable == nil || *host.Reachable })
+}
+
+func (p Plan) Render(w io.Writer) {
+	fmt.Fprintf(w, "Workflow: %s\n", p.Workflow)
+
+	if len(p.Hosts) == 0 {
+		fmt.Fprintln(w, "No server is selected; nothing would run.")
+	}
+
+	for _, host := range p.Hosts {
+		fmt.Fprintf(w, "\nServer: [%s]", host.Name)
+		if host.Address != "" {
+			fmt.Fprintf(w, " %s", host.Address)
+		}
+		if host.Reachable != nil {
+			fmt.Fprintf(w, " (%s)", lo.Ternary(*host.Reachable, "reachable", "unreachable; "+strings.ReplaceAll(host.Error, "\n", "; ")))
+		}
+		fmt.Fprintln(w)
+
+		for i, job := range host.Jobs {
+			fmt.Fprintf(w, "  %d. [%s]", i+1, job.Name)
+			if job.Needs != "" {
+				fmt.Fprintf(w, " needs %s", job.Needs)
+			}
+			if job.If != "" {
+				fmt.Fprintf(w, " (if %s)", job.If)
+			}
+			if job.Skip != "" {
+				fmt.Fprintf(w, " (skip; %s)", job.Skip)
+			}
+			if job.RunsOn != "" {
+				fmt.Fprintf(w, " (runs-on %s does not select this server, it runs here all the same)", job.RunsOn)
+			}
+			fmt.Fprintln(w)
+
+			for _, step := range job.Steps {
+				renderStepPlan(w, "->", step)
+			}
+
+			for _, handler := range job.Handlers {
+				renderStepPlan(w, "=>", handler)
+			}
+		}
+	}
+}
+
+// Handlers are marked with `=>`, they only run when notified
+func renderStepPlan(w io.Writer, marker string, step StepPlan) {
+	fmt.Fprintf(w, "     %s %s", marker, step.Name)
+	if step.Skip != "" {
+		fmt.Fprintf(w, " (skip; %s)", step.Skip)
+	}
+	if step.Directory != "" {
+		fmt.Fprintf(w, " (in %s)", step.Directory)
+	}
+	if step.If != "" {
+		fmt.Fprintf(w, " (if %s)", step.If)
+	}
+	if step.Notify != "" {
+		fmt.Fprintf(w, " (notifies %s)", step.Notify)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "        $ %s\n", strings.ReplaceAll(strings.TrimSpace(step.Command), "\n", "\n          "))
+}
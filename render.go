@@ -0,0 +1,126 @@
+package storm
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/samber/lo"
+)
+
+// Turns events into output; pass `Render` as an event handler
+//
+//	@example
+//
+//	renderer := NewJsonRenderer(os.Stdout)
+//	workflow.Run(workflow.WorkflowWithFile("./workflow.yaml"), workflow.WorkflowWithHandler(renderer.Render))
+type Renderer interface {
+	Render(Event)
+}
+
+const (
+	RendererPlain = "plain"
+	RendererJson  = "json"
+)
+
+// Pick a renderer by name; `plain` or `json`
+func NewRenderer(format string, w io.Writer) (Renderer, error) {
+	switch format {
+	case RendererPlain:
+		return NewPlainRenderer(w), nil
+	case RendererJson:
+		return NewJsonRenderer(w), nil
+	default:
+		return nil, fmt.Errorf("unknown output format %s; available options are plain and json", format)
+	}
+}
+
+// Human readable output; runs end with a recap of what their steps did
+type PlainRenderer struct {
+	w    io.Writer
+	host string
+
+	// Host => step counts of its run
+	recaps map[string]*recap
+}
+
+// Steps of a run by outcome; ok counts the changed ones too
+type recap struct {
+	ok      int
+	changed int
+	skipped int
+	failed  int
+}
+
+func (r *PlainRenderer) Render(event Event) {
+	meta := event.Meta()
+
+	if meta.Host != "" && meta.Host != r.host {
+		r.host = meta.Host
+		fmt.Fprintf(r.w, "Server: [%s]\n", meta.Host)
+	}
+
+	counts := r.recaps[meta.Host]
+	if counts == nil {
+		counts = &recap{}
+		r.recaps[meta.Host] = counts
+	}
+
+	switch e := event.(type) {
+	case *JobStarted:
+		fmt.Fprintf(r.w, "[%s]\n", e.Job)
+	case *StepStarted:
+		fmt.Fprintf(r.w, "-> %s\n", e.Step)
+		fmt.Fprintf(r.w, "$ %s \n", e.Command)
+	case *StepOutput:
+		if e.Job == "" {
+			fmt.Fprintln(r.w, e.Line)
+		} else {
+			fmt.Fprintln(r.w, "> ", e.Line)
+		}
+	case *StepFinished:
+		if e.Error != "" {
+			fmt.Fprintf(r.w, "x  %s\n", e.Error)
+			counts.failed++
+		} else {
+			counts.ok++
+			counts.changed += lo.Ternary(e.Changed, 1, 0)
+		}
+	case *StepSkipped:
+		fmt.Fprintf(r.w, "-> %s (skipped; %s)\n", e.Step, e.Reason)
+		counts.skipped++
+	case *JobSkipped:
+		fmt.Fprintf(r.w, "[%s] (skipped; %s)\n", e.Job, e.Reason)
+	case *JobFinished:
+		fmt.Fprintf(r.w, "Took %fs to run.\n\n", e.Duration.Seconds())
+	case *RunFinished:
+		if e.Error != "" {
+			fmt.Fprintf(r.w, "> %s\n", e.Error)
+		}
+
+		fmt.Fprintf(r.w, "Recap: ok=%d changed=%d skipped=%d failed=%d\n", counts.ok, counts.changed, counts.skipped, counts.failed)
+		delete(r.recaps, meta.Host)
+	}
+}
+
+func NewPlainRenderer(w io.Writer) *PlainRenderer {
+	return &PlainRenderer{w: w, recaps: map[string]*recap{}}
+}
+
+// One event protocol line per event
+type JsonRenderer struct {
+	w io.Writer
+}
+
+func (r *JsonRenderer) Render(event Event) {
+	line, err := MarshalEvent(event)
+	if err != nil {
+		fmt.Fprintln(r.w, "could not marshal event to json. reason: ", err)
+		return
+	}
+
+	fmt.Fprintln(r.w, string(line))
+}
+
+func NewJsonRenderer(w io.Writer) *JsonRenderer {
+	return &JsonRenderer{w: w}
+}
@@ -0,0 +1,101 @@
+package storm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/samber/lo"
+)
+
+// What a previous run of a host already did; jobs it completed are skipped
+// and the first job it did not complete is restarted
+type ResumeState struct {
+	RunId string      `json:"run_id"`
+	Jobs  []JobRecord `json:"jobs"`
+
+	// Step to restart the first incomplete job from; restarts the whole job
+	// when empty
+	FromStep string `json:"from_step,omitempty"`
+}
+
+// Build the resume state of a host from a recorded run; hosts the run never
+// reached get an empty state and run everything. `fromStep` only applies to
+// hosts that have a failed job.
+func NewResumeState(record RunRecord, host string, fromStep string) ResumeState {
+	state := ResumeState{RunId: record.Id, Jobs: []JobRecord{}}
+
+	hostRecord := record.Host(host)
+	if hostRecord == nil {
+		return state
+	}
+
+	state.Jobs = hostRecord.Jobs
+	if lo.ContainsBy(hostRecord.Jobs, func(j JobRecord) bool { return j.Status == StatusFailed || j.Status == StatusRunning }) {
+		state.FromStep = fromStep
+	}
+
+	return state
+}
+
+func LoadResumeState(file string) (*ResumeState, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Join(errors.New("cannot read resume state"), err)
+	}
+
+	state := ResumeState{}
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		return nil, errors.Join(errors.New("invalid resume state"), err)
+	}
+
+	return &state, nil
+}
+
+func (r ResumeState) Dump() ([]byte, error) {
+	return json.Marshal(&r)
+}
+
+// The recorded job if it completed in the resumed run, or in the run that
+// one resumed; jobs skipped by their `if` did not, the inputs may have changed
+func (r ResumeState) CompletedJob(name string) *JobRecord {
+	for i := range r.Jobs {
+		job := r.Jobs[i]
+		if job.Name == name && (job.Status == StatusSucceeded || job.Status == StatusSkipped && job.ResumedFrom != "") {
+			return &job
+		}
+	}
+
+	return nil
+}
+
+// The job the resumed run failed in, or was running when it stopped; the one
+// `FromStep` belongs to
+func (r ResumeState) failedJob() string {
+	job, _ := lo.Find(r.Jobs, func(j JobRecord) bool { return j.Status == StatusFailed || j.Status == StatusRunning })
+
+	return job.Name
+}
+
+// The recorded outputs of a step, from the last time it ran
+func (r ResumeState) StepOutputs(job string, step string) map[string]string {
+	for _, jobRecord := range r.Jobs {
+		if jobRecord.Name != job {
+			continue
+		}
+
+		for _, stepRecord := range jobRecord.Steps {
+			if stepRecord.Name == step {
+				return stepRecord.Outputs
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r ResumeState) reason() string {
+	return fmt.Sprintf("completed in run %s", r.RunId)
+}
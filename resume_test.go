@@ -0,0 +1,176 @@
+package storm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewResumeState(t *testing.T) {
+	record := RunRecord{
+		Id: "20261019-065400-abce00a8",
+		Hosts: []HostRecord{
+			{Name: "one", Status: StatusFailed, Jobs: []JobRecord{
+				{Name: "build", Status: StatusSucceeded},
+				{Name: "deploy", Status: StatusFailed},
+			}},
+			{Name: "two", Status: StatusSucceeded, Jobs: []JobRecord{
+				{Name: "build", Status: StatusSucceeded},
+				{Name: "deploy", Status: StatusSucceeded},
+			}},
+			{Name: "three", Status: StatusFailed, Jobs: []JobRecord{
+				{Name: "build", Status: StatusRunning},
+			}},
+		},
+	}
+
+	tests := []struct {
+		host     string
+		jobs     []string
+		fromStep string
+	}{
+		{"one", []string{"build", "deploy"}, "migrate"},
+		{"two", []string{"build", "deploy"}, ""},
+		{"three", []string{"build"}, "migrate"},
+		{"four", []string{}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			state := NewResumeState(record, test.host, "migrate")
+
+			if state.RunId != record.Id {
+				t.Errorf("got run id %q, want %q", state.RunId, record.Id)
+			}
+			if state.FromStep != test.fromStep {
+				t.Errorf("got from step %q, want %q", state.FromStep, test.fromStep)
+			}
+
+			jobs := []string{}
+			for _, job := range state.Jobs {
+				jobs = append(jobs, job.Name)
+			}
+			if !reflect.DeepEqual(jobs, test.jobs) {
+				t.Errorf("got jobs %v, want %v", jobs, test.jobs)
+			}
+		})
+	}
+}
+
+func TestResumeStateCompletedJob(t *testing.T) {
+	state := ResumeState{
+		RunId: "20261019-065400-abce00a8",
+		Jobs: []JobRecord{
+			{Name: "build", Status: StatusSucceeded},
+			{Name: "lint", Status: StatusSkipped, Error: `if "inputs.lint" is false`},
+			{Name: "test", Status: StatusSkipped, Error: "completed in run 20261018-010000-0000beef", ResumedFrom: "20261018-010000-0000beef"},
+			{Name: "deploy", Status: StatusFailed},
+			{Name: "notify", Status: StatusRunning},
+		},
+	}
+
+	tests := []struct {
+		job       string
+		completed bool
+	}{
+		{"build", true},
+		{"lint", false},
+		{"test", true},
+		{"deploy", false},
+		{"notify", false},
+		{"unknown", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.job, func(t *testing.T) {
+			job := state.CompletedJob(test.job)
+			if (job != nil) != test.completed {
+				t.Fatalf("got %v, want completed %v", job, test.completed)
+			}
+			if job != nil && job.Name != test.job {
+				t.Errorf("got job %q, want %q", job.Name, test.job)
+			}
+		})
+	}
+}
+
+func TestResumeStateStepOutputs(t *testing.T) {
+	state := ResumeState{Jobs: []JobRecord{
+		{Name: "build", Steps: []StepRecord{
+			{Name: "version", Outputs: map[string]string{"version": "1.4.2"}},
+			{Name: "compile"},
+		}},
+	}}
+
+	tests := []struct {
+		job     string
+		step    string
+		outputs map[string]string
+	}{
+		{"build", "version", map[string]string{"version": "1.4.2"}},
+		{"build", "compile", nil},
+		{"build", "unknown", nil},
+		{"deploy", "version", nil},
+	}
+
+	for _, test := range tests {
+		if outputs := state.StepOutputs(test.job, test.step); !reflect.DeepEqual(outputs, test.outputs) {
+			t.Errorf("%s job, %s step: got %v, want %v", test.job, test.step, outputs, test.outputs)
+		}
+	}
+}
+
+func TestLoadResumeState(t *testing.T) {
+	state := ResumeState{
+		RunId:    "20261019-065400-abce00a8",
+		FromStep: "migrate",
+		Jobs: []JobRecord{
+			{Name: "build", Status: StatusSkipped, ResumedFrom: "20261018-010000-0000beef", Steps: []StepRecord{}},
+		},
+	}
+
+	content, err := state.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "resume.json")
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadResumeState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*loaded, state) {
+		t.Errorf("got %+v, want %+v", *loaded, state)
+	}
+
+	if err := os.WriteFile(file, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadResumeState(file); err == nil {
+		t.Error("expected an invalid resume state to fail")
+	}
+}
+
+func TestResumeStateFailedJob(t *testing.T) {
+	tests := []struct {
+		name string
+		jobs []JobRecord
+		job  string
+	}{
+		{"failed", []JobRecord{{Name: "build", Status: StatusSucceeded}, {Name: "lint", Status: StatusSkipped}, {Name: "deploy", Status: StatusFailed}}, "deploy"},
+		{"interrupted", []JobRecord{{Name: "build", Status: StatusRunning}}, "build"},
+		{"succeeded", []JobRecord{{Name: "build", Status: StatusSucceeded}, {Name: "lint", Status: StatusSkipped}}, ""},
+		{"never reached", []JobRecord{}, ""},
+	}
+
+	for _, test := range tests {
+		if job := (ResumeState{Jobs: test.jobs}).failedJob(); job != test.job {
+			t.Errorf("%s: got %q, want %q", test.name, job, test.job)
+		}
+	}
+}
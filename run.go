@@ -0,0 +1,17 @@
+package storm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Generate a unique, time sortable id for a workflow run
+//
+//	example; `20240830-142501-9f86d081`
+func NewRunId() string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
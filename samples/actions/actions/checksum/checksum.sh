@@ -0,0 +1,5 @@
+#!/bin/sh
+set -e
+sum=$(sha256sum "$STORM_INPUT_FILE" | cut -d' ' -f1)
+echo "$STORM_INPUT_FILE $sum"
+echo "sha256=$sum" >> "$STORM_OUTPUT"
@@ -0,0 +1,325 @@
+package storm
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// What to do when a schedule fires while its previous run is not done
+const (
+	OverlapSkip  = "skip"
+	OverlapQueue = "queue"
+	OverlapAllow = "allow"
+)
+
+type Scheduler struct {
+	workflow  *Workflow
+	inventory *Inventory
+	agent     *Agent
+}
+
+type SchedulerArgs struct {
+	// Directory of the workflows; they are reloaded every minute
+	Workflows string
+
+	// When set, workflows run on the inventory's servers instead of locally
+	Inventory string
+
+	// Timezone of the schedules that do not name one; defaults to local time
+	Location *time.Location
+
+	Handlers []func(Event)
+	History  *History
+}
+
+// A schedule of a workflow, ready to be checked every minute
+type scheduledRun struct {
+	// Identifies the schedule across reloads, to track its runs
+	key string
+
+	config   WorkflowConfig
+	schedule ScheduleTrigger
+	cron     *CronSchedule
+	location *time.Location
+	jitter   time.Duration
+}
+
+// Runs of a schedule that are going and waiting
+type scheduleState struct {
+	running int
+	queued  int
+}
+
+// Run the workflows of the directory whenever one of their `on.schedule`
+// expressions fires, until the process is stopped. Times skipped by a
+// daylight saving change do not fire.
+func (s *Scheduler) Run(args SchedulerArgs) error {
+	workflows := lo.Ternary(args.Workflows != "", args.Workflows, DefaultWorkflowsDirectory)
+	location := lo.Ternary(args.Location != nil, args.Location, time.Local)
+
+	var ic *InventoryConfig
+	if args.Inventory != "" {
+		_ic, err := s.inventory.Load(args.Inventory)
+		if err != nil {
+			return err
+		}
+
+		ic = _ic
+	}
+
+	loaded := newLoadedSchedules()
+
+	schedules, err := s.reload(loaded, workflows, location)
+	if len(schedules) == 0 && err != nil {
+		return err
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	for _, schedule := range schedules {
+		next := schedule.cron.Next(time.Now().In(schedule.location))
+		fmt.Printf("%s (%s) next runs at %s\n", schedule.config.Name, schedule.schedule.Cron, next.Format(time.RFC3339))
+	}
+
+	// Runs of different schedules can overlap, their events must not
+	outputMutex := sync.Mutex{}
+	handlers := []func(Event){func(e Event) {
+		outputMutex.Lock()
+		defer outputMutex.Unlock()
+
+		for _, handler := range args.Handlers {
+			handler(e)
+		}
+	}}
+
+	stateMutex := sync.Mutex{}
+	states := map[string]*scheduleState{}
+
+	for {
+		tick := time.Now().Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(tick))
+
+		// Errors are only reported when they change, not every minute
+		schedules, err := s.reload(loaded, workflows, location)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		for _, schedule := range schedules {
+			if !schedule.cron.Matches(tick.In(schedule.location)) {
+				continue
+			}
+
+			stateMutex.Lock()
+			state, found := states[schedule.key]
+			if !found {
+				state = &scheduleState{}
+				states[schedule.key] = state
+			}
+
+			if state.running > 0 && schedule.schedule.Overlap != OverlapAllow {
+				if schedule.schedule.Overlap == OverlapQueue {
+					state.queued++
+					fmt.Printf("%s is still running, queued the run of %s\n", schedule.config.Name, tick.Format(time.RFC3339))
+				} else {
+					fmt.Printf("%s is still running, skipped the run of %s\n", schedule.config.Name, tick.Format(time.RFC3339))
+				}
+
+				stateMutex.Unlock()
+				continue
+			}
+
+			state.running++
+			stateMutex.Unlock()
+
+			go func() {
+				for {
+					s.run(schedule, ic, handlers, args.History)
+
+					stateMutex.Lock()
+					if state.queued == 0 {
+						state.running--
+						stateMutex.Unlock()
+
+						return
+					}
+
+					state.queued--
+					stateMutex.Unlock()
+				}
+			}()
+		}
+	}
+}
+
+// Run a scheduled workflow once; with a jitter every host starts after its
+// own delay, the same one every time, within the one run
+func (s *Scheduler) run(schedule scheduledRun, ic *InventoryConfig, handlers []func(Event), history *History) {
+	args := triggeredRunArgs{
+		Config:    schedule.config,
+		Trigger:   TriggerContext{Event: TriggerSchedule, Schedule: schedule.schedule.Cron},
+		Inventory: ic,
+		Handlers:  handlers,
+		History:   history,
+	}
+
+	if schedule.jitter > 0 {
+		args.StartDelay = func(host string) time.Duration { return hostJitter(schedule.key, host, schedule.jitter) }
+	}
+
+	if err := runTriggered(s.workflow, s.agent, args); err != nil {
+		fmt.Println(fmt.Errorf("%s workflow failed; %w", schedule.config.Name, err))
+	}
+}
+
+// A delay below `jitter`, derived from the schedule and the host so hosts are
+// spread out the same way on every run
+func hostJitter(key string, host string, jitter time.Duration) time.Duration {
+	hash := fnv.New64a()
+	hash.Write([]byte(key + "\x00" + host))
+
+	return time.Duration(hash.Sum64() % uint64(jitter))
+}
+
+// Schedules of the workflows in a directory, as of their last valid version
+type loadedSchedules struct {
+	// Schedules of each file
+	schedules map[string][]scheduledRun
+
+	// Last load error of each file, and of the directory
+	errors map[string]string
+}
+
+func newLoadedSchedules() *loadedSchedules {
+	return &loadedSchedules{schedules: map[string][]scheduledRun{}, errors: map[string]string{}}
+}
+
+// Reload the workflows of the directory and return every schedule; a file
+// that fails keeps its last valid schedules until it is fixed. Only the
+// errors that changed since the previous reload are returned.
+func (s *Scheduler) reload(loaded *loadedSchedules, directory string, location *time.Location) ([]scheduledRun, error) {
+	errs := []error{}
+
+	report := func(key string, err error) {
+		if err == nil {
+			if _, found := loaded.errors[key]; found {
+				fmt.Printf("%s is valid again\n", key)
+			}
+
+			delete(loaded.errors, key)
+			return
+		}
+
+		if loaded.errors[key] != err.Error() {
+			errs = append(errs, err)
+		}
+
+		loaded.errors[key] = err.Error()
+	}
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		report(directory, errors.Join(fmt.Errorf("could not read workflows directory %s", directory), err))
+	} else {
+		report(directory, nil)
+
+		files := map[string]bool{}
+
+		for _, entry := range entries {
+			if ext := filepath.Ext(entry.Name()); entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+				continue
+			}
+
+			file := filepath.Join(directory, entry.Name())
+			files[file] = true
+
+			schedules, err := s.schedules(file, location)
+			if err != nil {
+				if len(loaded.schedules[file]) > 0 {
+					err = errors.Join(err, fmt.Errorf("%s keeps its last valid schedules until it is fixed", file))
+				}
+
+				report(file, err)
+				continue
+			}
+
+			report(file, nil)
+			loaded.schedules[file] = schedules
+		}
+
+		// Removed files take their schedules with them
+		for file := range loaded.schedules {
+			if !files[file] {
+				delete(loaded.schedules, file)
+			}
+		}
+		for key := range loaded.errors {
+			if key != directory && !files[key] {
+				delete(loaded.errors, key)
+			}
+		}
+	}
+
+	files := lo.Keys(loaded.schedules)
+	sort.Strings(files)
+
+	schedules := []scheduledRun{}
+	for _, file := range files {
+		schedules = append(schedules, loaded.schedules[file]...)
+	}
+
+	return schedules, errors.Join(errs...)
+}
+
+// Every schedule of a workflow file
+func (s *Scheduler) schedules(file string, location *time.Location) ([]scheduledRun, error) {
+	wc, err := s.workflow.Load(file)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules := []scheduledRun{}
+
+	// Validation already checked the expressions, timezones and jitters
+	for i, schedule := range wc.On.Schedule {
+		cron, _ := ParseCron(schedule.Cron)
+
+		scheduleLocation := location
+		if schedule.Timezone != "" {
+			scheduleLocation, _ = time.LoadLocation(schedule.Timezone)
+		}
+
+		jitter := time.Duration(0)
+		if schedule.Jitter != "" {
+			jitter, _ = time.ParseDuration(schedule.Jitter)
+		}
+
+		schedules = append(schedules, scheduledRun{
+			key:      fmt.Sprintf("%s#%d", file, i),
+			config:   *wc,
+			schedule: schedule,
+			cron:     cron,
+			location: scheduleLocation,
+			jitter:   jitter,
+		})
+	}
+
+	return schedules, nil
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		workflow:  NewWorkflow(),
+		inventory: NewInventory(),
+		agent:     NewAgent(),
+	}
+}
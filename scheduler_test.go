@@ -0,0 +1,72 @@
+package storm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scheduledWorkflow(cron string) string {
+	return "name: nightly\non:\n  schedule:\n    - cron: \"" + cron + "\"\njobs:\n  - name: j\n    steps:\n      - name: s\n        run: echo s\n"
+}
+
+func TestSchedulerReload(t *testing.T) {
+	dir := writeWorkflowFiles(t, map[string]string{
+		"nightly.yaml": scheduledWorkflow("0 2 * * *"),
+		"broken.yaml":  "name: broken\njobs: {}\n",
+	})
+
+	write := func(name string, content string) func() {
+		return func() { os.WriteFile(filepath.Join(dir, name), []byte(content), 0644) }
+	}
+	remove := func(name string) func() {
+		return func() { os.RemoveAll(filepath.Join(dir, name)) }
+	}
+
+	// Each reload sees the changes of its step and the previous ones
+	steps := []struct {
+		name   string
+		change func()
+		crons  []string
+		errors []string
+	}{
+		{"first load", func() {}, []string{"0 2 * * *"}, []string{"broken.yaml"}},
+		{"same error", func() {}, []string{"0 2 * * *"}, nil},
+		{"broken schedule", write("nightly.yaml", scheduledWorkflow("0 25 * * *")), []string{"0 2 * * *"}, []string{"nightly.yaml", "keeps its last valid schedules"}},
+		{"still broken", func() {}, []string{"0 2 * * *"}, nil},
+		{"fixed", write("nightly.yaml", scheduledWorkflow("0 3 * * *")), []string{"0 3 * * *"}, nil},
+		{"other error", write("broken.yaml", "name: ["), []string{"0 3 * * *"}, []string{"broken.yaml"}},
+		{"removed", remove("nightly.yaml"), []string{}, nil},
+		{"removed directory", remove(""), []string{}, []string{"could not read workflows directory"}},
+		{"still removed", func() {}, []string{}, nil},
+	}
+
+	scheduler := NewScheduler()
+	loaded := newLoadedSchedules()
+
+	for _, step := range steps {
+		step.change()
+
+		schedules, err := scheduler.reload(loaded, dir, time.UTC)
+
+		crons := []string{}
+		for _, schedule := range schedules {
+			crons = append(crons, schedule.schedule.Cron)
+		}
+		if !reflect.DeepEqual(crons, step.crons) {
+			t.Errorf("%s: got schedules %v, want %v", step.name, crons, step.crons)
+		}
+
+		if (err == nil) != (step.errors == nil) {
+			t.Fatalf("%s: got error %v, want one mentioning %v", step.name, err, step.errors)
+		}
+		for _, text := range step.errors {
+			if !strings.Contains(err.Error(), text) {
+				t.Errorf("%s: got error %q, want it to contain %q", step.name, err.Error(), text)
+			}
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package storm
+
+//go:generate go run ./cmd/schemagen
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+const jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+//go:embed schema.workflow.json
+var workflowSchema []byte
+
+// Files included by steps
+//
+//go:embed schema.steps.json
+var stepsSchema []byte
+
+//go:embed schema.action.json
+var actionSchema []byte
+
+//go:embed schema.inventory.json
+var inventorySchema []byte
+
+// A JSON object that keeps its keys in insertion order when marshalled
+type orderedObject struct {
+	keys   []string
+	values map[string]any
+}
+
+func newOrderedObject() *orderedObject {
+	return &orderedObject{values: map[string]any{}}
+}
+
+func (o *orderedObject) Set(key string, value any) {
+	if _, found := o.values[key]; !found {
+		o.keys = append(o.keys, key)
+	}
+
+	o.values[key] = value
+}
+
+// Set a key right after another one, e.g. a description after the type
+func (o *orderedObject) SetAfter(after string, key string, value any) {
+	o.Set(key, value)
+
+	index := lo.IndexOf(o.keys, after)
+	if index < 0 {
+		return
+	}
+
+	keys := lo.Without(o.keys, key)
+	o.keys = append(append(append([]string{}, keys[:index+1]...), key), keys[index+1:]...)
+}
+
+func (o *orderedObject) MarshalJSON() ([]byte, error) {
+	buffer := bytes.Buffer{}
+	buffer.WriteByte('{')
+
+	for i, key := range o.keys {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+
+		keyJson, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+
+		valueJson, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+
+		buffer.Write(keyJson)
+		buffer.WriteByte(':')
+		buffer.Write(valueJson)
+	}
+
+	buffer.WriteByte('}')
+
+	return buffer.Bytes(), nil
+}
+
+// Implemented by types that need more than their fields describe, e.g. a
+// choice between two fields
+type schemaExtender interface {
+	extendSchema(schema *orderedObject)
+}
+
+// Generate the JSON schema of a config type from its fields; the field tags
+// used are
+//
+//	yaml:"name"                 => property name
+//	description:"..."           => property description
+//	schema:"required,minimum=1" => `required` or any schema keyword with its value as JSON
+func GenerateSchema(title string, v any) ([]byte, error) {
+	schema := typeSchema(reflect.TypeOf(v))
+	schema.Set("$schema", jsonSchemaDraft)
+	schema.Set("title", title)
+
+	// Keep the header at the top of the file
+	schema.keys = append([]string{"$schema", "title"}, lo.Without(schema.keys, "$schema", "title")...)
+
+	out, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(out, '\n'), nil
+}
+
+func typeSchema(t reflect.Type) *orderedObject {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	schema := newOrderedObject()
+
+	switch t.Kind() {
+	case reflect.Struct:
+		schema.Set("type", "object")
+
+		properties := newOrderedObject()
+		required := []string{}
+
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+
+			property := typeSchema(field.Type)
+			if description := field.Tag.Get("description"); description != "" {
+				property.SetAfter("type", "description", description)
+			}
+
+			for _, option := range strings.Split(field.Tag.Get("schema"), ",") {
+				keyword, value, hasValue := strings.Cut(option, "=")
+
+				switch {
+				case keyword == "":
+				case keyword == "required":
+					required = append(required, name)
+				case hasValue:
+					var parsed any
+					if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+						parsed = value
+					}
+					property.Set(keyword, parsed)
+				}
+			}
+
+			properties.Set(name, property)
+		}
+
+		schema.Set("properties", properties)
+		if len(required) > 0 {
+			schema.Set("required", required)
+		}
+		schema.Set("additionalProperties", false)
+	case reflect.Slice, reflect.Array:
+		schema.Set("type", "array")
+		schema.Set("items", typeSchema(t.Elem()))
+	case reflect.Map:
+		schema.Set("type", "object")
+		schema.Set("additionalProperties", typeSchema(t.Elem()))
+	case reflect.String:
+		schema.Set("type", "string")
+	case reflect.Bool:
+		schema.Set("type", "boolean")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema.Set("type", "integer")
+	case reflect.Float32, reflect.Float64:
+		schema.Set("type", "number")
+	}
+
+	if extender, ok := reflect.New(t).Interface().(schemaExtender); ok {
+		extender.extendSchema(schema)
+	}
+
+	return schema
+}
+
+// Check a yaml document against a (subset of) JSON schema; supports `type`,
+// `properties`, `required`, `additionalProperties`, `items`, `enum`,
+// `minimum`, `maximum`, `minLength`, `minItems`, `pattern`, `anyOf` and
+// `oneOf`
+func validateSchema(file string, root *yaml.Node, schema []byte) Diagnostics {
+	parsed := map[string]any{}
+
+	err := json.Unmarshal(schema, &parsed)
+	if err != nil {
+		return Diagnostics{{File: file, Message: fmt.Sprintf("invalid schema: %s", err)}}
+	}
+
+	c := diagnosticCollector{file: file}
+	schemaNode(&c, root, parsed, "")
+
+	return c.result()
+}
+
+func schemaNode(c *diagnosticCollector, node *yaml.Node, schema map[string]any, path string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	at := func(n *yaml.Node, message string, args ...any) {
+		message = fmt.Sprintf(message, args...)
+		if path != "" {
+			message = path + ": " + message
+		}
+
+		c.diagnostics = append(c.diagnostics, Diagnostic{
+			File:    c.file,
+			Line:    n.Line,
+			Column:  n.Column,
+			Message: message,
+		})
+	}
+
+	if expected, ok := schema["type"].(string); ok && !nodeIsType(node, expected) {
+		at(node, "expected %s, got %s", expected, describeNode(node))
+		return
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		if !lo.ContainsBy(enum, func(option any) bool { return fmt.Sprint(option) == node.Value }) {
+			options := lo.Map(enum, func(option any, _ int) string { return fmt.Sprint(option) })
+			at(node, "%q is not one of %s", node.Value, strings.Join(options, ", "))
+		}
+	}
+
+	if minLength, ok := schema["minLength"].(float64); ok && node.Kind == yaml.ScalarNode && float64(len(node.Value)) < minLength {
+		at(node, lo.Ternary(minLength == 1, "must not be empty", fmt.Sprintf("must be at least %v characters long", minLength)))
+	}
+
+	if minItems, ok := schema["minItems"].(float64); ok && node.Kind == yaml.SequenceNode && float64(len(node.Content)) < minItems {
+		at(node, lo.Ternary(minItems == 1, "must not be empty", fmt.Sprintf("must have at least %v items", minItems)))
+	}
+
+	if node.Kind == yaml.ScalarNode {
+		if number, err := strconv.ParseFloat(node.Value, 64); err == nil {
+			if minimum, ok := schema["minimum"].(float64); ok && number < minimum {
+				at(node, "%s is less than the minimum of %v", node.Value, minimum)
+			}
+			if maximum, ok := schema["maximum"].(float64); ok && number > maximum {
+				at(node, "%s is greater than the maximum of %v", node.Value, maximum)
+			}
+		}
+
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(node.Value) {
+				at(node, "%q does not match %s", node.Value, pattern)
+			}
+		}
+	}
+
+	if node.Kind == yaml.MappingNode {
+		properties, _ := schema["properties"].(map[string]any)
+		present := map[string]bool{}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			present[key.Value] = true
+
+			if property, ok := properties[key.Value].(map[string]any); ok {
+				schemaNode(c, value, property, joinSchemaPath(path, key.Value))
+				continue
+			}
+
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					expected := lo.Keys(properties)
+					sort.Strings(expected)
+					at(key, "unknown field %q; expected one of %s", key.Value, strings.Join(expected, ", "))
+				}
+			case map[string]any:
+				schemaNode(c, value, additional, joinSchemaPath(path, key.Value))
+			}
+		}
+
+		if required, ok := schema["required"].([]any); ok {
+			for _, name := range required {
+				if !present[fmt.Sprint(name)] {
+					at(node, "missing required field %q", name)
+				}
+			}
+		}
+	}
+
+	if node.Kind == yaml.SequenceNode {
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range node.Content {
+				schemaNode(c, item, items, joinSchemaPath(path, strconv.Itoa(i)))
+			}
+		}
+	}
+
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		options, ok := schema[keyword].([]any)
+		if !ok {
+			continue
+		}
+
+		matches := lo.CountBy(options, func(option any) bool {
+			optionSchema, _ := option.(map[string]any)
+			trial := diagnosticCollector{file: c.file}
+			schemaNode(&trial, node, optionSchema, "")
+
+			return len(trial.diagnostics) == 0
+		})
+
+		if matches == 0 || (keyword == "oneOf" && matches > 1) {
+			at(node, "must match %s of: %s", lo.Ternary(keyword == "oneOf", "exactly one", "at least one"), describeSchemaOptions(options))
+		}
+	}
+}
+
+func nodeIsType(node *yaml.Node, expected string) bool {
+	switch expected {
+	case "object":
+		return node.Kind == yaml.MappingNode
+	case "array":
+		return node.Kind == yaml.SequenceNode
+	case "string":
+		return node.Kind == yaml.ScalarNode && node.Tag != "!!null"
+	case "integer":
+		return node.Kind == yaml.ScalarNode && node.Tag == "!!int"
+	case "number":
+		return node.Kind == yaml.ScalarNode && (node.Tag == "!!int" || node.Tag == "!!float")
+	case "boolean":
+		return node.Kind == yaml.ScalarNode && node.Tag == "!!bool"
+	case "null":
+		return node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+	default:
+		return true
+	}
+}
+
+func joinSchemaPath(path string, segment string) string {
+	if path == "" {
+		return segment
+	}
+
+	return path + "." + segment
+}
+
+// Describe `anyOf` / `oneOf` options by their required fields, e.g.
+// `{ssh-pass} or {private-ssh-key}`
+func describeSchemaOptions(options []any) string {
+	descriptions := lo.Map(options, func(option any, _ int) string {
+		optionSchema, _ := option.(map[string]any)
+		required, _ := optionSchema["required"].([]any)
+
+		return "{" + strings.Join(lo.Map(required, func(r any, _ int) string { return fmt.Sprint(r) }), ", ") + "}"
+	})
+
+	return strings.Join(descriptions, " or ")
+}
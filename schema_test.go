@@ -0,0 +1,175 @@
+package storm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+const testSchema = `{
+	"type": "object",
+	"additionalProperties": false,
+	"required": ["name"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"port": {"type": "integer", "minimum": 1, "maximum": 65535},
+		"ratio": {"type": "number"},
+		"enabled": {"type": "boolean"},
+		"mode": {"type": "string", "enum": ["prod", "dev"]},
+		"version": {"type": "string", "pattern": "^v[0-9]+$"},
+		"tags": {"type": "array", "minItems": 1, "items": {"type": "string"}},
+		"env": {"type": "object", "additionalProperties": {"type": "string"}},
+		"auth": {
+			"type": "object",
+			"oneOf": [{"required": ["password"]}, {"required": ["key"]}]
+		},
+		"source": {
+			"anyOf": [{"type": "string"}, {"type": "object", "required": ["url"]}]
+		}
+	}
+}`
+
+func validateTestSchema(t *testing.T, document string) []string {
+	t.Helper()
+
+	root, diagnostics := parseYaml("test.yaml", []byte(document))
+	if len(diagnostics) > 0 {
+		t.Fatalf("invalid test document: %v", diagnostics)
+	}
+
+	return diagnosticTexts(validateSchema("test.yaml", root, []byte(testSchema)))
+}
+
+func diagnosticTexts(diagnostics Diagnostics) []string {
+	texts := []string{}
+	for _, diagnostic := range diagnostics {
+		texts = append(texts, diagnostic.String())
+	}
+
+	return texts
+}
+
+func TestValidateSchema(t *testing.T) {
+	tests := []struct {
+		name        string
+		document    string
+		diagnostics []string
+	}{
+		{
+			name:        "valid",
+			document:    "name: api\nport: 8080\nratio: 0.5\nenabled: true\nmode: prod\nversion: v2\ntags: [a, b]\nenv:\n  A: x\nauth:\n  key: ~/.ssh/id\nsource: ./src\n",
+			diagnostics: []string{},
+		},
+		{
+			name:        "missing required field",
+			document:    "port: 22\n",
+			diagnostics: []string{`test.yaml:1:1: missing required field "name"`},
+		},
+		{
+			name:        "unknown field",
+			document:    "name: api\nprot: 22\n",
+			diagnostics: []string{`test.yaml:2:1: unknown field "prot"; expected one of auth, enabled, env, mode, name, port, ratio, source, tags, version`},
+		},
+		{
+			name:        "types",
+			document:    "name: [api]\nport: \"22\"\nratio: fast\nenabled: yes please\ntags: a\n",
+			diagnostics: []string{`test.yaml:1:7: name: expected string, got a list`, `test.yaml:2:7: port: expected integer, got "22"`, `test.yaml:3:8: ratio: expected number, got "fast"`, `test.yaml:4:10: enabled: expected boolean, got "yes please"`, `test.yaml:5:7: tags: expected array, got "a"`},
+		},
+		{
+			name:        "null is not a string",
+			document:    "name:\n",
+			diagnostics: []string{`test.yaml:1:6: name: expected string, got ""`},
+		},
+		{
+			name:        "bounds",
+			document:    "name: ''\nport: 70000\ntags: []\n",
+			diagnostics: []string{"test.yaml:1:7: name: must not be empty", "test.yaml:2:7: port: 70000 is greater than the maximum of 65535", "test.yaml:3:7: tags: must not be empty"},
+		},
+		{
+			name:        "minimum",
+			document:    "name: api\nport: 0\n",
+			diagnostics: []string{"test.yaml:2:7: port: 0 is less than the minimum of 1"},
+		},
+		{
+			name:        "enum, and scalars read as strings",
+			document:    "name: api\nmode: staging\nversion: 2.0\n",
+			diagnostics: []string{`test.yaml:2:7: mode: "staging" is not one of prod, dev`, `test.yaml:3:10: version: "2.0" does not match ^v[0-9]+$`},
+		},
+		{
+			name:        "pattern",
+			document:    "name: api\nversion: two\n",
+			diagnostics: []string{`test.yaml:2:10: version: "two" does not match ^v[0-9]+$`},
+		},
+		{
+			name:        "items and additional properties",
+			document:    "name: api\ntags: [a, [b]]\nenv:\n  A: [x]\n",
+			diagnostics: []string{"test.yaml:2:11: tags.1: expected string, got a list", "test.yaml:4:6: env.A: expected string, got a list"},
+		},
+		{
+			name:        "one of, none",
+			document:    "name: api\nauth: {}\n",
+			diagnostics: []string{"test.yaml:2:7: auth: must match exactly one of: {password} or {key}"},
+		},
+		{
+			name:        "one of, both",
+			document:    "name: api\nauth:\n  password: x\n  key: y\n",
+			diagnostics: []string{"test.yaml:3:3: auth: must match exactly one of: {password} or {key}"},
+		},
+		{
+			name:        "any of",
+			document:    "name: api\nsource: {path: x}\n",
+			diagnostics: []string{"test.yaml:2:9: source: must match at least one of: {} or {url}"},
+		},
+		{
+			name:        "aliases",
+			document:    "name: &name api\nmode: *name\n",
+			diagnostics: []string{`test.yaml:1:7: mode: "api" is not one of prod, dev`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diagnostics := validateTestSchema(t, test.document); !reflect.DeepEqual(diagnostics, test.diagnostics) {
+				t.Errorf("got %q, want %q", diagnostics, test.diagnostics)
+			}
+		})
+	}
+}
+
+func TestValidateSchemaInvalidSchema(t *testing.T) {
+	root := &yaml.Node{Kind: yaml.ScalarNode, Value: "x"}
+
+	diagnostics := validateSchema("test.yaml", root, []byte("{"))
+	if len(diagnostics) != 1 || diagnostics[0].File != "test.yaml" {
+		t.Errorf("got %v, want a single diagnostic for the schema", diagnostics)
+	}
+}
+
+// The samples are what users copy from; they must pass the embedded schemas
+func TestSamplesMatchSchemas(t *testing.T) {
+	files, _ := filepath.Glob("samples/*.yaml")
+	nested, _ := filepath.Glob("samples/*/*.yaml")
+	files = append(files, nested...)
+	if len(files) == 0 {
+		t.Fatal("no samples found")
+	}
+
+	for _, file := range files {
+		schema := lo.Ternary(filepath.Base(file) == "inventory.yaml", inventorySchema, workflowSchema)
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		root, diagnostics := parseYaml(file, content)
+		diagnostics = append(diagnostics, validateSchema(file, root, schema)...)
+		if len(diagnostics) > 0 {
+			t.Errorf("%s: %v", file, diagnostics)
+		}
+	}
+}
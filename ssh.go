@@ -1,14 +1,17 @@
 package storm
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
@@ -22,6 +25,9 @@ type AuthenticateArgs struct {
 	Host          string
 	Port          int
 	PrivateSshKey string
+
+	// How long to wait for the connection; no limit when zero
+	Timeout time.Duration
 }
 
 func (s *Ssh) Authenticate(args AuthenticateArgs) (*ssh.Client, error) {
@@ -46,6 +52,7 @@ func (s *Ssh) Authenticate(args AuthenticateArgs) (*ssh.Client, error) {
 		Auth: signers,
 		// TODO: For production, use a more secure host key callback
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         args.Timeout,
 	}
 
 	// Connect to the SSH server
@@ -141,20 +148,122 @@ func (s *Ssh) CreateDirectory(sftpClient *sftp.Client, dirPath string) error {
 	return nil
 }
 
-// writerFunc is a helper that turns a callback function into an io.Writer.
-func writerFunc(callback func(string)) io.Writer {
-	return writerFuncImpl{callback: callback}
+// Resolve the remote user's home directory; the SFTP server starts in it
+func (s *Ssh) HomeDirectory(client *ssh.Client) (string, error) {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return "", fmt.Errorf("failed to create SFTP client: %w", err)
+	}
+	defer sftpClient.Close()
+
+	home, err := sftpClient.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve remote home directory: %w", err)
+	}
+
+	return home, nil
+}
+
+// Create a directory (and its parents) on the remote server that is only
+// accessible by the remote user
+func (s *Ssh) CreatePrivateDirectory(client *ssh.Client, dirPath string) error {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return fmt.Errorf("failed to create SFTP client: %w", err)
+	}
+	defer sftpClient.Close()
+
+	if err := s.CreateDirectory(sftpClient, dirPath); err != nil {
+		return err
+	}
+
+	if err := sftpClient.Chmod(dirPath, 0700); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w", dirPath, err)
+	}
+
+	return nil
+}
+
+// Write content to a file on the remote server with the given permissions
+func (s *Ssh) WriteFile(client *ssh.Client, content []byte, destination string, perm os.FileMode) error {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return fmt.Errorf("failed to create SFTP client: %w", err)
+	}
+	defer sftpClient.Close()
+
+	remoteFile, err := sftpClient.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("failed to create remote file %s: %w", destination, err)
+	}
+	defer remoteFile.Close()
+
+	// Restrict permissions before anything is written
+	if err := remoteFile.Chmod(perm); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w", destination, err)
+	}
+
+	if _, err := remoteFile.Write(content); err != nil {
+		return fmt.Errorf("failed to write remote file %s: %w", destination, err)
+	}
+
+	return nil
+}
+
+// Remove a file or directory tree from the remote server
+func (s *Ssh) RemoveAll(client *ssh.Client, target string) error {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return fmt.Errorf("failed to create SFTP client: %w", err)
+	}
+	defer sftpClient.Close()
+
+	return s.removeAll(sftpClient, target)
+}
+
+func (s *Ssh) removeAll(sftpClient *sftp.Client, target string) error {
+	info, err := sftpClient.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		entries, err := sftpClient.ReadDir(target)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := s.removeAll(sftpClient, path.Join(target, entry.Name())); err != nil {
+				return err
+			}
+		}
+
+		return sftpClient.RemoveDirectory(target)
+	}
+
+	return sftpClient.Remove(target)
 }
 
-type writerFuncImpl struct {
-	callback func(string)
+// Quote a string so it is passed as a single word to a POSIX shell
+func ShellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
 }
 
-func (w writerFuncImpl) Write(p []byte) (n int, err error) {
-	trimmedLine := strings.TrimSpace(string(p))
-	w.callback(string(trimmedLine))
+// Stream a pipe line by line to a callback while keeping a copy of everything
+// that was read
+func streamLines(reader io.Reader, buffer *bytes.Buffer, callback func(string)) error {
+	scanner := bufio.NewScanner(io.TeeReader(reader, buffer))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	for scanner.Scan() {
+		callback(strings.TrimRight(scanner.Text(), "\r"))
+	}
 
-	return len(p), nil
+	return scanner.Err()
 }
 
 type ExecuteCommandArgs struct {
@@ -191,16 +300,12 @@ func (s *Ssh) ExecuteCommand(args ExecuteCommandArgs) (string, string, error) {
 
 	// Stream stdout
 	go func() {
-		multiWriter := io.MultiWriter(&stdoutBuf, writerFunc(args.OutputCallback))
-		_, err := io.Copy(multiWriter, stdoutPipe)
-		doneOut <- err
+		doneOut <- streamLines(stdoutPipe, &stdoutBuf, args.OutputCallback)
 	}()
 
 	// Stream stderr
 	go func() {
-		multiWriter := io.MultiWriter(&stderrBuf, writerFunc(args.ErrorCallback))
-		_, err := io.Copy(multiWriter, stderrPipe)
-		doneErr <- err
+		doneErr <- streamLines(stderrPipe, &stderrBuf, args.ErrorCallback)
 	}()
 
 	// Run the command
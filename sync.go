@@ -0,0 +1,560 @@
+package storm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"github.com/samber/lo"
+)
+
+// Suffix of files being synced, hidden next to the file they replace once
+// complete; an interrupted sync resumes from them
+const syncPartialSuffix = ".storm-partial"
+
+type SyncArgs struct {
+	CopyArgs
+
+	// Remove what the destination has and the source does not; excluded paths
+	// are kept
+	Delete bool
+
+	// Compare files by SHA-256 instead of size and modification time; needs
+	// sha256sum on the server
+	Checksum bool
+}
+
+type SyncResult struct {
+	Server string
+
+	Transferred int
+	Unchanged   int
+	Deleted     int
+
+	// Bytes sent; resumed files only count what was left
+	Bytes int64
+}
+
+// Make a remote directory a copy of a local one, sending only the files that
+// changed. Files are written next to their destination and renamed into
+// place once complete, so an interrupted sync leaves no half written files
+// and picks up where it stopped. Permissions and modification times are
+// always kept, the next sync compares against them.
+func (s *Ssh) SyncDirTo(args SyncArgs) (SyncResult, error) {
+	result := SyncResult{}
+	args.Destination = path.Clean(args.Destination)
+
+	info, err := os.Stat(args.Source)
+	if err != nil {
+		return result, err
+	}
+	if !info.IsDir() {
+		return result, fmt.Errorf("%s is not a directory", args.Source)
+	}
+
+	sftpClient, err := sftp.NewClient(args.Client, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		return result, fmt.Errorf("failed to create SFTP client: %w", err)
+	}
+	defer sftpClient.Close()
+
+	sc := syncer{ssh: s, client: sftpClient, args: args, visited: map[string]bool{}}
+
+	local := map[string]syncEntry{"": {path: args.Source, info: info}}
+	if err := sc.walkLocal(args.Source, "", local); err != nil {
+		return result, err
+	}
+
+	remote, partials, err := sc.walkRemote()
+	if err != nil {
+		return result, err
+	}
+
+	checksums := map[string]string{}
+	if args.Checksum && len(remote) > 0 {
+		if checksums, err = sc.remoteChecksums(); err != nil {
+			return result, err
+		}
+	}
+
+	names := lo.Keys(local)
+	sort.Strings(names)
+
+	for _, name := range names {
+		entry := local[name]
+		destination := path.Join(args.Destination, name)
+		existing, exists := remote[name]
+
+		switch {
+		case entry.link != "":
+			if exists && existing.Mode()&fs.ModeSymlink != 0 {
+				if target, err := sftpClient.ReadLink(destination); err == nil && target == entry.link {
+					result.Unchanged++
+					continue
+				}
+			}
+
+			if err := sc.replace(destination, exists); err != nil {
+				return result, err
+			}
+			if err := sftpClient.Symlink(entry.link, destination); err != nil {
+				return result, fmt.Errorf("failed to link %s: %w", destination, err)
+			}
+			result.Transferred++
+		case entry.info.IsDir():
+			if exists && existing.IsDir() {
+				continue
+			}
+
+			if err := sc.replace(destination, exists); err != nil {
+				return result, err
+			}
+			if err := sftpClient.MkdirAll(destination); err != nil {
+				return result, fmt.Errorf("failed to create directory %s: %w", destination, err)
+			}
+		default:
+			unchanged, err := sc.unchanged(entry, existing, exists, checksums[name])
+			if err != nil {
+				return result, err
+			}
+
+			if unchanged {
+				result.Unchanged++
+
+				if err := sc.preserve(destination, entry.info, existing); err != nil {
+					return result, err
+				}
+
+				continue
+			}
+
+			if exists && !existing.Mode().IsRegular() {
+				if err := sc.replace(destination, exists); err != nil {
+					return result, err
+				}
+			}
+
+			sent, err := sc.upload(name, entry, destination)
+			if err != nil {
+				return result, err
+			}
+
+			result.Transferred++
+			result.Bytes += sent
+		}
+	}
+
+	if args.Delete {
+		deleted, err := sc.deleteExtraneous(local, remote, partials)
+		if err != nil {
+			return result, err
+		}
+
+		result.Deleted = deleted
+	}
+
+	// Writing entries changes the modification time of directories, they are
+	// set last, deepest first
+	for i := len(names) - 1; i >= 0; i-- {
+		entry := local[names[i]]
+		if entry.link == "" && entry.info.IsDir() {
+			if err := sc.preserve(path.Join(args.Destination, names[i]), entry.info, nil); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// A file, directory or link of the source
+type syncEntry struct {
+	path string
+	info fs.FileInfo
+
+	// Target of a link that is kept as a link
+	link string
+}
+
+type syncer struct {
+	ssh    *Ssh
+	client *sftp.Client
+	args   SyncArgs
+
+	// Real paths of the directories being walked, when following symlinks
+	visited map[string]bool
+}
+
+// Collect the entries of a local directory that are synced, by their path
+// relative to the source
+func (sc *syncer) walkLocal(directory string, relative string, entries map[string]syncEntry) error {
+	if sc.args.Symlinks == SymlinksFollow {
+		real, err := filepath.EvalSymlinks(directory)
+		if err != nil {
+			return err
+		}
+		if sc.visited[real] {
+			return nil
+		}
+
+		sc.visited[real] = true
+		defer delete(sc.visited, real)
+	}
+
+	children, err := os.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		childPath := filepath.Join(directory, child.Name())
+		childRelative := path.Join(relative, child.Name())
+
+		// Partial files on the server must not be confused with the source's
+		if strings.HasSuffix(child.Name(), syncPartialSuffix) || matchCopyGlobs(sc.args.Exclude, childRelative) {
+			continue
+		}
+
+		info, err := child.Info()
+		if err != nil {
+			return err
+		}
+
+		entry := syncEntry{path: childPath, info: info}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			switch sc.args.Symlinks {
+			case SymlinksSkip:
+				continue
+			case SymlinksFollow:
+				if entry.info, err = os.Stat(childPath); err != nil {
+					return fmt.Errorf("broken symlink %s: %w", childPath, err)
+				}
+			default:
+				if entry.link, err = os.Readlink(childPath); err != nil {
+					return err
+				}
+			}
+		}
+
+		isDir := entry.link == "" && entry.info.IsDir()
+
+		if (!isDir && entry.link == "" && !entry.info.Mode().IsRegular()) || sc.excluded(childRelative, isDir) {
+			continue
+		}
+
+		entries[childRelative] = entry
+
+		if isDir {
+			if err := sc.walkLocal(childPath, childRelative, entries); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Whether include and exclude patterns leave a path out; included patterns
+// only apply to files, directories are entered to look for them
+func (sc *syncer) excluded(relative string, isDir bool) bool {
+	if matchCopyGlobs(sc.args.Exclude, relative) {
+		return true
+	}
+
+	return !isDir && len(sc.args.Include) > 0 && !matchCopyGlobs(sc.args.Include, relative)
+}
+
+// Entries of the destination by their path relative to it, and the partial
+// files of interrupted syncs; an empty map when it does not exist yet
+func (sc *syncer) walkRemote() (map[string]fs.FileInfo, []string, error) {
+	entries := map[string]fs.FileInfo{}
+	partials := []string{}
+
+	if _, err := sc.client.Lstat(sc.args.Destination); os.IsNotExist(err) {
+		return entries, partials, nil
+	}
+
+	// Walked paths are joined to the destination, "." is dropped by the join
+	prefix := lo.Ternary(sc.args.Destination == ".", "", strings.TrimSuffix(sc.args.Destination, "/")+"/")
+
+	walker := sc.client.Walk(sc.args.Destination)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		relative := ""
+		if walker.Path() != sc.args.Destination {
+			relative = strings.TrimPrefix(walker.Path(), prefix)
+		}
+
+		if strings.HasSuffix(relative, syncPartialSuffix) {
+			partials = append(partials, relative)
+			continue
+		}
+
+		entries[relative] = walker.Stat()
+	}
+
+	return entries, partials, nil
+}
+
+// SHA-256 of every file of the destination, by path relative to it
+func (sc *syncer) remoteChecksums() (map[string]string, error) {
+	command := fmt.Sprintf(
+		"cd %s && find . -type f ! -name '*%s' -print0 | xargs -0 -r sha256sum --",
+		ShellQuote(sc.args.Destination), syncPartialSuffix,
+	)
+
+	stdout, stderr, err := sc.ssh.ExecuteCommand(ExecuteCommandArgs{
+		Client:         sc.args.Client,
+		Command:        command,
+		OutputCallback: func(string) {},
+		ErrorCallback:  func(string) {},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not checksum %s: %w; %s", sc.args.Destination, err, strings.TrimSpace(stderr))
+	}
+
+	checksums := map[string]string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		checksum, file, found := strings.Cut(line, "  ")
+		if found {
+			checksums[strings.TrimPrefix(file, "./")] = checksum
+		}
+	}
+
+	return checksums, nil
+}
+
+// Whether the destination already has the file's content
+func (sc *syncer) unchanged(entry syncEntry, existing fs.FileInfo, exists bool, checksum string) (bool, error) {
+	if !exists || !existing.Mode().IsRegular() || existing.Size() != entry.info.Size() {
+		return false, nil
+	}
+
+	if !sc.args.Checksum {
+		return existing.ModTime().Unix() == entry.info.ModTime().Unix(), nil
+	}
+
+	local, err := fileChecksum(entry.path, -1)
+	if err != nil {
+		return false, err
+	}
+
+	return local == checksum, nil
+}
+
+// Send a file through its partial file, resuming an interrupted sync when the
+// partial file holds the beginning of the file; returns the bytes sent
+func (sc *syncer) upload(relative string, entry syncEntry, destination string) (int64, error) {
+	partial := path.Join(path.Dir(destination), "."+path.Base(destination)+syncPartialSuffix)
+	offset := sc.resumeOffset(entry, partial)
+
+	source, err := os.Open(entry.path)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	file, err := sc.client.OpenFile(partial, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", partial, err)
+	}
+
+	err = file.Truncate(offset)
+	if err == nil {
+		_, err = source.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return 0, fmt.Errorf("failed to resume %s: %w", destination, err)
+	}
+
+	reader := &progressReader{
+		reader:   source,
+		progress: CopyProgress{File: relative, Size: entry.info.Size(), Copied: offset},
+		callback: sc.args.Progress,
+	}
+
+	sent, err := io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return sent, fmt.Errorf("failed to send %s: %w", entry.path, err)
+	}
+
+	if err := sc.preserve(partial, entry.info, nil); err != nil {
+		return sent, err
+	}
+
+	if err := sc.rename(partial, destination); err != nil {
+		return sent, err
+	}
+
+	reader.done()
+
+	return sent, nil
+}
+
+// How much of a partial file can be kept; none unless it matches the
+// beginning of the file
+func (sc *syncer) resumeOffset(entry syncEntry, partial string) int64 {
+	info, err := sc.client.Stat(partial)
+	if err != nil || info.Size() == 0 || info.Size() > entry.info.Size() {
+		return 0
+	}
+
+	// Parallel writes can leave holes in an interrupted file, its size alone
+	// proves nothing
+	stdout, _, err := sc.ssh.ExecuteCommand(ExecuteCommandArgs{
+		Client:         sc.args.Client,
+		Command:        "sha256sum -- " + ShellQuote(partial),
+		OutputCallback: func(string) {},
+		ErrorCallback:  func(string) {},
+	})
+	if err != nil {
+		return 0
+	}
+
+	remote, _, _ := strings.Cut(stdout, " ")
+
+	local, err := fileChecksum(entry.path, info.Size())
+	if err != nil || local != remote {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// Rename over an existing file; servers without the POSIX rename extension
+// need the destination removed first
+func (sc *syncer) rename(from string, to string) error {
+	if _, ok := sc.client.HasExtension("posix-rename@openssh.com"); ok {
+		return sc.client.PosixRename(from, to)
+	}
+
+	if err := sc.client.Remove(to); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return sc.client.Rename(from, to)
+}
+
+// Remove what is in the way of an entry of another type
+func (sc *syncer) replace(destination string, exists bool) error {
+	if !exists {
+		return nil
+	}
+
+	return sc.ssh.removeAll(sc.client, destination)
+}
+
+// Give a remote entry the permissions and modification time of its source,
+// unless `existing` shows it already has them
+func (sc *syncer) preserve(destination string, info fs.FileInfo, existing fs.FileInfo) error {
+	if existing == nil || existing.Mode().Perm() != info.Mode().Perm() {
+		if err := sc.client.Chmod(destination, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to set permissions on %s: %w", destination, err)
+		}
+	}
+
+	if existing == nil || existing.ModTime().Unix() != info.ModTime().Unix() {
+		if err := sc.client.Chtimes(destination, info.ModTime(), info.ModTime()); err != nil {
+			return fmt.Errorf("failed to set modification time on %s: %w", destination, err)
+		}
+	}
+
+	return nil
+}
+
+// Remove the destination's entries the source does not have, and the partial
+// files left for them; excluded paths are kept
+func (sc *syncer) deleteExtraneous(local map[string]syncEntry, remote map[string]fs.FileInfo, partials []string) (int, error) {
+	names := lo.Filter(lo.Keys(remote), func(name string, _ int) bool {
+		_, found := local[name]
+		return !found && !sc.protected(name, remote[name].IsDir())
+	})
+
+	// Parents go first and take their children with them
+	sort.Strings(names)
+
+	deleted := 0
+	removed := []string{}
+
+	for _, name := range names {
+		if lo.ContainsBy(removed, func(parent string) bool { return strings.HasPrefix(name, parent+"/") }) {
+			continue
+		}
+
+		if err := sc.ssh.removeAll(sc.client, path.Join(sc.args.Destination, name)); err != nil {
+			return deleted, fmt.Errorf("failed to delete %s: %w", name, err)
+		}
+
+		deleted++
+		removed = append(removed, name)
+	}
+
+	for _, partial := range partials {
+		directory, base := path.Split(partial)
+		target := path.Join(directory, strings.TrimSuffix(strings.TrimPrefix(base, "."), syncPartialSuffix))
+
+		if _, found := local[target]; found || sc.protected(target, false) {
+			continue
+		}
+
+		// Gone with its directory already
+		if err := sc.client.Remove(path.Join(sc.args.Destination, partial)); err != nil && !os.IsNotExist(err) {
+			return deleted, fmt.Errorf("failed to delete %s: %w", partial, err)
+		}
+	}
+
+	return deleted, nil
+}
+
+// Whether a destination path, or one of its parents, is left out of the sync
+func (sc *syncer) protected(relative string, isDir bool) bool {
+	parts := strings.Split(relative, "/")
+
+	for i := 1; i < len(parts); i++ {
+		if matchCopyGlobs(sc.args.Exclude, strings.Join(parts[:i], "/")) {
+			return true
+		}
+	}
+
+	return sc.excluded(relative, isDir)
+}
+
+// Hex SHA-256 of a file's first `size` bytes, or of all of it when negative
+func fileChecksum(file string, size int64) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var reader io.Reader = f
+	if size >= 0 {
+		reader = io.LimitReader(f, size)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
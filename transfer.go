@@ -0,0 +1,308 @@
+package storm
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// Copies files between the local machine and the servers of an inventory
+type Transfer struct {
+	ssh       *Ssh
+	inventory *Inventory
+}
+
+type TransferArgs struct {
+	// Local paths, or `server:path` where server is a server's name or label;
+	// one side has to be local
+	Source      string
+	Destination string
+
+	Inventory string
+
+	// Copy directories
+	Recursive bool
+
+	Include  []string
+	Exclude  []string
+	Preserve bool
+	Symlinks string
+
+	// Servers copied to or from at the same time; all of them when zero
+	Parallel int
+
+	// Called as files are copied, with the server's name
+	Progress func(server string, progress CopyProgress)
+
+	// Sync only; see SyncArgs
+	Delete   bool
+	Checksum bool
+}
+
+// A side of a transfer; `Selector` picks the servers and is empty for local
+// paths
+type TransferPath struct {
+	Selector string
+	Path     string
+}
+
+// Parse a local path or `server:path`; a `:` after a `/` is part of a local
+// path
+func ParseTransferPath(value string) TransferPath {
+	selector, remotePath, found := strings.Cut(value, ":")
+	if !found || selector == "" || strings.Contains(selector, "/") {
+		return TransferPath{Path: value}
+	}
+
+	// SFTP starts in the home directory, relative paths are from there
+	remotePath = lo.Ternary(remotePath == "~", ".", strings.TrimPrefix(remotePath, "~/"))
+
+	return TransferPath{Selector: selector, Path: lo.Ternary(remotePath != "", remotePath, ".")}
+}
+
+func (p TransferPath) Remote() bool {
+	return p.Selector != ""
+}
+
+// Copy files to or from every server the remote side selects. Like cp,
+// copying into an existing directory keeps the source's name; copies from
+// several servers go into a directory per server.
+func (t *Transfer) Copy(args TransferArgs) error {
+	source := ParseTransferPath(args.Source)
+	destination := ParseTransferPath(args.Destination)
+
+	servers, err := t.servers(args, source, destination)
+	if err != nil {
+		return err
+	}
+
+	return t.eachServer(servers, args.Parallel, func(server Server, client *ssh.Client) error {
+		copyArgs := args.copyArgs(server, client)
+
+		if source.Remote() {
+			destinationPath := destination.Path
+			if len(servers) > 1 {
+				destinationPath = filepath.Join(destinationPath, server.Name)
+
+				// Copied into, the same way on every run
+				if err := os.MkdirAll(destinationPath, 0755); err != nil {
+					return err
+				}
+			}
+
+			return t.download(copyArgs, source.Path, destinationPath, args.Recursive)
+		}
+
+		return t.upload(copyArgs, source.Path, destination.Path, args.Recursive)
+	})
+}
+
+// Make a directory of every server the destination selects a copy of a local
+// directory, sending only what changed; results are those of the servers
+// that were synced
+func (t *Transfer) Sync(args TransferArgs) ([]SyncResult, error) {
+	source := ParseTransferPath(args.Source)
+	destination := ParseTransferPath(args.Destination)
+
+	if source.Remote() {
+		return nil, errors.New("sync goes from a local directory to server:path")
+	}
+
+	servers, err := t.servers(args, source, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	mutex := sync.Mutex{}
+	results := []SyncResult{}
+
+	err = t.eachServer(servers, args.Parallel, func(server Server, client *ssh.Client) error {
+		copyArgs := args.copyArgs(server, client)
+		copyArgs.Source, copyArgs.Destination = source.Path, destination.Path
+
+		result, err := t.ssh.SyncDirTo(SyncArgs{CopyArgs: copyArgs, Delete: args.Delete, Checksum: args.Checksum})
+		if err != nil {
+			return err
+		}
+
+		result.Server = server.Name
+
+		mutex.Lock()
+		results = append(results, result)
+		mutex.Unlock()
+
+		return nil
+	})
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Server < results[j].Server })
+
+	return results, err
+}
+
+// Copy arguments of a transfer, for one of its servers
+func (args TransferArgs) copyArgs(server Server, client *ssh.Client) CopyArgs {
+	copyArgs := CopyArgs{
+		Client:   client,
+		Include:  args.Include,
+		Exclude:  args.Exclude,
+		Preserve: args.Preserve,
+		Symlinks: args.Symlinks,
+	}
+
+	if args.Progress != nil {
+		copyArgs.Progress = func(progress CopyProgress) { args.Progress(server.Name, progress) }
+	}
+
+	return copyArgs
+}
+
+// Servers of the remote side of a transfer
+func (t *Transfer) servers(args TransferArgs, source TransferPath, destination TransferPath) ([]Server, error) {
+	if source.Remote() == destination.Remote() {
+		return nil, errors.New("one side has to be local and the other server:path")
+	}
+
+	if args.Inventory == "" {
+		return nil, errors.New("an inventory is required to copy to or from servers")
+	}
+
+	ic, err := t.inventory.Load(args.Inventory)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := lo.Ternary(source.Remote(), source.Selector, destination.Selector)
+
+	servers := ic.Select(selector)
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no server is named or labelled %s", selector)
+	}
+
+	return servers, nil
+}
+
+func (t *Transfer) upload(args CopyArgs, source string, destination string, recursive bool) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && !recursive {
+		return fmt.Errorf("%s is a directory; copy it with --recursive", source)
+	}
+
+	sftpClient, err := sftp.NewClient(args.Client)
+	if err != nil {
+		return fmt.Errorf("failed to create SFTP client: %w", err)
+	}
+
+	args.Source = source
+	args.Destination = into(sftpClient.Stat, path.Join, destination, filepath.Base(source))
+	sftpClient.Close()
+
+	if info.IsDir() {
+		return t.ssh.CopyDirTo(args)
+	}
+
+	return t.ssh.copy(args, true, false)
+}
+
+func (t *Transfer) download(args CopyArgs, source string, destination string, recursive bool) error {
+	sftpClient, err := sftp.NewClient(args.Client)
+	if err != nil {
+		return fmt.Errorf("failed to create SFTP client: %w", err)
+	}
+
+	info, err := sftpClient.Stat(source)
+	sftpClient.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	if info.IsDir() && !recursive {
+		return fmt.Errorf("%s is a directory; copy it with --recursive", source)
+	}
+
+	args.Source = source
+	args.Destination = into(os.Stat, filepath.Join, destination, path.Base(source))
+
+	if info.IsDir() {
+		return t.ssh.CopyDirFrom(args)
+	}
+
+	return t.ssh.CopyFrom(args)
+}
+
+// Where a copy goes; into an existing directory, it keeps the source's name
+func into(stat func(string) (fs.FileInfo, error), join func(...string) string, destination string, name string) string {
+	info, err := stat(destination)
+	if err == nil && info.IsDir() && name != "." && name != "/" {
+		return join(destination, name)
+	}
+
+	return destination
+}
+
+// Connect to the servers, at most `parallel` at a time, and call `fn` with
+// each; errors are reported per server
+func (t *Transfer) eachServer(servers []Server, parallel int, fn func(server Server, client *ssh.Client) error) error {
+	parallel = lo.Ternary(parallel > 0, parallel, len(servers))
+	slots := make(chan struct{}, parallel)
+
+	mutex := sync.Mutex{}
+	errs := []error{}
+
+	wg := sync.WaitGroup{}
+	for _, server := range servers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			err := func() error {
+				client, err := t.ssh.Authenticate(AuthenticateArgs{
+					Host:          server.Host,
+					Port:          server.Port,
+					User:          server.User,
+					Password:      server.SshPassword,
+					PrivateSshKey: server.PrivateSshKey,
+				})
+				if err != nil {
+					return err
+				}
+				defer client.Close()
+
+				return fn(server, client)
+			}()
+
+			if err != nil {
+				mutex.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", server.Name, err))
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+
+	return errors.Join(errs...)
+}
+
+func NewTransfer() *Transfer {
+	return &Transfer{
+		ssh:       NewSsh(),
+		inventory: NewInventory(),
+	}
+}
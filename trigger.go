@@ -0,0 +1,212 @@
+package storm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+const (
+	TriggerPush        = "push"
+	TriggerPullRequest = "pull-request"
+	TriggerSchedule    = "schedule"
+)
+
+const (
+	PullRequestOpened      = "opened"
+	PullRequestSynchronize = "synchronize"
+	PullRequestReopened    = "reopened"
+	PullRequestClosed      = "closed"
+)
+
+const (
+	RefTypeBranch = "branch"
+	RefTypeTag    = "tag"
+)
+
+// What triggered a run; handed to every step as `STORM_*` environment
+// variables
+type TriggerContext struct {
+	Event string
+
+	// Full ref name, e.g. refs/heads/main or refs/tags/v1.0.0
+	Ref    string
+	Sha    string
+	Before string
+
+	Repository string
+	Actor      string
+
+	// Files changed by the push, relative to the repository root
+	ChangedPaths []string
+
+	// Schedules only; the cron expression that fired
+	Schedule string
+
+	// Pull requests only; the action, e.g. opened, and the branch names
+	Action  string
+	Number  int
+	BaseRef string
+	HeadRef string
+}
+
+// Short name of the ref and whether it is a branch or a tag; other refs have
+// no type
+func (t TriggerContext) RefName() (string, string) {
+	if name, found := strings.CutPrefix(t.Ref, "refs/heads/"); found {
+		return name, RefTypeBranch
+	}
+
+	if name, found := strings.CutPrefix(t.Ref, "refs/tags/"); found {
+		return name, RefTypeTag
+	}
+
+	return t.Ref, ""
+}
+
+func (t TriggerContext) Env() []string {
+	name, refType := t.RefName()
+
+	env := []string{
+		fmt.Sprintf("STORM_EVENT=%s", t.Event),
+		fmt.Sprintf("STORM_REF=%s", t.Ref),
+		fmt.Sprintf("STORM_REF_NAME=%s", name),
+		fmt.Sprintf("STORM_REF_TYPE=%s", refType),
+		fmt.Sprintf("STORM_SHA=%s", t.Sha),
+		fmt.Sprintf("STORM_BEFORE=%s", t.Before),
+		fmt.Sprintf("STORM_REPOSITORY=%s", t.Repository),
+		fmt.Sprintf("STORM_ACTOR=%s", t.Actor),
+	}
+
+	if t.Event == TriggerSchedule {
+		env = append(env, fmt.Sprintf("STORM_SCHEDULE=%s", t.Schedule))
+	}
+
+	if t.Event == TriggerPullRequest {
+		env = append(env,
+			fmt.Sprintf("STORM_PR_ACTION=%s", t.Action),
+			fmt.Sprintf("STORM_PR_NUMBER=%d", t.Number),
+			fmt.Sprintf("STORM_BASE_REF=%s", t.BaseRef),
+			fmt.Sprintf("STORM_HEAD_REF=%s", t.HeadRef),
+		)
+	}
+
+	return env
+}
+
+// Whether a push matches the filters; without `branches` and `tags` every
+// push matches, with only one of them the other kind of ref never does.
+// `paths` only applies to branches, tags do not change files.
+func (p PushTrigger) Matches(t TriggerContext) bool {
+	name, refType := t.RefName()
+
+	switch refType {
+	case RefTypeBranch:
+		if len(p.Branches) > 0 && !MatchGlobs(p.Branches, name) {
+			return false
+		}
+		if len(p.Branches) == 0 && len(p.Tags) > 0 {
+			return false
+		}
+
+		if len(p.Paths) == 0 {
+			return true
+		}
+
+		for _, changed := range t.ChangedPaths {
+			if MatchGlobs(p.Paths, changed) {
+				return true
+			}
+		}
+
+		return false
+	case RefTypeTag:
+		if len(p.Tags) > 0 {
+			return MatchGlobs(p.Tags, name)
+		}
+
+		return len(p.Branches) == 0
+	default:
+		return false
+	}
+}
+
+// Whether a pull request change matches the filters; `branches` are matched
+// against the branch the pull request targets
+func (p PullRequestTrigger) Matches(t TriggerContext) bool {
+	types := lo.Ternary(len(p.Types) > 0, p.Types, []string{PullRequestOpened, PullRequestSynchronize, PullRequestReopened})
+	if !lo.Contains(types, t.Action) {
+		return false
+	}
+
+	return len(p.Branches) == 0 || MatchGlobs(p.Branches, t.BaseRef)
+}
+
+// Whether the workflow runs for the event, according to its `on` triggers
+func (wc WorkflowConfig) TriggeredBy(t TriggerContext) bool {
+	switch t.Event {
+	case TriggerPush:
+		return wc.On.Push != nil && wc.On.Push.Matches(t)
+	case TriggerPullRequest:
+		return wc.On.PullRequest != nil && wc.On.PullRequest.Matches(t)
+	default:
+		return false
+	}
+}
+
+type triggeredRunArgs struct {
+	Config  WorkflowConfig
+	Trigger TriggerContext
+
+	// When set, the workflow runs on the inventory's servers instead of locally
+	Inventory *InventoryConfig
+	Limit     []string
+
+	// Delay before each host starts, from the start of the run
+	StartDelay func(host string) time.Duration
+
+	Handlers []func(Event)
+	History  *History
+}
+
+// Run a triggered workflow, locally or with the agent, with the trigger's
+// environment variables
+func runTriggered(workflow *Workflow, agent *Agent, args triggeredRunArgs) error {
+	if args.Inventory != nil {
+		options := []RunOption{
+			agent.AgentWithConfigs(args.Config, *args.Inventory),
+			agent.AgentWithEnv(args.Trigger.Env()...),
+			agent.AgentWithLimit(args.Limit...),
+		}
+		for _, handler := range args.Handlers {
+			options = append(options, agent.AgentWithHandler(handler))
+		}
+		if args.History != nil {
+			options = append(options, agent.AgentWithHistory(args.History))
+		}
+		if args.StartDelay != nil {
+			options = append(options, agent.AgentWithStartDelay(func(server Server) time.Duration { return args.StartDelay(server.Name) }))
+		}
+
+		return agent.Run(options...)
+	}
+
+	options := []WorkflowRunOptions{
+		workflow.WorkflowWithConfig(args.Config),
+		workflow.WorkflowWithEnv(args.Trigger.Env()...),
+	}
+	for _, handler := range args.Handlers {
+		options = append(options, workflow.WorkflowWithHandler(handler))
+	}
+	if args.History != nil {
+		options = append(options, workflow.WorkflowWithHistory(args.History))
+	}
+
+	if args.StartDelay != nil {
+		time.Sleep(args.StartDelay(LocalHost))
+	}
+
+	return workflow.Run(options...)
+}
@@ -0,0 +1,346 @@
+package storm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// Check a workflow file, and the files it uses or includes, against
+// `schema.workflow.json` and the rules the schema cannot express
+func (w *Workflow) Validate(file string) Diagnostics {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return Diagnostics{{File: file, Message: err.Error()}}
+	}
+
+	_, err = w.Parse(file, content)
+
+	diagnostics := Diagnostics{}
+	if errors.As(err, &diagnostics) {
+		return diagnostics
+	}
+
+	return nil
+}
+
+func (w *Workflow) check(file string, content []byte) (*WorkflowConfig, Diagnostics) {
+	wc := WorkflowConfig{}
+
+	diagnostics := checkYaml(file, content, workflowSchema, &wc, func(root *yaml.Node) Diagnostics {
+		return validateWorkflow(file, root, wc)
+	})
+
+	return &wc, diagnostics
+}
+
+// Check an inventory file against `schema.inventory.json` and the rules the
+// schema cannot express
+func (c *Inventory) Validate(file string) Diagnostics {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return Diagnostics{{File: file, Message: err.Error()}}
+	}
+
+	_, diagnostics := c.check(file, content)
+
+	return diagnostics
+}
+
+func (c *Inventory) check(file string, content []byte) (*InventoryConfig, Diagnostics) {
+	ic := InventoryConfig{}
+
+	diagnostics := checkYaml(file, content, inventorySchema, &ic, func(root *yaml.Node) Diagnostics {
+		return validateInventory(file, root, ic)
+	})
+
+	return &ic, diagnostics
+}
+
+// Parse and decode yaml into `out`, reporting everything wrong with it at
+// once; schema violations, decode errors and semantic rules
+func checkYaml(file string, content []byte, schema []byte, out any, semantic func(root *yaml.Node) Diagnostics) Diagnostics {
+	root, diagnostics := parseYaml(file, content)
+	if len(diagnostics) > 0 {
+		return diagnostics
+	}
+
+	diagnostics = validateSchema(file, root, schema)
+
+	// Decode what can be decoded so the semantic rules see as much as possible;
+	// type errors are already reported by the schema
+	err := root.Decode(out)
+	if err != nil && !errors.As(err, new(*yaml.TypeError)) {
+		diagnostics = append(diagnostics, Diagnostic{File: file, Message: err.Error()})
+	}
+
+	diagnostics = append(diagnostics, semantic(root)...)
+	if len(diagnostics) == 0 {
+		return nil
+	}
+
+	return diagnostics.sort()
+}
+
+// Rules of a workflow the schema cannot express
+func validateWorkflow(file string, root *yaml.Node, wc WorkflowConfig) Diagnostics {
+	c := diagnosticCollector{file: file, root: root}
+
+	// Job name => index of its first definition
+	jobs := map[string]int{}
+
+	for i, job := range wc.Jobs {
+		jobPath := []string{"jobs", strconv.Itoa(i)}
+
+		if job.Name != "" {
+			if first, found := jobs[job.Name]; found {
+				c.add(append(jobPath, "name"), "duplicate job name %q; first defined at line %d", job.Name, nodeAt(root, "jobs", strconv.Itoa(first)).Line)
+			} else {
+				jobs[job.Name] = i
+			}
+		}
+
+		if job.Needs != "" {
+			needsPath := append(jobPath, "needs")
+
+			if job.Needs == job.Name {
+				c.add(needsPath, "job %q needs itself", job.Name)
+			} else if !lo.ContainsBy(wc.Jobs, func(j Job) bool { return j.Name == job.Needs }) {
+				c.add(needsPath, "job %q needs unknown job %q", job.Name, job.Needs)
+			}
+		}
+	}
+
+	for i, schedule := range wc.On.Schedule {
+		schedulePath := []string{"on", "schedule", strconv.Itoa(i)}
+
+		if schedule.Cron != "" {
+			if _, err := ParseCron(schedule.Cron); err != nil {
+				c.add(append(schedulePath, "cron"), "%s", err)
+			}
+		}
+
+		if schedule.Timezone != "" {
+			if _, err := time.LoadLocation(schedule.Timezone); err != nil {
+				c.add(append(schedulePath, "timezone"), "unknown timezone %q", schedule.Timezone)
+			}
+		}
+
+		if schedule.Jitter != "" {
+			if jitter, err := time.ParseDuration(schedule.Jitter); err != nil || jitter < 0 {
+				c.add(append(schedulePath, "jitter"), "invalid jitter %q; expected a duration such as 30s or 5m", schedule.Jitter)
+			}
+		}
+	}
+
+	declared := map[string]string{}
+	if wc.On.Dispatch != nil {
+		declared = validateInputs(&c, []string{"on", "dispatch", "inputs"}, wc.On.Dispatch.Inputs)
+	}
+
+	// Expressions can only refer to declared inputs, and to facts
+	expressions := ExpressionContext{Inputs: declared, Facts: declaredFacts()}
+	if _, err := expressions.Interpolate(wc.Directory); err != nil {
+		c.add([]string{"directory"}, "%s", err)
+	}
+	for i, job := range wc.Jobs {
+		for name, value := range job.With {
+			if _, err := expressions.Interpolate(value); err != nil {
+				c.add([]string{"jobs", strconv.Itoa(i), "with", name}, "%s", err)
+			}
+		}
+
+		jobPath := []string{"jobs", strconv.Itoa(i)}
+
+		if job.If != "" {
+			if _, err := expressions.Condition(job.If); err != nil {
+				c.add(append(append([]string{}, jobPath...), "if"), "%s", err)
+			}
+		}
+
+		validateSteps(&c, expressions, append(append([]string{}, jobPath...), "steps"), job.Steps)
+		validateSteps(&c, expressions, append(append([]string{}, jobPath...), "handlers"), job.Handlers)
+
+		// Handler name => index of its first definition
+		handlers := map[string]int{}
+
+		for j, handler := range job.Handlers {
+			handlerPath := append(append([]string{}, jobPath...), "handlers", strconv.Itoa(j))
+
+			switch {
+			case handler.Include != "":
+				c.add(append(handlerPath, "include"), "handlers cannot include steps")
+			case handler.Name == "":
+				c.add(handlerPath, "handlers need a name to be notified by")
+			case handler.Notify != "":
+				c.add(append(handlerPath, "notify"), "handlers cannot notify")
+			}
+
+			if first, found := handlers[handler.Name]; found && handler.Name != "" {
+				c.add(append(handlerPath, "name"), "duplicate handler name %q; first defined at line %d", handler.Name, nodeAt(root, "jobs", strconv.Itoa(i), "handlers", strconv.Itoa(first)).Line)
+			} else {
+				handlers[handler.Name] = j
+			}
+		}
+
+		for j, step := range job.Steps {
+			if _, found := handlers[step.Notify]; step.Notify != "" && !found {
+				c.add(append(append([]string{}, jobPath...), "steps", strconv.Itoa(j), "notify"), "job %q has no handler %q", job.Name, step.Notify)
+			}
+		}
+	}
+
+	if cycle := NewJobGraph(wc.Jobs).Cycle(); len(cycle) > 2 {
+		i := lo.IndexOf(lo.Map(wc.Jobs, func(j Job, _ int) string { return j.Name }), cycle[0])
+		c.add([]string{"jobs", strconv.Itoa(i), "needs"}, "jobs depend on each other; %s", strings.Join(cycle, " -> "))
+	}
+
+	return c.result()
+}
+
+// Expressions and globs of steps, or handlers
+func validateSteps(c *diagnosticCollector, expressions ExpressionContext, path []string, steps []Step) {
+	for j, step := range steps {
+		stepPath := append(append([]string{}, path...), strconv.Itoa(j))
+
+		fields := map[string]string{
+			"name":      step.Name,
+			"run":       step.Run,
+			"directory": step.Directory,
+			"creates":   step.Creates,
+			"removes":   step.Removes,
+			"unless":    step.Unless,
+			"onlyif":    step.OnlyIf,
+		}
+
+		for field, value := range fields {
+			if _, err := expressions.Interpolate(value); err != nil {
+				c.add(append(stepPath, field), "%s", err)
+			}
+		}
+
+		if step.CheckSafe && step.Run == "" && step.Uses == "" {
+			c.add(append(stepPath, "check-safe"), "only run and uses steps can be check-safe; modules, copy and template steps always check what they would change")
+		}
+
+		if step.If != "" {
+			if _, err := expressions.Condition(step.If); err != nil {
+				c.add(append(stepPath, "if"), "%s", err)
+			}
+		}
+
+		for field, pattern := range map[string]string{"creates": step.Creates, "removes": step.Removes} {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				c.add(append(stepPath, field), "invalid glob %q", pattern)
+			}
+		}
+
+		for name, value := range step.With {
+			if _, err := expressions.Interpolate(value); err != nil {
+				c.add(append(stepPath, "with", name), "%s", err)
+			}
+		}
+
+		if fileStep, key := step.file(); fileStep != nil {
+			validateFileStep(c, expressions, append(stepPath, key), *fileStep)
+		}
+	}
+}
+
+// Rules of a copy or template step the schema cannot express
+func validateFileStep(c *diagnosticCollector, expressions ExpressionContext, path []string, fileStep FileStep) {
+	fields := map[string]string{"dest": fileStep.Dest, "mode": fileStep.Mode, "owner": fileStep.Owner}
+
+	for field, value := range fields {
+		if _, err := expressions.Interpolate(value); err != nil {
+			c.add(append(append([]string{}, path...), field), "%s", err)
+		}
+	}
+
+	// Sources are read when the workflow is loaded, before inputs are known
+	if expressionPattern.MatchString(fileStep.Src) {
+		c.add(append(append([]string{}, path...), "src"), "src cannot have expressions")
+	}
+
+	// Modes with expressions are checked when the step runs
+	if fileStep.Mode != "" && !expressionPattern.MatchString(fileStep.Mode) {
+		if _, err := parseFileMode(fileStep.Mode); err != nil {
+			c.add(append(append([]string{}, path...), "mode"), "%s", err)
+		}
+	}
+}
+
+// Rules of declared inputs the schema cannot express; returns the inputs as
+// an expression context, without values
+func validateInputs(c *diagnosticCollector, path []string, inputs map[string]DispatchInput) map[string]string {
+	declared := map[string]string{}
+
+	for name, input := range inputs {
+		declared[name] = ""
+		inputPath := append(append([]string{}, path...), name)
+
+		if input.Type == InputChoice && len(input.Options) == 0 {
+			c.add(inputPath, "choice input %q has no options", name)
+		}
+		if input.Type != InputChoice && len(input.Options) > 0 {
+			c.add(append(inputPath, "options"), "only choice inputs have options, %q is a %s input", name, lo.Ternary(input.Type != "", input.Type, InputString))
+		}
+		if input.Default != "" {
+			if _, err := input.check(input.Default); err != nil {
+				c.add(append(inputPath, "default"), "invalid default of input %q; %s", name, err)
+			}
+		}
+	}
+
+	return declared
+}
+
+// Rules of an action the schema cannot express
+func validateAction(file string, root *yaml.Node, ac ActionConfig) Diagnostics {
+	c := diagnosticCollector{file: file, root: root}
+
+	expressions := ExpressionContext{Inputs: validateInputs(&c, []string{"inputs"}, ac.Inputs), Facts: declaredFacts()}
+
+	for i, step := range ac.Steps {
+		fields := map[string]string{"name": step.Name, "run": step.Run, "directory": step.Directory}
+
+		for field, value := range fields {
+			if _, err := expressions.Interpolate(value); err != nil {
+				c.add([]string{"steps", strconv.Itoa(i), field}, "%s", err)
+			}
+		}
+	}
+
+	if ac.Script != "" && !filepath.IsLocal(ac.Script) {
+		c.add([]string{"script"}, "script %q must be inside the action's directory", ac.Script)
+	}
+
+	return c.result()
+}
+
+// Rules of an inventory the schema cannot express
+func validateInventory(file string, root *yaml.Node, ic InventoryConfig) Diagnostics {
+	c := diagnosticCollector{file: file, root: root}
+
+	servers := map[string]int{}
+
+	for i, server := range ic.Servers {
+		if server.Name == "" {
+			continue
+		}
+
+		if first, found := servers[server.Name]; found {
+			c.add([]string{"servers", strconv.Itoa(i), "name"}, "duplicate server name %q; first defined at line %d", server.Name, nodeAt(root, "servers", strconv.Itoa(first)).Line)
+		} else {
+			servers[server.Name] = i
+		}
+	}
+
+	return c.result()
+}
@@ -0,0 +1,278 @@
+package storm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// Version of storm; set by the command line when it is built
+var Version = "dev"
+
+// Level of what the controller expects of the storm binary on servers; the
+// flags of `storm run` it passes, the workflow fields it ships and the events
+// it reads back. Bump it whenever any of them changes, controllers only run
+// workflows with agents of their own level.
+const AgentProtocolVersion = 2
+
+var ErrIncompatibleAgent = errors.New("incompatible agent")
+
+// What `storm version` reports of a storm binary
+type AgentVersion struct {
+	Version  string `json:"version"`
+	Commit   string `json:"commit"`
+	Protocol int    `json:"protocol"`
+}
+
+func (v AgentVersion) String() string {
+	return fmt.Sprintf("%s (protocol %d)", v.Version, v.Protocol)
+}
+
+// Read the `Name: value` lines of `storm version`; binaries older than the
+// protocol print none for it, they are level 0
+func parseAgentVersion(output string) AgentVersion {
+	version := AgentVersion{}
+
+	for _, line := range strings.Split(output, "\n") {
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+
+		switch strings.TrimSpace(name) {
+		case "Version":
+			version.Version = value
+		case "Commit":
+			version.Commit = value
+		case "Protocol":
+			version.Protocol, _ = strconv.Atoi(value)
+		}
+	}
+
+	return version
+}
+
+// Version of the storm binary on a server; nil when it is not installed
+func (a *Agent) agentVersion(client *ssh.Client) (*AgentVersion, error) {
+	output, err := a.remoteCommand(client, fmt.Sprintf("if [ -x ~/%[1]s ]; then ~/%[1]s version; fi", agentBinary))
+	if err != nil {
+		return nil, errors.Join(errors.New("the storm binary on the server does not run"), err)
+	}
+	if output == "" {
+		return nil, nil
+	}
+
+	version := parseAgentVersion(output)
+
+	return &version, nil
+}
+
+// Why a server's storm cannot run the controller's workflows, if it cannot
+func checkAgentVersion(version *AgentVersion) error {
+	if version == nil {
+		return fmt.Errorf("%w; storm is not installed on the server", ErrIncompatibleAgent)
+	}
+
+	if version.Protocol != AgentProtocolVersion {
+		return fmt.Errorf("%w; storm %s on the server, the controller speaks protocol %d", ErrIncompatibleAgent, version, AgentProtocolVersion)
+	}
+
+	return nil
+}
+
+// Make sure the storm binary on a server can run the controller's workflows.
+// Incompatible ones are upgraded with a binary of the cache when there is one,
+// otherwise the run is refused; reports the upgrade, if any.
+func (a *Agent) handshake(client *ssh.Client, binaries *binaryCache) (string, error) {
+	version, err := a.agentVersion(client)
+	if err == nil {
+		err = checkAgentVersion(version)
+	}
+	if err == nil {
+		return "", nil
+	}
+
+	if binaries == nil {
+		return "", errors.Join(err, errors.New("upgrade it with `storm agent upgrade`"))
+	}
+
+	platform, err := a.detectPlatform(client)
+	if err != nil {
+		return "", err
+	}
+
+	binary, err := binaries.binary(platform)
+	if err != nil {
+		return "", err
+	}
+
+	if err := a.installBinary(client, binary); err != nil {
+		return "", errors.Join(errors.New("could not upgrade storm on the server"), err)
+	}
+
+	upgraded, err := a.agentVersion(client)
+	if err == nil {
+		err = checkAgentVersion(upgraded)
+	}
+	if err != nil {
+		return "", errors.Join(errors.New("the upgraded storm is still incompatible"), err)
+	}
+
+	from := "nothing"
+	if version != nil {
+		from = version.String()
+	}
+
+	return fmt.Sprintf("upgraded storm from %s to %s", from, upgraded), nil
+}
+
+type UpgradeArgs struct {
+	If string
+	Ic InventoryConfig
+
+	// Only upgrade servers matching these names or labels
+	Limit []string
+
+	// Where the new binary comes from; `prod` takes it from the release
+	// directory, `dev` builds it from the source in the current directory
+	Mode             string
+	ReleaseDirectory string
+
+	// Reinstall storm on servers that already run the controller's version
+	Force bool
+}
+
+// Roll the controller's version of storm out to the inventory's servers, one
+// at a time. The binary a server had is kept as `storm.previous`; when a server
+// fails, it and every server upgraded before it get theirs back, leaving the
+// inventory as it was.
+func (a *Agent) Upgrade(args UpgradeArgs) error {
+	var ic *InventoryConfig = &args.Ic
+
+	if args.If != "" {
+		_ic, err := a.inventory.Load(args.If)
+		if err != nil {
+			return err
+		}
+		ic = _ic
+	}
+
+	var source binarySource
+	switch args.Mode {
+	case "dev":
+		source = buildBinary
+	case "prod", "":
+		source = releaseBinary(lo.Ternary(args.ReleaseDirectory != "", args.ReleaseDirectory, DefaultReleaseDirectory))
+	default:
+		return errors.New("installation mode not supported")
+	}
+
+	binaries, err := newBinaryCache(source)
+	if err != nil {
+		return err
+	}
+	defer binaries.Close()
+
+	// Servers whose binary was replaced, or was about to be
+	upgraded := []Server{}
+
+	for _, server := range ic.Select(args.Limit...) {
+		fmt.Printf("Server: [%s]\n", server.Name)
+
+		skipped, err := func() (bool, error) {
+			client, err := a.connect(server)
+			if err != nil {
+				return false, err
+			}
+			defer client.Close()
+
+			// A binary that does not run is replaced like an outdated one
+			version, _ := a.agentVersion(client)
+
+			if version != nil && !args.Force && Version != "dev" && version.Version == Version && version.Protocol == AgentProtocolVersion {
+				fmt.Printf("Storm %s is up to date\n", version)
+				return true, nil
+			}
+
+			platform, err := a.detectPlatform(client)
+			if err != nil {
+				return false, err
+			}
+
+			binary, err := binaries.binary(platform)
+			if err != nil {
+				return false, err
+			}
+
+			from := "(not installed)"
+			if version != nil {
+				from = version.String()
+			}
+
+			fmt.Printf("Upgrading storm %s to %s for %s ... ", from, AgentVersion{Version: Version, Protocol: AgentProtocolVersion}, platform)
+
+			_, err = a.remoteCommand(client, fmt.Sprintf(`b=~/%s; if [ -e "$b" ]; then cp -p "$b" "$b.previous"; else rm -f "$b.previous"; fi`, agentBinary))
+			if err != nil {
+				return false, errors.Join(errors.New("could not keep the previous binary"), err)
+			}
+			upgraded = append(upgraded, server)
+
+			if err := a.installBinary(client, binary); err != nil {
+				return false, err
+			}
+
+			version, err = a.agentVersion(client)
+			if err == nil {
+				err = checkAgentVersion(version)
+			}
+
+			return false, err
+		}()
+		if err != nil {
+			fmt.Println("failed")
+
+			return errors.Join(append([]error{fmt.Errorf("%s: %w", server.Name, err)}, a.rollback(upgraded)...)...)
+		}
+
+		if !skipped {
+			fmt.Println("done")
+		}
+	}
+
+	return nil
+}
+
+// Put the previous binaries of servers back, the last upgraded first; reports
+// the servers that could not be rolled back
+func (a *Agent) rollback(servers []Server) []error {
+	errs := []error{}
+
+	for i := len(servers) - 1; i >= 0; i-- {
+		server := servers[i]
+		fmt.Printf("Rolling back storm on [%s] ... ", server.Name)
+
+		err := func() error {
+			client, err := a.connect(server)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+
+			_, err = a.remoteCommand(client, fmt.Sprintf(`b=~/%s; if [ -e "$b.previous" ]; then mv -f "$b.previous" "$b"; else rm -f "$b"; fi`, agentBinary))
+
+			return err
+		}()
+		if err != nil {
+			fmt.Println("failed")
+			errs = append(errs, fmt.Errorf("%s: could not roll back; %w", server.Name, err))
+
+			continue
+		}
+
+		fmt.Println("done")
+	}
+
+	return errs
+}
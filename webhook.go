@@ -0,0 +1,418 @@
+package storm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+const (
+	WebhookProviderGithub = "github"
+	WebhookProviderGitea  = "gitea"
+	WebhookProviderGitlab = "gitlab"
+)
+
+// Largest payload accepted; GitHub caps theirs at 25MB
+const maxWebhookPayload = 25 << 20
+
+// Number of triggered runs waiting for the previous ones to finish
+const webhookQueueSize = 64
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+type Webhooks struct {
+	workflow  *Workflow
+	inventory *Inventory
+	agent     *Agent
+}
+
+type WebhookServeArgs struct {
+	// Address to listen on, e.g. :8080
+	Address string
+
+	// Shared secret the payloads are signed with
+	Secret string
+
+	// Directory of the workflows; they are loaded on every event
+	Workflows string
+
+	// When set, workflows run on the inventory's servers instead of locally
+	Inventory string
+
+	Handlers []func(Event)
+	History  *History
+}
+
+type webhookRun struct {
+	config  WorkflowConfig
+	trigger TriggerContext
+}
+
+// Receive webhooks and run the workflows they trigger, one at a time, until
+// the server fails
+func (wh *Webhooks) Serve(args WebhookServeArgs) error {
+	handler, err := wh.Handler(args)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Listening for webhooks on %s\n", args.Address)
+
+	return http.ListenAndServe(args.Address, handler)
+}
+
+// Handler verifying webhooks and queueing the workflows they trigger; the
+// response lists the queued workflows, and fails with the errors of the
+// workflows that could not be loaded
+func (wh *Webhooks) Handler(args WebhookServeArgs) (http.Handler, error) {
+	if args.Secret == "" {
+		return nil, errors.New("a webhook secret is required")
+	}
+
+	workflows := lo.Ternary(args.Workflows != "", args.Workflows, DefaultWorkflowsDirectory)
+
+	var ic *InventoryConfig
+	if args.Inventory != "" {
+		_ic, err := wh.inventory.Load(args.Inventory)
+		if err != nil {
+			return nil, err
+		}
+
+		ic = _ic
+	}
+
+	// Runs go one after another, in the order the events came in
+	queue := make(chan webhookRun, webhookQueueSize)
+	go func() {
+		for run := range queue {
+			err := runTriggered(wh.workflow, wh.agent, triggeredRunArgs{
+				Config:    run.config,
+				Trigger:   run.trigger,
+				Inventory: ic,
+				Handlers:  args.Handlers,
+				History:   args.History,
+			})
+			if err != nil {
+				fmt.Println(fmt.Errorf("%s workflow failed for %s; %w", run.config.Name, run.trigger.Ref, err))
+			}
+		}
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookPayload))
+		if err != nil {
+			http.Error(w, "could not read payload", http.StatusBadRequest)
+			return
+		}
+
+		trigger, err := ParseWebhook(r.Header, body, args.Secret)
+		if errors.Is(err, ErrInvalidSignature) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		queued := []string{}
+		var loadErr error
+
+		// Events that trigger nothing, e.g. pings, are acknowledged as well
+		if trigger != nil {
+			configs, err := wh.workflows(workflows)
+			if err != nil {
+				fmt.Println(err)
+				loadErr = err
+			}
+
+			for _, wc := range configs {
+				if !wc.TriggeredBy(*trigger) {
+					continue
+				}
+
+				select {
+				case queue <- webhookRun{config: wc, trigger: *trigger}:
+					queued = append(queued, wc.Name)
+				default:
+					http.Error(w, "too many queued runs", http.StatusServiceUnavailable)
+					return
+				}
+			}
+		}
+
+		response := map[string]any{"workflows": queued}
+		status := lo.Ternary(len(queued) > 0, http.StatusAccepted, http.StatusOK)
+
+		// The valid workflows are queued all the same, the delivery still
+		// shows as failed with the reason
+		if loadErr != nil {
+			response["error"] = loadErr.Error()
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	}), nil
+}
+
+// Every workflow file of the directory; invalid ones are reported and the
+// others kept
+func (wh *Webhooks) workflows(directory string) ([]WorkflowConfig, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("could not read workflows directory %s", directory), err)
+	}
+
+	configs := []WorkflowConfig{}
+	errs := []error{}
+
+	for _, entry := range entries {
+		if ext := filepath.Ext(entry.Name()); entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		wc, err := wh.workflow.Load(filepath.Join(directory, entry.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		configs = append(configs, *wc)
+	}
+
+	return configs, errors.Join(errs...)
+}
+
+// Verify and decode a GitHub, Gitea or GitLab webhook into the event it
+// describes; events that trigger no workflow, e.g. pings, decode to nil
+func ParseWebhook(header http.Header, body []byte, secret string) (*TriggerContext, error) {
+	// Gitea sends GitHub's headers as well, it has to be detected first
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		signature := header.Get("X-Gitea-Signature")
+		if !validHmac(body, secret, signature) {
+			return nil, ErrInvalidSignature
+		}
+
+		return parseGithubPayload(WebhookProviderGitea, header.Get("X-Gitea-Event"), body)
+	case header.Get("X-Gitlab-Event") != "":
+		token := header.Get("X-Gitlab-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return nil, ErrInvalidSignature
+		}
+
+		return parseGitlabPayload(header.Get("X-Gitlab-Event"), body)
+	case header.Get("X-GitHub-Event") != "":
+		signature, found := strings.CutPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+		if !found || !validHmac(body, secret, signature) {
+			return nil, ErrInvalidSignature
+		}
+
+		return parseGithubPayload(WebhookProviderGithub, header.Get("X-GitHub-Event"), body)
+	default:
+		return nil, errors.New("unknown webhook provider; expected a GitHub, Gitea or GitLab event header")
+	}
+}
+
+// Whether the hex encoded signature is the body's HMAC-SHA256 with the secret
+func validHmac(body []byte, secret string, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || secret == "" {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+type webhookCommit struct {
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+func commitPaths(commits []webhookCommit) []string {
+	paths := []string{}
+	for _, commit := range commits {
+		paths = append(paths, commit.Added...)
+		paths = append(paths, commit.Removed...)
+		paths = append(paths, commit.Modified...)
+	}
+
+	return lo.Uniq(paths)
+}
+
+// GitHub payload; Gitea's are compatible
+type githubPayload struct {
+	Ref     string          `json:"ref"`
+	Before  string          `json:"before"`
+	After   string          `json:"after"`
+	Deleted bool            `json:"deleted"`
+	Commits []webhookCommit `json:"commits"`
+
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Base struct {
+			Ref string `json:"ref"`
+			Sha string `json:"sha"`
+		} `json:"base"`
+		Head struct {
+			Ref string `json:"ref"`
+			Sha string `json:"sha"`
+		} `json:"head"`
+	} `json:"pull_request"`
+}
+
+func parseGithubPayload(provider string, event string, body []byte) (*TriggerContext, error) {
+	if event != "push" && event != "pull_request" {
+		return nil, nil
+	}
+
+	payload := githubPayload{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, errors.Join(fmt.Errorf("invalid %s %s payload", provider, event), err)
+	}
+
+	trigger := TriggerContext{
+		Repository: payload.Repository.FullName,
+		Actor:      payload.Sender.Login,
+	}
+
+	if event == "push" {
+		if payload.Deleted || payload.After == zeroSha {
+			return nil, nil
+		}
+
+		trigger.Event = TriggerPush
+		trigger.Ref = payload.Ref
+		trigger.Sha = payload.After
+		trigger.Before = payload.Before
+		trigger.ChangedPaths = commitPaths(payload.Commits)
+
+		return &trigger, nil
+	}
+
+	trigger.Event = TriggerPullRequest
+	trigger.Ref = fmt.Sprintf("refs/pull/%d/head", payload.Number)
+	trigger.Sha = payload.PullRequest.Head.Sha
+	trigger.Before = payload.PullRequest.Base.Sha
+	trigger.Number = payload.Number
+	trigger.BaseRef = payload.PullRequest.Base.Ref
+	trigger.HeadRef = payload.PullRequest.Head.Ref
+
+	// Gitea names it in the past tense
+	trigger.Action = lo.Ternary(payload.Action == "synchronized", PullRequestSynchronize, payload.Action)
+
+	return &trigger, nil
+}
+
+type gitlabPayload struct {
+	Ref          string          `json:"ref"`
+	Before       string          `json:"before"`
+	After        string          `json:"after"`
+	UserUsername string          `json:"user_username"`
+	Commits      []webhookCommit `json:"commits"`
+
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+
+	ObjectAttributes struct {
+		Action       string `json:"action"`
+		Iid          int    `json:"iid"`
+		TargetBranch string `json:"target_branch"`
+		SourceBranch string `json:"source_branch"`
+		LastCommit   struct {
+			Id string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// GitLab merge request actions, by the pull request action they stand for
+var gitlabActions = map[string]string{
+	"open":   PullRequestOpened,
+	"update": PullRequestSynchronize,
+	"reopen": PullRequestReopened,
+	"close":  PullRequestClosed,
+	"merge":  PullRequestClosed,
+}
+
+func parseGitlabPayload(event string, body []byte) (*TriggerContext, error) {
+	if event != "Push Hook" && event != "Tag Push Hook" && event != "Merge Request Hook" {
+		return nil, nil
+	}
+
+	payload := gitlabPayload{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, errors.Join(fmt.Errorf("invalid gitlab %s payload", event), err)
+	}
+
+	trigger := TriggerContext{Repository: payload.Project.PathWithNamespace}
+
+	if event != "Merge Request Hook" {
+		if payload.After == zeroSha {
+			return nil, nil
+		}
+
+		trigger.Event = TriggerPush
+		trigger.Ref = payload.Ref
+		trigger.Sha = payload.After
+		trigger.Before = payload.Before
+		trigger.Actor = payload.UserUsername
+		trigger.ChangedPaths = commitPaths(payload.Commits)
+
+		return &trigger, nil
+	}
+
+	attributes := payload.ObjectAttributes
+
+	trigger.Event = TriggerPullRequest
+	trigger.Ref = fmt.Sprintf("refs/merge-requests/%d/head", attributes.Iid)
+	trigger.Sha = attributes.LastCommit.Id
+	trigger.Actor = payload.User.Username
+	trigger.Action = gitlabActions[attributes.Action]
+	trigger.Number = attributes.Iid
+	trigger.BaseRef = attributes.TargetBranch
+	trigger.HeadRef = attributes.SourceBranch
+
+	return &trigger, nil
+}
+
+func NewWebhooks() *Webhooks {
+	return &Webhooks{
+		workflow:  NewWorkflow(),
+		inventory: NewInventory(),
+		agent:     NewAgent(),
+	}
+}
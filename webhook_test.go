@@ -0,0 +1,333 @@
+package storm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const webhookSecret = "s3cr3t"
+
+func readWebhookSample(t *testing.T, name string) []byte {
+	t.Helper()
+
+	body, err := os.ReadFile("samples/webhooks/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+// Hex encoded HMAC-SHA256 of the body, as `openssl dgst -sha256 -hmac` prints it
+func signWebhook(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookHeader(values map[string]string) http.Header {
+	header := http.Header{}
+	for name, value := range values {
+		header.Set(name, value)
+	}
+
+	return header
+}
+
+func TestParseWebhook(t *testing.T) {
+	githubPush := readWebhookSample(t, "github-push.json")
+	gitlabPush := readWebhookSample(t, "gitlab-push.json")
+	giteaPullRequest := readWebhookSample(t, "gitea-pull-request.json")
+
+	tests := []struct {
+		name    string
+		header  http.Header
+		body    []byte
+		trigger *TriggerContext
+	}{
+		{
+			name: "github push",
+			header: webhookHeader(map[string]string{
+				"X-GitHub-Event":      "push",
+				"X-Hub-Signature-256": "sha256=" + signWebhook(githubPush, webhookSecret),
+			}),
+			body: githubPush,
+			trigger: &TriggerContext{
+				Event:        TriggerPush,
+				Ref:          "refs/heads/main",
+				Sha:          "59b20b8d5c6ff8d09518454d4dd8b7b30f095ab5",
+				Before:       "6113728f27ae82c7b1a177c8d03f9e96e0adf246",
+				Repository:   "octo-org/app",
+				Actor:        "octocat",
+				ChangedPaths: []string{"src/main.go"},
+			},
+		},
+		{
+			name: "gitlab push",
+			header: webhookHeader(map[string]string{
+				"X-Gitlab-Event": "Push Hook",
+				"X-Gitlab-Token": webhookSecret,
+			}),
+			body: gitlabPush,
+			trigger: &TriggerContext{
+				Event:        TriggerPush,
+				Ref:          "refs/heads/main",
+				Sha:          "59b20b8d5c6ff8d09518454d4dd8b7b30f095ab5",
+				Before:       "6113728f27ae82c7b1a177c8d03f9e96e0adf246",
+				Repository:   "group/app",
+				Actor:        "gitlab-user",
+				ChangedPaths: []string{"src/new.go"},
+			},
+		},
+		{
+			// Gitea sends GitHub's headers too, its own signature is the one checked
+			name: "gitea pull request",
+			header: webhookHeader(map[string]string{
+				"X-Gitea-Event":       "pull_request",
+				"X-Gitea-Signature":   signWebhook(giteaPullRequest, webhookSecret),
+				"X-GitHub-Event":      "pull_request",
+				"X-Hub-Signature-256": "sha256=invalid",
+			}),
+			body: giteaPullRequest,
+			trigger: &TriggerContext{
+				Event:      TriggerPullRequest,
+				Ref:        "refs/pull/12/head",
+				Sha:        "59b20b8d5c6ff8d09518454d4dd8b7b30f095ab5",
+				Before:     "6113728f27ae82c7b1a177c8d03f9e96e0adf246",
+				Repository: "ops/app",
+				Actor:      "gitea-user",
+				Action:     PullRequestOpened,
+				Number:     12,
+				BaseRef:    "main",
+				HeadRef:    "feature/login",
+			},
+		},
+		{
+			name: "github ping",
+			header: webhookHeader(map[string]string{
+				"X-GitHub-Event":      "ping",
+				"X-Hub-Signature-256": "sha256=" + signWebhook([]byte(`{}`), webhookSecret),
+			}),
+			body:    []byte(`{}`),
+			trigger: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trigger, err := ParseWebhook(test.header, test.body, webhookSecret)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(trigger, test.trigger) {
+				t.Errorf("got %+v, want %+v", trigger, test.trigger)
+			}
+		})
+	}
+}
+
+func TestParseWebhookInvalidSignature(t *testing.T) {
+	githubPush := readWebhookSample(t, "github-push.json")
+	gitlabPush := readWebhookSample(t, "gitlab-push.json")
+	giteaPullRequest := readWebhookSample(t, "gitea-pull-request.json")
+
+	tampered := []byte(strings.Replace(string(githubPush), "octocat", "mallory", 1))
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   []byte
+		secret string
+	}{
+		{
+			name:   "github signed with another secret",
+			header: webhookHeader(map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signWebhook(githubPush, "other")}),
+			body:   githubPush,
+			secret: webhookSecret,
+		},
+		{
+			name:   "github tampered body",
+			header: webhookHeader(map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signWebhook(githubPush, webhookSecret)}),
+			body:   tampered,
+			secret: webhookSecret,
+		},
+		{
+			name:   "github signature without prefix",
+			header: webhookHeader(map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": signWebhook(githubPush, webhookSecret)}),
+			body:   githubPush,
+			secret: webhookSecret,
+		},
+		{
+			name:   "github without signature",
+			header: webhookHeader(map[string]string{"X-GitHub-Event": "push"}),
+			body:   githubPush,
+			secret: webhookSecret,
+		},
+		{
+			name:   "github without secret",
+			header: webhookHeader(map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signWebhook(githubPush, "")}),
+			body:   githubPush,
+			secret: "",
+		},
+		{
+			name:   "gitea signature not hex",
+			header: webhookHeader(map[string]string{"X-Gitea-Event": "pull_request", "X-Gitea-Signature": "not-hex"}),
+			body:   giteaPullRequest,
+			secret: webhookSecret,
+		},
+		{
+			name:   "gitea signed with another secret",
+			header: webhookHeader(map[string]string{"X-Gitea-Event": "pull_request", "X-Gitea-Signature": signWebhook(giteaPullRequest, "other")}),
+			body:   giteaPullRequest,
+			secret: webhookSecret,
+		},
+		{
+			name:   "gitlab wrong token",
+			header: webhookHeader(map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "other"}),
+			body:   gitlabPush,
+			secret: webhookSecret,
+		},
+		{
+			name:   "gitlab without token",
+			header: webhookHeader(map[string]string{"X-Gitlab-Event": "Push Hook"}),
+			body:   gitlabPush,
+			secret: webhookSecret,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trigger, err := ParseWebhook(test.header, test.body, test.secret)
+			if !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("got %v, want %v", err, ErrInvalidSignature)
+			}
+			if trigger != nil {
+				t.Errorf("got %+v, want no trigger", trigger)
+			}
+		})
+	}
+}
+
+func TestWebhookTriggeredBy(t *testing.T) {
+	wc, err := NewWorkflow().Load("samples/webhooks/workflow.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	githubPush := readWebhookSample(t, "github-push.json")
+	gitlabPush := readWebhookSample(t, "gitlab-push.json")
+	giteaPullRequest := readWebhookSample(t, "gitea-pull-request.json")
+
+	docsPush := []byte(strings.Replace(string(githubPush), "src/main.go", "docs/index.md", 1))
+	branchPush := []byte(strings.Replace(string(githubPush), "refs/heads/main", "refs/heads/feature/login", 1))
+	tagPush := []byte(strings.Replace(string(githubPush), "refs/heads/main", "refs/tags/v1.0.0", 1))
+	closedPullRequest := []byte(strings.Replace(string(giteaPullRequest), `"opened"`, `"closed"`, 1))
+	otherBasePullRequest := []byte(strings.Replace(string(giteaPullRequest), `"ref": "main"`, `"ref": "develop"`, 1))
+
+	github := func(body []byte) http.Header {
+		return webhookHeader(map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signWebhook(body, webhookSecret)})
+	}
+	gitea := func(body []byte) http.Header {
+		return webhookHeader(map[string]string{"X-Gitea-Event": "pull_request", "X-Gitea-Signature": signWebhook(body, webhookSecret)})
+	}
+
+	tests := []struct {
+		name      string
+		header    http.Header
+		body      []byte
+		triggered bool
+	}{
+		{"github push changing src", github(githubPush), githubPush, true},
+		{"gitlab push adding to src", webhookHeader(map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": webhookSecret}), gitlabPush, true},
+		{"push changing docs only", github(docsPush), docsPush, false},
+		{"push to another branch", github(branchPush), branchPush, false},
+		{"tag push with branch filters", github(tagPush), tagPush, false},
+		{"pull request opened on main", gitea(giteaPullRequest), giteaPullRequest, true},
+		{"pull request closed", gitea(closedPullRequest), closedPullRequest, false},
+		{"pull request on another base", gitea(otherBasePullRequest), otherBasePullRequest, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trigger, err := ParseWebhook(test.header, test.body, webhookSecret)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if triggered := wc.TriggeredBy(*trigger); triggered != test.triggered {
+				t.Errorf("got triggered %v, want %v", triggered, test.triggered)
+			}
+		})
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	// Nothing is triggered by the pushes to main, no run starts
+	untriggered := "name: release\non:\n  push:\n    branches: [release]\njobs:\n  - name: j\n    steps:\n      - name: s\n        run: echo s\n"
+
+	tests := []struct {
+		name      string
+		files     map[string]string
+		event     string
+		status    int
+		workflows []any
+		error     string
+	}{
+		{"nothing triggered", map[string]string{"release.yaml": untriggered}, "push", http.StatusOK, []any{}, ""},
+		{"ping", map[string]string{"broken.yaml": "name: ["}, "ping", http.StatusOK, []any{}, ""},
+		{"invalid workflow", map[string]string{"release.yaml": untriggered, "broken.yaml": "name: w\njobs: {}\n"}, "push", http.StatusInternalServerError, []any{}, "broken.yaml"},
+		{"missing directory", nil, "push", http.StatusInternalServerError, []any{}, "could not read workflows directory"},
+	}
+
+	body := readWebhookSample(t, "github-push.json")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			workflows := filepath.Join(t.TempDir(), "missing")
+			if test.files != nil {
+				workflows = writeWorkflowFiles(t, test.files)
+			}
+
+			handler, err := NewWebhooks().Handler(WebhookServeArgs{Secret: webhookSecret, Workflows: workflows})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			request := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			request.Header = webhookHeader(map[string]string{"X-GitHub-Event": test.event, "X-Hub-Signature-256": "sha256=" + signWebhook(body, webhookSecret)})
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, request)
+
+			response := map[string]any{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid response %q; %v", recorder.Body.String(), err)
+			}
+
+			if recorder.Code != test.status {
+				t.Errorf("got status %d, want %d", recorder.Code, test.status)
+			}
+			if !reflect.DeepEqual(response["workflows"], test.workflows) {
+				t.Errorf("got workflows %v, want %v", response["workflows"], test.workflows)
+			}
+
+			message, _ := response["error"].(string)
+			if (test.error == "") != (message == "") || !strings.Contains(message, test.error) {
+				t.Errorf("got error %q, want it to contain %q", message, test.error)
+			}
+		})
+	}
+}
@@ -2,12 +2,13 @@ package storm
 
 import (
 	"bufio"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/samber/lo"
@@ -16,13 +17,32 @@ import (
 
 type Workflow struct{}
 
+// Load a workflow file; every problem found in it is reported as `Diagnostics`
 func (w *Workflow) Load(file string) (*WorkflowConfig, error) {
-	workflow := WorkflowConfig{}
+	fileContent, err := os.ReadFile(file)
+	if err != nil {
+		return nil, Diagnostics{{File: file, Message: err.Error()}}
+	}
+
+	return w.Parse(file, fileContent)
+}
+
+// Parse workflow content; `file` is used to report diagnostics and to find
+// the files its jobs use and its steps include
+func (w *Workflow) Parse(file string, content []byte) (*WorkflowConfig, error) {
+	workflow, diagnostics := w.check(file, content)
+	if len(diagnostics) > 0 {
+		return nil, diagnostics
+	}
 
-	fileContent, _ := os.ReadFile(file)
-	yaml.Unmarshal([]byte(fileContent), &workflow)
+	resolver := includeResolver{workflow: w}
 
-	return &workflow, nil
+	diagnostics = resolver.resolveWorkflow(file, content, workflow)
+	if len(diagnostics) > 0 {
+		return nil, diagnostics
+	}
+
+	return workflow, nil
 }
 
 func (w *Workflow) Dump(content WorkflowConfig) (*string, error) {
@@ -39,31 +59,33 @@ type State struct {
 
 type JobState map[string]State
 
-const (
-	StepOutputTypePlain = iota + 1
-	StepOutputTypeStruct
-	StepOutputTypeJson
-)
+type WorkflowRunArgs struct {
+	File     *string
+	Config   *WorkflowConfig
+	Handlers []func(Event)
 
-type StepOutputPlain string
-
-type WorkflowStepOutputStruct struct {
-	// workflow step path
-	// 	example; `build.installing curl`, means 👇
-	// 	- name: build
-	// 		steps:
-	// 		- name: installing curl
-	// 			run: sudo apt install -y curl
-	Path    string
-	Command string
-	Message string
-}
+	// Defaults to a new run id
+	RunId   string
+	History *History
 
-type WorkflowRunArgs struct {
-	File           *string
-	Config         *WorkflowConfig
-	Callback       func(interface{})
-	StepOutputType int
+	Resume *ResumeState
+
+	// `KEY=value` variables set for every step
+	Env []string
+
+	// Values of the workflow's `on.dispatch.inputs`
+	Inputs map[string]string
+
+	// Variables templates render with
+	Vars map[string]any
+
+	// Facts of the host; gathered from the current machine when not given
+	Facts *Facts
+
+	// Report what would change instead of changing it, and show changes to
+	// files as unified diffs
+	Check bool
+	Diff  bool
 }
 
 type WorkflowRunOptions func(*WorkflowRunArgs)
@@ -80,18 +102,87 @@ func (w *Workflow) WorkflowWithConfig(config WorkflowConfig) WorkflowRunOptions
 	}
 }
 
-func (w *Workflow) WorkflowWithCallback(callback func(interface{}), sot int) WorkflowRunOptions {
+// Receive every event of the run; can be used multiple times. Without any
+// handler the run is rendered as plain text to stdout.
+func (w *Workflow) WorkflowWithHandler(handler func(Event)) WorkflowRunOptions {
+	return func(wra *WorkflowRunArgs) {
+		wra.Handlers = append(wra.Handlers, handler)
+	}
+}
+
+// Publish every event of the run to the bus' subscribers
+func (w *Workflow) WorkflowWithEvents(bus *EventBus) WorkflowRunOptions {
+	return w.WorkflowWithHandler(bus.Publish)
+}
+
+func (w *Workflow) WorkflowWithRunId(id string) WorkflowRunOptions {
+	return func(wra *WorkflowRunArgs) {
+		wra.RunId = id
+	}
+}
+
+// Record the run, its events and outputs in the run history
+func (w *Workflow) WorkflowWithHistory(history *History) WorkflowRunOptions {
+	return func(wra *WorkflowRunArgs) {
+		wra.History = history
+	}
+}
+
+// Skip the jobs a previous run completed and restart from the first one it
+// did not
+func (w *Workflow) WorkflowWithResume(state ResumeState) WorkflowRunOptions {
+	return func(wra *WorkflowRunArgs) {
+		wra.Resume = &state
+	}
+}
+
+// Set `KEY=value` environment variables for every step of the run
+func (w *Workflow) WorkflowWithEnv(env ...string) WorkflowRunOptions {
+	return func(wra *WorkflowRunArgs) {
+		wra.Env = append(wra.Env, env...)
+	}
+}
+
+// Give the workflow's `on.dispatch.inputs`; checked before anything runs
+func (w *Workflow) WorkflowWithInputs(inputs map[string]string) WorkflowRunOptions {
+	return func(wra *WorkflowRunArgs) {
+		wra.Inputs = inputs
+	}
+}
+
+// Give the variables templates render with, as `.Vars`
+func (w *Workflow) WorkflowWithVars(vars map[string]any) WorkflowRunOptions {
 	return func(wra *WorkflowRunArgs) {
-		wra.Callback = callback
-		wra.StepOutputType = sot
+		wra.Vars = vars
 	}
 }
 
-func (w *Workflow) Run(opts ...WorkflowRunOptions) error {
-	args := WorkflowRunArgs{
-		StepOutputType: StepOutputTypePlain,
-		Callback:       func(sos interface{}) {},
+// Give the facts of the host, e.g. the ones the agent gathered over SSH
+func (w *Workflow) WorkflowWithFacts(facts Facts) WorkflowRunOptions {
+	return func(wra *WorkflowRunArgs) {
+		wra.Facts = &facts
 	}
+}
+
+// Report what the run would change without changing anything. Modules, copy
+// and template steps tell what they would do; run and uses steps are skipped
+// unless they are check-safe, or reported as what would run when their guards
+// say their work is not done.
+func (w *Workflow) WorkflowWithCheck() WorkflowRunOptions {
+	return func(wra *WorkflowRunArgs) {
+		wra.Check = true
+	}
+}
+
+// Show the changes to files, made or that would be, as unified diffs
+func (w *Workflow) WorkflowWithDiff() WorkflowRunOptions {
+	return func(wra *WorkflowRunArgs) {
+		wra.Diff = true
+	}
+}
+
+func (w *Workflow) Run(opts ...WorkflowRunOptions) (err error) {
+	args := WorkflowRunArgs{}
 
 	for _, opt := range opts {
 		opt(&args)
@@ -110,85 +201,289 @@ func (w *Workflow) Run(opts ...WorkflowRunOptions) error {
 		args.Config = _config
 	}
 
+	// The history keeps the workflow as written, with its inputs
+	workflowConfig := *args.Config
+
+	if args.Facts == nil {
+		args.Facts = lo.ToPtr(GatherLocalFacts())
+	}
+
+	config, inputs, err := applyInputs(*args.Config, args.Inputs, args.Facts.values())
+	if err != nil {
+		return err
+	}
+	args.Config = &config
+	expressions := ExpressionContext{Inputs: inputs, Facts: args.Facts.values()}
+	args.Env = append(args.Env, InputsEnv(inputs)...)
+
+	// Jobs run in file order, but always after the job they need, which may
+	// be defined after them
+	jobs, err := NewJobGraph(args.Config.Jobs).Order()
+	if err != nil {
+		return err
+	}
+
+	fromJob, fromStep := "", ""
+	if args.Resume != nil && args.Resume.FromStep != "" {
+		fromJob = args.Resume.failedJob()
+
+		job, found := lo.Find(jobs, func(j Job) bool { return j.Name == fromJob })
+		if found && !lo.ContainsBy(job.Steps, func(s Step) bool { return s.Name == args.Resume.FromStep }) {
+			return fmt.Errorf("cannot resume from step %s; %s job has no such step", args.Resume.FromStep, job.Name)
+		}
+
+		fromStep = args.Resume.FromStep
+	}
+
+	if len(args.Handlers) == 0 {
+		args.Handlers = append(args.Handlers, NewPlainRenderer(os.Stdout).Render)
+	}
+
+	if args.RunId == "" {
+		args.RunId = NewRunId()
+	}
+
+	if args.History != nil {
+		recorder, startErr := args.History.Start(HistoryStartArgs{
+			Id:       args.RunId,
+			Mode:     RunModeLocal,
+			Workflow: workflowConfig,
+			Inputs:   inputs,
+
+			ResumedFrom: lo.TernaryF(args.Resume != nil, func() string { return args.Resume.RunId }, func() string { return "" }),
+		})
+		if startErr != nil {
+			return startErr
+		}
+		defer func() { recorder.Finish(err) }()
+
+		args.Handlers = append(args.Handlers, recorder.Handle)
+	}
+
+	emit := newEventDispatcher(args.Handlers)
+	meta := func(job string, step string) EventMeta {
+		return EventMeta{
+			RunId:    args.RunId,
+			Time:     time.Now().UTC(),
+			Workflow: args.Config.Name,
+			Job:      job,
+			Step:     step,
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	templateData := TemplateData{
+		Vars:     args.Vars,
+		Host:     TemplateHost{Name: hostname},
+		Facts:    *args.Facts,
+		Inputs:   inputs,
+		Workflow: args.Config.Name,
+	}
+
+	// Run a step of a job, or one of its handlers; reports whether it changed
+	// anything
+	runStep := func(job Job, step Step) (bool, int, error) {
+		callback := func(stream string) func(string) {
+			return func(s string) {
+				emit(&StepOutput{EventMeta: meta(job.Name, step.Name), Stream: stream, Line: s})
+			}
+		}
+
+		executeArgs := ExecuteArgs{
+			Directory:      lo.Ternary(step.Directory != "", step.Directory, args.Config.Directory),
+			Command:        step.Run,
+			Env:            args.Env,
+			OutputCallback: callback(StreamStdout),
+			ErrorCallback:  callback(StreamStderr),
+			Check:          args.Check,
+			Diff:           args.Diff,
+		}
+
+		// Run and uses steps can change anything; in check mode, only the ones
+		// that are safe to run, or that guards can tell would run, are kept
+		unsafe := args.Check && !step.CheckSafe && (step.Run != "" || step.Uses != "")
+
+		if step.If != "" {
+			holds, err := expressions.Condition(step.If)
+			if err != nil {
+				return false, 1, err
+			}
+			if !holds {
+				emit(&StepSkipped{EventMeta: meta(job.Name, step.Name), Reason: fmt.Sprintf("if %q is false", step.If)})
+				return false, 0, nil
+			}
+		}
+
+		if unsafe && !step.guarded() {
+			emit(&StepSkipped{EventMeta: meta(job.Name, step.Name), Reason: "check mode; not check-safe"})
+			return false, 0, nil
+		}
+
+		if reason := w.guard(step, executeArgs); reason != "" {
+			emit(&StepSkipped{EventMeta: meta(job.Name, step.Name), Reason: reason})
+			return false, 0, nil
+		}
+
+		emit(&StepStarted{EventMeta: meta(job.Name, step.Name), Command: step.command()})
+
+		stepStart := time.Now()
+
+		var outputs map[string]string
+		var exitCode int
+		var changed bool
+		var err error
+
+		switch {
+		case unsafe:
+			executeArgs.OutputCallback("would run")
+			changed = true
+		case step.Uses != "":
+			outputs, exitCode, err = w.executeAction(step, executeArgs, expressions.Facts)
+			outputs, changed, exitCode, err = step.changed(outputs, exitCode, err)
+		case step.Copy != nil || step.Template != nil:
+			data := templateData
+			data.Job = job.Name
+
+			changed, err = w.executeFile(step, executeArgs, data)
+			exitCode = lo.Ternary(err != nil, 1, 0)
+		case step.Module != "":
+			changed, err = w.executeModule(step, executeArgs)
+			exitCode = lo.Ternary(err != nil, 1, 0)
+		default:
+			outputs, exitCode, err = w.executeStep(executeArgs)
+			outputs, changed, exitCode, err = step.changed(outputs, exitCode, err)
+		}
+
+		stepFinished := &StepFinished{
+			EventMeta: meta(job.Name, step.Name),
+			ExitCode:  exitCode,
+			Duration:  time.Since(stepStart),
+			Outputs:   outputs,
+			Changed:   changed,
+		}
+		if err != nil {
+			stepFinished.Error = err.Error()
+		}
+		emit(stepFinished)
+
+		return changed, exitCode, err
+	}
+
+	runStart := time.Now()
+	emit(&RunStarted{EventMeta: meta("", "")})
+
 	jobState := make(JobState, 0)
+	failedJobs := []string{}
 
-	for _, job := range args.Config.Jobs {
+	for _, job := range jobs {
 		jobState[job.Name] = State{IsSuccessful: true, IsCompleted: true}
 
-		// TODO: handle error for when `job.Needs` is not found in `jobState`; aka, don't exist
+		if args.Resume != nil {
+			if completed := args.Resume.CompletedJob(job.Name); completed != nil {
+				// Jobs completed before the resumed run keep the run they completed in
+				resumedFrom := lo.Ternary(completed.ResumedFrom != "", completed.ResumedFrom, args.Resume.RunId)
+				reason := fmt.Sprintf("completed in run %s", resumedFrom)
+
+				emit(&JobSkipped{EventMeta: meta(job.Name, ""), Reason: reason, ResumedFrom: resumedFrom})
+				for _, step := range completed.Steps {
+					emit(&StepSkipped{EventMeta: meta(job.Name, step.Name), Reason: reason, Outputs: step.Outputs})
+				}
+
+				continue
+			}
+		}
+
 		if job.Needs != "" && (!jobState[job.Needs].IsCompleted || !jobState[job.Needs].IsSuccessful) {
-			err := fmt.Errorf("> dependencies error, %s job failed", job.Needs)
-			fmt.Println(err)
+			err := fmt.Errorf("dependencies error, %s job failed", job.Needs)
+
+			emit(&RunFinished{
+				EventMeta: meta("", ""),
+				ExitCode:  1,
+				Duration:  time.Since(runStart),
+				Error:     err.Error(),
+			})
 
 			return err
 		}
 
-		start := time.Now()
+		// Jobs that need a skipped job still run, their own conditions decide
+		if job.If != "" {
+			holds, err := expressions.Condition(job.If)
+			if err != nil {
+				emit(&RunFinished{
+					EventMeta: meta("", ""),
+					ExitCode:  1,
+					Duration:  time.Since(runStart),
+					Error:     err.Error(),
+				})
 
-		if args.StepOutputType == StepOutputTypePlain {
-			fmt.Printf("[%s]\n", job.Name)
+				return err
+			}
+			if !holds {
+				emit(&JobSkipped{EventMeta: meta(job.Name, ""), Reason: fmt.Sprintf("if %q is false", job.If)})
+				continue
+			}
 		}
 
-		err := func() error {
-			for _, step := range job.Steps {
-				if args.StepOutputType == StepOutputTypePlain {
-					fmt.Printf("-> %s\n", step.Name)
-					fmt.Printf("$ %s \n", step.Run)
-				}
+		start := time.Now()
 
-				callback := func(s string) {
-					switch args.StepOutputType {
-					case StepOutputTypePlain:
-						fmt.Println("> ", s)
-					case StepOutputTypeStruct:
-						args.Callback(WorkflowStepOutputStruct{
-							Path:    fmt.Sprintf("%s.%s", job.Name, step.Name),
-							Command: step.Run,
-							Message: s,
+		emit(&JobStarted{EventMeta: meta(job.Name, "")})
+
+		exitCode, err := func() (int, error) {
+			// Handlers changed steps notified
+			notified := map[string]bool{}
+
+			for _, step := range job.Steps {
+				if fromStep != "" && job.Name == fromJob {
+					if step.Name != fromStep {
+						emit(&StepSkipped{
+							EventMeta: meta(job.Name, step.Name),
+							Reason:    args.Resume.reason(),
+							Outputs:   args.Resume.StepOutputs(job.Name, step.Name),
 						})
-					case StepOutputTypeJson:
-						payload := WorkflowStepOutputStruct{
-							Path:    fmt.Sprintf("%s.%s", job.Name, step.Name),
-							Command: step.Run,
-							Message: s,
-						}
-						payloadString, err := json.Marshal(&payload)
-						if err != nil {
-							fmt.Println("could not marshel workflow payload to json. reason: ", err)
-							break
-						}
-
-						args.Callback(string(payloadString))
+
+						continue
 					}
+
+					fromStep = ""
 				}
 
-				err := w.Execute(ExecuteArgs{
-					Directory:      lo.Ternary(step.Directory != "", step.Directory, args.Config.Directory),
-					Command:        step.Run,
-					OutputCallback: callback,
-					ErrorCallback:  callback,
-				})
+				changed, exitCode, err := runStep(job, step)
 				if err != nil {
-					return err
+					return exitCode, err
+				}
+
+				if changed && step.Notify != "" {
+					notified[step.Notify] = true
 				}
 			}
 
-			return nil
+			for _, handler := range job.Handlers {
+				if !notified[handler.Name] {
+					continue
+				}
+
+				_, exitCode, err := runStep(job, handler)
+				if err != nil {
+					return exitCode, err
+				}
+			}
+
+			return 0, nil
 		}()
 
 		end := time.Now()
 		duration := end.Sub(start)
 
-		switch args.StepOutputType {
-		case StepOutputTypePlain:
-			fmt.Printf("Took %fs to run.\n\n", duration.Seconds())
-		case StepOutputTypeStruct:
-			args.Callback(WorkflowStepOutputStruct{
-				Path:    "__builtin__.TimeTaken",
-				Command: "TimeTaken",
-				Message: fmt.Sprintf("%fs", duration.Seconds()),
-			})
+		jobFinished := &JobFinished{
+			EventMeta: meta(job.Name, ""),
+			ExitCode:  exitCode,
+			Duration:  duration,
 		}
+		if err != nil {
+			jobFinished.Error = err.Error()
+		}
+		emit(jobFinished)
 
 		if err != nil {
 			state := jobState[job.Name]
@@ -196,36 +491,138 @@ func (w *Workflow) Run(opts ...WorkflowRunOptions) error {
 			state.IsCompleted = false
 
 			jobState[job.Name] = state
+			failedJobs = append(failedJobs, job.Name)
 		}
 	}
 
+	runFinished := &RunFinished{
+		EventMeta: meta("", ""),
+		ExitCode:  lo.Ternary(len(failedJobs) > 0, 1, 0),
+		Duration:  time.Since(runStart),
+	}
+
+	if len(failedJobs) > 0 {
+		err := fmt.Errorf("workflow failed; failed jobs: %s", strings.Join(failedJobs, ", "))
+		runFinished.Error = err.Error()
+		emit(runFinished)
+
+		return err
+	}
+
+	emit(runFinished)
+
 	return nil
 }
 
+// Run a step's command with a `STORM_OUTPUT` file the command can append
+// `key=value` lines to, and return the outputs it wrote and its exit code
+func (w *Workflow) executeStep(args ExecuteArgs) (map[string]string, int, error) {
+	outputFile, err := os.CreateTemp("", "storm-output-*")
+	if err != nil {
+		return nil, 1, fmt.Errorf("cannot create step output file %w", err)
+	}
+	outputFile.Close()
+	defer os.Remove(outputFile.Name())
+
+	args.Env = append(args.Env, fmt.Sprintf("STORM_OUTPUT=%s", outputFile.Name()))
+
+	err = w.Execute(args)
+
+	exitCode := 0
+	if err != nil {
+		exitCode = 1
+
+		exitError := &exec.ExitError{}
+		if errors.As(err, &exitError) && exitError.ExitCode() > 0 {
+			exitCode = exitError.ExitCode()
+		}
+	}
+
+	content, readErr := os.ReadFile(outputFile.Name())
+	if readErr != nil {
+		return nil, exitCode, err
+	}
+
+	return ParseStepOutputs(string(content)), exitCode, err
+}
+
+// Output run and uses steps write to `STORM_OUTPUT` to say whether they
+// changed anything; `changed=true` or `changed=false`
+const ChangedOutput = "changed"
+
+// Whether a run or uses step changed anything, with the `changed` output taken
+// out of its outputs. The output says so when written; otherwise exiting with
+// the step's changed exit code does, and is not a failure, and without one any
+// step that succeeded did.
+func (s Step) changed(outputs map[string]string, exitCode int, err error) (map[string]string, bool, int, error) {
+	changed := err == nil
+
+	if s.ChangedExitCode != 0 {
+		changed = exitCode == s.ChangedExitCode
+		if changed {
+			exitCode, err = 0, nil
+		}
+	}
+
+	if value, found := outputs[ChangedOutput]; found {
+		if reported, parseErr := strconv.ParseBool(strings.TrimSpace(value)); parseErr == nil {
+			changed = reported && err == nil
+		}
+
+		outputs = lo.OmitByKeys(outputs, []string{ChangedOutput})
+		if len(outputs) == 0 {
+			outputs = nil
+		}
+	}
+
+	return outputs, changed, exitCode, err
+}
+
+// Parse `key=value` lines written to a step's `STORM_OUTPUT` file
+func ParseStepOutputs(content string) map[string]string {
+	outputs := map[string]string{}
+
+	for _, line := range strings.Split(content, "\n") {
+		key, value, found := strings.Cut(strings.TrimRight(line, "\r"), "=")
+		if !found || strings.TrimSpace(key) == "" {
+			continue
+		}
+
+		outputs[strings.TrimSpace(key)] = value
+	}
+
+	if len(outputs) == 0 {
+		return nil
+	}
+
+	return outputs
+}
+
 type ExecuteArgs struct {
 	Directory      string
 	Command        string
 	OutputCallback func(string)
 	ErrorCallback  func(string)
+
+	// Extra environment variables, in `KEY=value` form
+	Env []string
+
+	// Report what would change without changing anything, and show changes to
+	// files as unified diffs
+	Check bool
+	Diff  bool
 }
 
 func (w *Workflow) Execute(args ExecuteArgs) error {
 	// Trim any leading/trailing whitespace
 	command := strings.TrimSpace(args.Command)
 
-	currentDirectory, err := os.Getwd()
-	if err != nil {
-		return fmt.Errorf("cannot get current directory %w", err)
-	}
-
-	err = os.Chdir(args.Directory)
-	if err != nil {
-		return fmt.Errorf("cannot change directory %w", err)
-	}
-
-	defer os.Chdir(currentDirectory)
-
 	currentCmd := exec.Command("/bin/bash", "-c", command)
+	currentCmd.Env = append(os.Environ(), args.Env...)
+
+	// Without a directory, commands run from the current one; runs can overlap,
+	// the process' directory is left alone
+	currentCmd.Dir = args.Directory
 
 	stdoutPipe, err := currentCmd.StdoutPipe()
 	if err != nil {
@@ -242,8 +639,13 @@ func (w *Workflow) Execute(args ExecuteArgs) error {
 		return fmt.Errorf("error starting command: %w", err)
 	}
 
+	var wg sync.WaitGroup
+	wg.Add(2)
+
 	// Stream stdout to the output callback
 	go func() {
+		defer wg.Done()
+
 		scanner := bufio.NewScanner(stdoutPipe)
 		for scanner.Scan() {
 			args.OutputCallback(scanner.Text())
@@ -252,12 +654,17 @@ func (w *Workflow) Execute(args ExecuteArgs) error {
 
 	// Stream stderr to the error callback
 	go func() {
+		defer wg.Done()
+
 		scanner := bufio.NewScanner(stderrPipe)
 		for scanner.Scan() {
 			args.ErrorCallback(scanner.Text())
 		}
 	}()
 
+	// All output must be read before waiting, `Wait` closes the pipes
+	wg.Wait()
+
 	// Wait for the command to finish
 	if err := currentCmd.Wait(); err != nil {
 		return fmt.Errorf("error waiting for command: %w", err)
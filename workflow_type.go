@@ -1,26 +1,174 @@
 package storm
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
 type WorkflowConfig struct {
-	Name string `yaml:"name"`
-	On   struct {
-		Push        struct{} `yaml:"push"`
-		PullRequest struct{} `yaml:"pull-request"`
-	} `yaml:"on"`
-	Jobs []Job `yaml:"jobs"`
+	Name string   `yaml:"name" description:"The name of the workflow." schema:"required,minLength=1"`
+	On   Triggers `yaml:"on" description:"Events that trigger the workflow."`
+	Jobs []Job    `yaml:"jobs" schema:"required,minItems=1"`
 
 	// Directory to run the workflow from, defaults to the current directory
-	Directory string `yaml:"directory"`
+	Directory string `yaml:"directory" description:"Directory to run the workflow from"`
+}
+
+type Triggers struct {
+	Push        *PushTrigger        `yaml:"push,omitempty" description:"Run the workflow when commits are pushed."`
+	PullRequest *PullRequestTrigger `yaml:"pull-request,omitempty" description:"Run the workflow when a pull request changes."`
+	Schedule    []ScheduleTrigger   `yaml:"schedule,omitempty" description:"Run the workflow at times given by cron expressions, with storm scheduler."`
+	Dispatch    *DispatchTrigger    `yaml:"dispatch,omitempty" description:"Run the workflow by hand, with storm run or storm agent run."`
+}
+
+// Filters of the pushes that trigger a workflow; an empty filter matches
+// everything, patterns are globs and a leading `!` excludes
+type PushTrigger struct {
+	Branches []string `yaml:"branches,omitempty" description:"Branches whose pushes run the workflow, e.g. main or release/**."`
+	Tags     []string `yaml:"tags,omitempty" description:"Tags whose pushes run the workflow, e.g. v*."`
+	Paths    []string `yaml:"paths,omitempty" description:"Run the workflow only when a changed file matches one of the paths."`
+}
+
+// Filters of the pull request changes that trigger a workflow
+type PullRequestTrigger struct {
+	Branches []string `yaml:"branches,omitempty" description:"Target branches of the pull requests that run the workflow."`
+	Types    []string `yaml:"types,omitempty" description:"Pull request actions that run the workflow; opened, synchronize, reopened or closed. Defaults to opened, synchronize and reopened."`
+}
+
+type ScheduleTrigger struct {
+	Cron     string `yaml:"cron" description:"When to run; minute hour day-of-month month day-of-week, or @hourly, @daily, @weekly, @monthly and @yearly." schema:"required,minLength=1"`
+	Timezone string `yaml:"timezone,omitempty" description:"Timezone of the cron expression, e.g. Europe/Berlin. Defaults to the scheduler's timezone."`
+	Overlap  string `yaml:"overlap,omitempty" description:"What to do when it is time to run and the previous run is not done; skip, queue or allow. Defaults to skip."`
+	Jitter   string `yaml:"jitter,omitempty" description:"Longest delay added to the start on each host, e.g. 5m; spreads hosts out."`
+}
+
+func (s *ScheduleTrigger) extendSchema(schema *orderedObject) {
+	properties := schema.values["properties"].(*orderedObject)
+	properties.values["overlap"].(*orderedObject).Set("enum", []string{OverlapSkip, OverlapQueue, OverlapAllow})
+}
+
+type DispatchTrigger struct {
+	Inputs map[string]DispatchInput `yaml:"inputs,omitempty" description:"Inputs given with --input name=value; available to steps as ${{ inputs.name }} and STORM_INPUT_NAME."`
+}
+
+type DispatchInput struct {
+	Type        string   `yaml:"type,omitempty" description:"string, number, boolean or choice. Defaults to string."`
+	Description string   `yaml:"description,omitempty" description:"What the input is for."`
+	Required    bool     `yaml:"required,omitempty" description:"Whether the run needs the input; inputs with a default never do."`
+	Default     string   `yaml:"default,omitempty" description:"Value of the input when it is not given."`
+	Options     []string `yaml:"options,omitempty" description:"Values a choice input accepts."`
+}
+
+func (d *DispatchInput) extendSchema(schema *orderedObject) {
+	properties := schema.values["properties"].(*orderedObject)
+	properties.values["type"].(*orderedObject).Set("enum", []string{InputString, InputNumber, InputBoolean, InputChoice})
 }
 
 type Job struct {
-	Name   string `yaml:"name"`
-	RunsOn string `yaml:"runs-on"`
-	Needs  string `yaml:"needs,omitempty"`
-	Steps  []Step `yaml:"steps"`
+	Name   string `yaml:"name" description:"The name of the job." schema:"required,minLength=1"`
+	RunsOn string `yaml:"runs-on" description:"The environments where the job should run."`
+	Needs  string `yaml:"needs,omitempty" description:"The job that must complete before this job starts."`
+	If     string `yaml:"if,omitempty" description:"Condition on the inputs and facts of the host; the job is skipped when it does not hold, e.g. facts.distro == 'ubuntu'." schema:"minLength=1"`
+	Steps  []Step `yaml:"steps" schema:"minItems=1"`
+
+	// Run once, in order, at the end of the job, when a changed step notified
+	// them; not when a step failed
+	Handlers []Step `yaml:"handlers,omitempty" description:"Steps that run once at the end of the job when a step that changed something notifies them by name."`
+
+	// Resolved when the workflow is loaded; the job runs the steps of the used
+	// workflow's jobs instead of its own
+	Uses string            `yaml:"uses,omitempty" description:"Workflow file whose steps the job runs, relative to this file; e.g. ./deploy/common.yaml." schema:"minLength=1"`
+	With map[string]string `yaml:"with,omitempty" description:"Inputs of the used workflow, as declared by its on.dispatch.inputs."`
+}
+
+func (j *Job) extendSchema(schema *orderedObject) {
+	schema.Set("oneOf", []map[string][]string{
+		{"required": {"steps"}},
+		{"required": {"uses"}},
+	})
 }
 
 type Step struct {
-	Name      string `yaml:"name,omitempty"`
-	Run       string `yaml:"run,omitempty"`
-	Directory string `yaml:"directory"`
+	Name      string `yaml:"name,omitempty" description:"The name of the step." schema:"minLength=1"`
+	Run       string `yaml:"run,omitempty" description:"The command to run in this step." schema:"minLength=1"`
+	Directory string `yaml:"directory" description:"Directory to run the workflow from"`
+	If        string `yaml:"if,omitempty" description:"Condition on the inputs and facts of the host; the step is skipped when it does not hold, e.g. facts.arch == 'arm64'." schema:"minLength=1"`
+
+	// Checked before the step runs; the step is skipped when what it would do
+	// is already done
+	Creates string `yaml:"creates,omitempty" description:"Skip the step when a path matching this glob exists, e.g. /opt/app/bin/app; relative to the step's directory." schema:"minLength=1"`
+	Removes string `yaml:"removes,omitempty" description:"Skip the step unless a path matching this glob exists; relative to the step's directory." schema:"minLength=1"`
+	Unless  string `yaml:"unless,omitempty" description:"Skip the step when this command succeeds." schema:"minLength=1"`
+	OnlyIf  string `yaml:"onlyif,omitempty" description:"Skip the step unless this command succeeds." schema:"minLength=1"`
+
+	// In check mode, run and uses steps only run when they are safe to; the
+	// others are skipped, or reported as what would run when guards decide
+	CheckSafe bool `yaml:"check-safe,omitempty" description:"Run the step in check mode too; for run and uses steps that change nothing."`
+
+	// Run and uses steps that succeed changed something, unless they write
+	// `changed=false` to `STORM_OUTPUT` or declare a changed exit code
+	ChangedExitCode int    `yaml:"changed-exit-code,omitempty" description:"Exit code meaning the step succeeded and changed something; exiting with 0 then means it changed nothing." schema:"minimum=1,maximum=255"`
+	Notify          string `yaml:"notify,omitempty" description:"Handler of the job to run at its end when the step changed something." schema:"minLength=1"`
+
+	// Resolved when the workflow is loaded; replaced by the included steps
+	Include string `yaml:"include,omitempty" description:"File with a list of steps to run in place of this one, relative to this file; e.g. ./steps/install-runtime.yaml." schema:"minLength=1"`
+
+	// Checked when the workflow is loaded, and made absolute; the step runs the
+	// action's steps or script
+	Uses string            `yaml:"uses,omitempty" description:"Directory of an action to run, relative to this file; e.g. ./actions/setup-node." schema:"minLength=1"`
+	With map[string]string `yaml:"with,omitempty" description:"Inputs of the action, as declared by its inputs; or parameters of the module."`
+
+	// Checked when the workflow is loaded; the step runs a built-in module
+	// with its `with` parameters, without a shell
+	Module string `yaml:"module,omitempty" description:"Built-in module to run with the with parameters; package, service, user, group, file or lineinfile."`
+
+	// Checked when the workflow is loaded, with sources made absolute; the
+	// step writes the file itself, without a shell
+	Copy     *FileStep `yaml:"copy,omitempty" description:"Copy a file to dest; skipped when dest already has the same content, mode and owner."`
+	Template *FileStep `yaml:"template,omitempty" description:"Render a Go template to dest, with .Vars, .Host, .Inputs, .Workflow and .Job; skipped when dest already has the same content, mode and owner."`
+}
+
+type FileStep struct {
+	Src   string `yaml:"src" description:"Source file, relative to this file." schema:"required,minLength=1"`
+	Dest  string `yaml:"dest" description:"Destination file; relative paths are from the step's directory." schema:"required,minLength=1"`
+	Mode  string `yaml:"mode,omitempty" description:"Octal permissions of dest, e.g. 0644. New files default to the source's, 0644 for templates; existing files keep theirs."`
+	Owner string `yaml:"owner,omitempty" description:"Owner of dest, as user or user:group."`
+}
+
+// What the step runs, as shown to the user
+func (s Step) command() string {
+	switch {
+	case s.Uses != "":
+		return "uses " + s.Uses
+	case s.Copy != nil:
+		return fmt.Sprintf("copy %s %s", s.Copy.Src, s.Copy.Dest)
+	case s.Template != nil:
+		return fmt.Sprintf("template %s %s", s.Template.Src, s.Template.Dest)
+	case s.Module != "":
+		params := lo.Keys(s.With)
+		sort.Strings(params)
+
+		return strings.Join(append([]string{"module", s.Module}, lo.Map(params, func(param string, _ int) string {
+			return param + "=" + s.With[param]
+		})...), " ")
+	}
+
+	return s.Run
+}
+
+func (s *Step) extendSchema(schema *orderedObject) {
+	schema.Set("oneOf", []map[string][]string{
+		{"required": {"name", "run"}},
+		{"required": {"include"}},
+		{"required": {"uses"}},
+		{"required": {"copy"}},
+		{"required": {"template"}},
+		{"required": {"module"}},
+	})
+
+	properties := schema.values["properties"].(*orderedObject)
+	properties.values["module"].(*orderedObject).Set("enum", moduleNames())
 }